@@ -2,4 +2,17 @@ module github.com/example/XraySubRefiner
 
 go 1.22.0
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	github.com/refraction-networking/utls v1.6.7
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.23.0
+	golang.org/x/sys v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
+	github.com/klauspost/compress v1.17.4 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
@@ -0,0 +1,106 @@
+package refiner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// AdaptiveTimeoutCfg gives every node's TCP connect only Initial at first.
+// Nodes that did not answer in time are retried once with the Percentile
+// of the connect times seen so far, times Factor (at least twice Initial,
+// at most the probe timeout), so dead nodes in dirty feeds no longer cost
+// the full timeout each.
+type AdaptiveTimeoutCfg struct {
+	Initial    time.Duration `yaml:"initial"`
+	Percentile float64       `yaml:"percentile"`
+	Factor     float64       `yaml:"factor"`
+}
+
+// errDialCut marks nodes whose connect ran past the adaptive first cut.
+var errDialCut = errors.New("connect cut short by adaptive timeout")
+
+func (a *AdaptiveTimeoutCfg) check() error {
+	if a.Initial < 0 {
+		return fmt.Errorf("probe.adaptive_timeout.initial must not be negative")
+	}
+	if a.Percentile == 0 {
+		a.Percentile = 90
+	}
+	if a.Factor == 0 {
+		a.Factor = 3
+	}
+	if a.Percentile < 0 || a.Percentile > 100 {
+		return fmt.Errorf("probe.adaptive_timeout.percentile must be within 0-100, got %g", a.Percentile)
+	}
+	if a.Factor < 1 {
+		return fmt.Errorf("probe.adaptive_timeout.factor must be at least 1, got %g", a.Factor)
+	}
+	return nil
+}
+
+// probeAdaptive is probeLines with p.adaptive applied to the node lines
+// of key.
+func probeAdaptive(log io.Writer, key string, lines []string, p *prober, maxConcurrent, maxToTest int) []probeResult {
+	a := p.adaptive
+	if a.Initial <= 0 || a.Initial >= p.dialer.timeout {
+		return probeLines(lines, p, maxConcurrent, maxToTest)
+	}
+	quick := *p
+	quick.dialCut, quick.retryCut = a.Initial, true
+	results := probeLines(lines, &quick, maxConcurrent, maxToTest)
+
+	var slow []string
+	var rtts []time.Duration
+	for _, res := range results {
+		switch {
+		case res.err == errDialCut:
+			slow = append(slow, res.line)
+		case res.err == nil && !res.unverified:
+			rtts = append(rtts, res.latency)
+		}
+	}
+	if len(slow) == 0 {
+		return results
+	}
+
+	retry := *p
+	retry.dialCut = extendedCut(rtts, a, p.dialer.timeout)
+	fmt.Fprintf(log, "Info: %s -> %d nodes did not connect within %s, retrying with %s\n",
+		key, len(slow), a.Initial, retry.dialCut)
+	byLine := make(map[string]probeResult, len(slow))
+	for _, res := range probeLines(slow, &retry, maxConcurrent, 0) {
+		byLine[res.line] = res
+	}
+	for i := range results {
+		if res, ok := byLine[results[i].line]; ok {
+			results[i] = res
+		}
+	}
+	return results
+}
+
+// extendedCut is the connect timeout of the retry round: the configured
+// percentile of rtts times the factor, kept between twice a.Initial and
+// limit. Without any connect times to go by, the full limit is used.
+func extendedCut(rtts []time.Duration, a AdaptiveTimeoutCfg, limit time.Duration) time.Duration {
+	if len(rtts) == 0 {
+		return limit
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	i := int(math.Ceil(a.Percentile/100*float64(len(rtts)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	cut := time.Duration(float64(rtts[i]) * a.Factor)
+	if cut < 2*a.Initial {
+		cut = 2 * a.Initial
+	}
+	if cut > limit {
+		cut = limit
+	}
+	return cut
+}
@@ -0,0 +1,321 @@
+package refiner
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAgentTargets caps one agent request so a stray client cannot make an
+// agent dial the whole internet.
+const maxAgentTargets = 5000
+
+// agentBatch is how many targets the main process sends per request.
+const agentBatch = 500
+
+// AgentCfg is a remote probe agent, named after its vantage point.
+type AgentCfg struct {
+	Name  string `yaml:"name"`
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+// AgentsCfg fans TCP reachability checks out to remote agents. Require is
+// "all" (every vantage point must reach a node) or "any"; SkipLocal leaves
+// the local probe out of that decision. LocalName names the runner's own
+// vantage point, e.g. "iran" for an in-country runner.
+type AgentsCfg struct {
+	Endpoints []AgentCfg `yaml:"endpoints"`
+	Require   string     `yaml:"require"`
+	SkipLocal bool       `yaml:"skip_local"`
+	LocalName string     `yaml:"local_name"`
+}
+
+type agentRequest struct {
+	Targets   []string `json:"targets"`
+	TimeoutMS int64    `json:"timeout_ms,omitempty"`
+}
+
+type agentResult struct {
+	Target    string `json:"target"`
+	Reachable bool   `json:"reachable"`
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type agentResponse struct {
+	Results []agentResult `json:"results"`
+}
+
+// runAgent serves POST /probe: a batch of host:port targets in, one TCP
+// reachability result per target out.
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	token := fs.String("token", "", "bearer token clients must send (required)")
+	timeout := fs.Duration("timeout", 2*time.Second, "default dial timeout per target")
+	concurrency := fs.Int("concurrency", 50, "concurrent dials per request")
+	family := fs.String("family", "any", "ipv4 | ipv6 | any")
+	_ = fs.Parse(args)
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "usage: xraysubrefiner agent -token <secret> [-listen addr]")
+		os.Exit(2)
+	}
+	want := []byte("Bearer " + *token)
+
+	d, err := newProbeDialer(ProbeCfg{Family: *family}, *timeout, os.Stderr)
+	must(err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/probe", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var ar agentRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&ar); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(ar.Targets) > maxAgentTargets {
+			http.Error(w, fmt.Sprintf("at most %d targets per request", maxAgentTargets), http.StatusRequestEntityTooLarge)
+			return
+		}
+		t := *timeout
+		if ar.TimeoutMS > 0 && time.Duration(ar.TimeoutMS)*time.Millisecond < t {
+			t = time.Duration(ar.TimeoutMS) * time.Millisecond
+		}
+		resp := agentResponse{Results: dialTargets(req.Context(), d, ar.Targets, t, *concurrency)}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	// Slow clients must not hold connections open; a response may take as
+	// long as dialing a full request's targets.
+	maxDial := time.Duration(maxAgentTargets/max(*concurrency, 1)+1) * *timeout
+	hs := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      maxDial + 30*time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    16 << 10,
+	}
+	fmt.Fprintf(os.Stderr, "Info: agent listening on %s\n", *listen)
+	log.Fatal(hs.ListenAndServe())
+}
+
+func dialTargets(ctx context.Context, d *probeDialer, targets []string, timeout time.Duration, concurrency int) []agentResult {
+	out := make([]agentResult, len(targets))
+	concurrency = max(concurrency, 1)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			out[i] = dialTarget(ctx, d, t, timeout)
+		}(i, t)
+	}
+	wg.Wait()
+	return out
+}
+
+func dialTarget(ctx context.Context, d *probeDialer, target string, timeout time.Duration) agentResult {
+	res := agentResult{Target: target}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := d.dial(ctx, host, port)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	conn.Close()
+	res.Reachable = true
+	res.LatencyMS = time.Since(start).Milliseconds()
+	return res
+}
+
+// queryAgent asks one agent about targets, in batches.
+func queryAgent(ctx context.Context, a AgentCfg, targets []string, timeout time.Duration) (map[string]agentResult, error) {
+	out := make(map[string]agentResult, len(targets))
+	client := &http.Client{}
+	for len(targets) > 0 {
+		batch := targets
+		if len(batch) > agentBatch {
+			batch = batch[:agentBatch]
+		}
+		targets = targets[len(batch):]
+
+		body, err := json.Marshal(agentRequest{Targets: batch, TimeoutMS: timeout.Milliseconds()})
+		if err != nil {
+			return nil, err
+		}
+		// Generous enough for a full batch at the agent's default
+		// concurrency, plus transfer.
+		qctx, cancel := context.WithTimeout(ctx, time.Duration(len(batch)/50+1)*timeout+30*time.Second)
+		req, err := http.NewRequestWithContext(qctx, http.MethodPost, strings.TrimRight(a.URL, "/")+"/probe", bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		resp, err := client.Do(req)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		var ar agentResponse
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&ar)
+		}
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ar.Results {
+			out[r.Target] = r
+		}
+	}
+	return out, nil
+}
+
+// applyAgents probes the nodes of results from every configured agent,
+// records each vantage point's verdict and combines them according to
+// cfg.Require. Agents that cannot be queried are left out of the decision.
+// Agents only dial, so they never clear a local failure of a tls, ws, grpc,
+// reality or certificate check.
+func applyAgents(ctx context.Context, log io.Writer, results []probeResult, cfg AgentsCfg, timeout time.Duration, key string) {
+	targets := make([]string, len(results))
+	var uniq []string
+	seen := map[string]bool{}
+	for i, r := range results {
+		n, err := parseNode(r.line)
+		if err != nil {
+			continue
+		}
+		targets[i] = net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+		if !seen[targets[i]] {
+			seen[targets[i]] = true
+			uniq = append(uniq, targets[i])
+		}
+	}
+
+	answers := make([]map[string]agentResult, len(cfg.Endpoints))
+	var wg sync.WaitGroup
+	for i, a := range cfg.Endpoints {
+		wg.Add(1)
+		go func(i int, a AgentCfg) {
+			defer wg.Done()
+			m, err := queryAgent(ctx, a, uniq, timeout)
+			if err != nil {
+				fmt.Fprintf(log, "!! %s: agent %s failed, ignoring it this run: %v\n", key, a.Name, err)
+				return
+			}
+			answers[i] = m
+		}(i, a)
+	}
+	wg.Wait()
+
+	reached := map[string]int{}
+	for i := range results {
+		r := &results[i]
+		r.vantage = map[string]bool{}
+		var names []string
+		if !cfg.SkipLocal {
+			r.vantage[cfg.LocalName] = r.err == nil
+			names = append(names, cfg.LocalName)
+		}
+		var best time.Duration
+		for j, a := range cfg.Endpoints {
+			if answers[j] == nil {
+				continue
+			}
+			ar := answers[j][targets[i]]
+			r.vantage[a.Name] = ar.Reachable
+			names = append(names, a.Name)
+			if ar.Reachable {
+				if l := time.Duration(ar.LatencyMS) * time.Millisecond; best == 0 || l < best {
+					best = l
+				}
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		var failed []string
+		for _, name := range names {
+			if !r.vantage[name] {
+				failed = append(failed, name)
+			} else {
+				reached[name]++
+			}
+		}
+		ok := len(failed) == 0
+		if cfg.Require == "any" {
+			ok = len(failed) < len(names)
+		}
+		switch {
+		case ok && r.err != nil && r.method == "tcp":
+			r.err, r.latency = nil, best
+		case !ok && r.err == nil:
+			r.err = fmt.Errorf("unreachable from %s", strings.Join(failed, ", "))
+		}
+	}
+
+	var parts []string
+	if !cfg.SkipLocal {
+		parts = append(parts, fmt.Sprintf("%s %d", cfg.LocalName, reached[cfg.LocalName]))
+	}
+	for j, a := range cfg.Endpoints {
+		if answers[j] != nil {
+			parts = append(parts, fmt.Sprintf("%s %d", a.Name, reached[a.Name]))
+		}
+	}
+	fmt.Fprintf(log, "Info: %s -> reachable per vantage point: %s\n", key, strings.Join(parts, ", "))
+}
+
+// reachedFrom reports whether every one of names reached the node.
+func reachedFrom(v map[string]bool, names []string) bool {
+	for _, n := range names {
+		if !v[n] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+// Package refiner fetches, validates, probes and exports proxy
+// subscriptions. It backs the xraysubrefiner command; Refine runs the same
+// pipeline on a single source for programs that embed it, without the
+// export tree, state or snapshots.
+package refiner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// RefineOptions selects the source and settings of a Refine call.
+type RefineOptions struct {
+	// Source is a raw subscription body. When it is nil, URL is read
+	// instead: fetched over HTTP, or opened as a file:// URL or path.
+	Source []byte
+	URL    string
+
+	// Config supplies filter, probe and output settings. It must come
+	// from ParseConfig or LoadConfig, which fill in defaults and validate;
+	// nil uses the defaults of the refine command. Its subscriptions,
+	// locations, export layout, state, snapshots and reports are ignored,
+	// and it is not modified.
+	Config *Config
+
+	// NoProbe keeps every valid node without probing.
+	NoProbe bool
+	// Timeout bounds the HTTP fetch of URL (default 20s).
+	Timeout time.Duration
+	// Observer, when set, is told about every stage of the run.
+	Observer Observer
+	// Log receives the progress and warning lines the command prints to
+	// stderr; nil discards them.
+	Log io.Writer
+}
+
+// Node is one refined node.
+type Node struct {
+	// ID is a short hash of the scheme, server, port and credential that
+	// stays the same when the remark or encoding changes.
+	ID        string
+	Link      string
+	Scheme    string
+	Host      string
+	Port      int
+	Transport string
+	Security  string
+	SNI       string
+	Remark    string
+	// Latency is the probe's connect time, zero when not probed.
+	Latency time.Duration
+}
+
+// Result is the outcome of Refine.
+type Result struct {
+	// Nodes are the nodes that passed every stage, in export order.
+	Nodes []Node
+	// Outputs holds each configured output by name, encoded as it would
+	// be exported. Outputs are missing when no node passed.
+	Outputs map[string][]byte
+}
+
+// Refine runs the pipeline on one source. Cancelling ctx stops the fetch,
+// DNS lookups and probes in flight, and Refine returns ctx's error.
+func Refine(ctx context.Context, opts RefineOptions) (Result, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		var err error
+		if cfg, err = ParseConfig([]byte(refineDefaults)); err != nil {
+			return Result{}, err
+		}
+	}
+	if opts.Source == nil && opts.URL == "" {
+		return Result{}, errors.New("refine: Source or URL is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 20 * time.Second
+	}
+	cfg = singleSource(cfg, "-")
+	if opts.NoProbe {
+		off := false
+		cfg.Probe.Enabled = &off
+	}
+
+	dir, err := cfg.Disk.mkdirTemp("xsr-refine-")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	log := opts.Log
+	if log == nil {
+		log = io.Discard
+	}
+	r, err := newRefiner(cfg, dir, opts.Timeout, log)
+	if err != nil {
+		return Result{}, err
+	}
+	r.ctx = ctx
+	r.progress = io.Discard
+	r.stdin = opts.Source
+	if r.stdin == nil {
+		// Fetch errors are the caller's to handle, not a skipped key.
+		if r.stdin, err = r.readSource(opts.URL, r.allowed); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var res Result
+	r.obs = observers{collector{nodes: &res.Nodes}}
+	if opts.Observer != nil {
+		r.obs = append(r.obs, opts.Observer)
+	}
+	if err := r.run(); err != nil {
+		return Result{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	res.Outputs = map[string][]byte{}
+	for _, o := range cfg.Outputs {
+		path, err := exportPath(dir, cfg.Export, refineKey, o)
+		if err != nil {
+			return Result{}, err
+		}
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		res.Outputs[o.Name] = b
+	}
+	return res, nil
+}
+
+// ValidateLink checks a single link the way the pipeline's validation
+// stage does, protocol rules and server host included, and returns it
+// parsed.
+func ValidateLink(link string) (*Node, error) {
+	link = normalizeScheme(strings.TrimSpace(link))
+	if err := validateLine(link); err != nil {
+		return nil, err
+	}
+	n, err := parseNode(link)
+	if err != nil {
+		return nil, err
+	}
+	pn := publicNode(link, n)
+	return &pn, nil
+}
+
+// collector keeps the exported nodes for Result.
+type collector struct {
+	NopObserver
+	nodes *[]Node
+}
+
+func (c collector) OnExport(ev ExportEvent) { *c.nodes = ev.Nodes }
+
+func publicNode(line string, n *node) Node {
+	return Node{
+		ID: fingerprint(line), Link: line, Scheme: n.Scheme, Host: n.Host, Port: n.Port,
+		Transport: n.Transport, Security: n.Security, SNI: n.SNI, Remark: n.Remark,
+	}
+}
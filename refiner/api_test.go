@@ -0,0 +1,70 @@
+package refiner
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testSource = `trojan://secret@1.1.1.1:443?security=tls&sni=a.example.net#one
+trojan://secret@1.1.1.1:443?security=tls&sni=a.example.net#one
+trojan://secret@10.0.0.1:443#private
+vless://11111111-2222-3333-4444-555555555555@1.1.1.2#noport
+`
+
+func TestRefineNoProbeCallerConfig(t *testing.T) {
+	// Built without ParseConfig, so none of its defaults are filled in.
+	cfg := &Config{
+		AllowedSchemes: []string{"trojan", "vless"},
+		Outputs:        []OutputCfg{{Name: "plain", Format: "plain"}},
+	}
+	var log strings.Builder
+	res, err := Refine(context.Background(), RefineOptions{
+		Source:  []byte(testSource),
+		Config:  cfg,
+		NoProbe: true,
+		Log:     &log,
+	})
+	if err != nil {
+		t.Fatalf("Refine: %v", err)
+	}
+	if len(res.Nodes) != 1 {
+		t.Fatalf("got %d nodes, want 1: %+v", len(res.Nodes), res.Nodes)
+	}
+	n := res.Nodes[0]
+	if n.Scheme != "trojan" || n.Host != "1.1.1.1" || n.Port != 443 || n.SNI != "a.example.net" {
+		t.Errorf("unexpected node %+v", n)
+	}
+	if out := string(res.Outputs["plain"]); !strings.Contains(out, "trojan://secret@1.1.1.1:443") {
+		t.Errorf("plain output misses the node:\n%s", out)
+	}
+	if cfg.Fetch.MaxRedirects != nil || cfg.Subscriptions != nil {
+		t.Error("Refine modified the caller's config")
+	}
+	if log.Len() == 0 {
+		t.Error("nothing was logged to RefineOptions.Log")
+	}
+}
+
+func TestRefineCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Refine(ctx, RefineOptions{Source: []byte(testSource), NoProbe: true})
+	if err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestValidateLink(t *testing.T) {
+	for link, ok := range map[string]bool{
+		"trojan://secret@1.1.1.1:443#one":                      true,
+		"trojan://secret@10.0.0.1:443#lan":                     false,
+		"trojan://secret@localhost:443":                        false,
+		"vless://11111111-2222-3333-4444-555555555555@1.1.1.2": false,
+	} {
+		_, err := ValidateLink(link)
+		if (err == nil) != ok {
+			t.Errorf("ValidateLink(%q) = %v, want ok=%v", link, err, ok)
+		}
+	}
+}
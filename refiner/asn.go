@@ -0,0 +1,289 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ASNCfg breaks the reachable nodes of every key down by the AS hosting
+// them. Source is an IP-to-ASN table, a file or URL, optionally
+// gzipped, in the ip2asn TSV format (range start, range end, AS number,
+// country, description) or one "prefix ASN [name]" per line. Keys with at
+// least min_nodes nodes of which more than warn_share sit in one AS are
+// flagged: a single range block takes them all. The table is loaded again
+// once it is older than Refresh, so a daemon does not download it every run.
+type ASNCfg struct {
+	Source    string        `yaml:"source"`
+	WarnShare float64       `yaml:"warn_share"`
+	MinNodes  int           `yaml:"min_nodes"`
+	Refresh   time.Duration `yaml:"refresh"`
+}
+
+func (c ASNCfg) check() error {
+	if c.WarnShare < 0 || c.WarnShare > 1 {
+		return fmt.Errorf("asn.warn_share must be between 0 and 1, got %g", c.WarnShare)
+	}
+	if c.MinNodes < 0 || c.Refresh < 0 {
+		return fmt.Errorf("asn: min_nodes and refresh must not be negative")
+	}
+	return nil
+}
+
+type asnRange struct {
+	from, to netip.Addr
+	asn      uint32
+	name     string
+}
+
+// asnTable holds the ranges of an ASN source ordered by start address.
+type asnTable []asnRange
+
+// lookup returns the range holding a.
+func (t asnTable) lookup(a netip.Addr) (asnRange, bool) {
+	i := sort.Search(len(t), func(i int) bool { return t[i].from.Compare(a) > 0 }) - 1
+	if i < 0 || t[i].to.Compare(a) < 0 {
+		return asnRange{}, false
+	}
+	return t[i], true
+}
+
+// refreshASNs loads the asn.source table when there is none yet or it is
+// older than asn.refresh. A failed reload keeps the table loaded before.
+func (r *refiner) refreshASNs(now time.Time) {
+	c := r.cfg.ASN
+	if c.Source == "" || r.asns != nil && now.Sub(r.asnsAt) < c.Refresh {
+		return
+	}
+	t, err := r.loadASNs()
+	if err != nil {
+		if r.asns != nil {
+			fmt.Fprintf(r.log, "!! %v, keeping the table loaded %s ago\n", err, now.Sub(r.asnsAt).Round(time.Minute))
+		} else {
+			fmt.Fprintf(r.log, "!! %v, skipping the ASN breakdown\n", err)
+		}
+		return
+	}
+	r.asns, r.asnsAt = t, now
+	fmt.Fprintf(r.log, "Info: asn %s -> %d ranges\n", c.Source, len(t))
+}
+
+// loadASNs reads the table of asn.source.
+func (r *refiner) loadASNs() (asnTable, error) {
+	src := r.cfg.ASN.Source
+	b, err := r.readSource(src, nil)
+	if err == nil && bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(b)); err == nil {
+			b, err = io.ReadAll(zr)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("asn %s: %w", src, err)
+	}
+	t := parseASNTable(b)
+	if len(t) == 0 {
+		return nil, fmt.Errorf("asn %s: no ranges", src)
+	}
+	return t, nil
+}
+
+func parseASNTable(b []byte) asnTable {
+	var t asnTable
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var f []string
+		tsv := strings.Contains(line, "\t")
+		if tsv {
+			f = strings.Split(line, "\t")
+		} else {
+			f = strings.Fields(line)
+		}
+		var r asnRange
+		var rest []string
+		if p, err := netip.ParsePrefix(f[0]); err == nil && len(f) >= 2 {
+			p = p.Masked()
+			r.from, r.to = p.Addr().Unmap(), lastAddr(p).Unmap()
+			rest = f[1:]
+		} else if len(f) >= 3 {
+			from, err1 := netip.ParseAddr(f[0])
+			to, err2 := netip.ParseAddr(f[1])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			r.from, r.to = from.Unmap(), to.Unmap()
+			rest = f[2:]
+		} else {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(rest[0]), "AS"), 10, 32)
+		// AS 0 marks unrouted space in ip2asn.
+		if err != nil || n == 0 || r.from.Is4() != r.to.Is4() || r.to.Less(r.from) {
+			continue
+		}
+		r.asn = uint32(n)
+		// ip2asn puts the country before the description.
+		if tsv && len(rest) >= 3 {
+			rest = rest[1:]
+		}
+		if len(rest) > 1 {
+			r.name = strings.Join(rest[1:], " ")
+		}
+		t = append(t, r)
+	}
+	return flattenASNs(t)
+}
+
+// flattenASNs turns ranges that may nest, as a /24 announced inside a /16
+// in a BGP dump, into disjoint ones where the most specific range wins, so
+// lookup finds every address with one search.
+func flattenASNs(t asnTable) asnTable {
+	// Wider ranges first among those starting together, so the narrower
+	// one is pushed on top of them.
+	sort.Slice(t, func(i, j int) bool {
+		if c := t[i].from.Compare(t[j].from); c != 0 {
+			return c < 0
+		}
+		return t[i].to.Compare(t[j].to) > 0
+	})
+	out := make(asnTable, 0, len(t))
+	emit := func(from, to netip.Addr, r asnRange) {
+		if from.IsValid() && to.IsValid() && from.Compare(to) <= 0 {
+			r.from, r.to = from, to
+			out = append(out, r)
+		}
+	}
+	// open holds the ranges enclosing pos, the innermost last; pos is the
+	// first address not yet emitted.
+	var open []asnRange
+	var pos netip.Addr
+	closeBefore := func(a netip.Addr) {
+		for len(open) > 0 {
+			top := open[len(open)-1]
+			if a.IsValid() && top.to.Compare(a) >= 0 {
+				return
+			}
+			emit(pos, top.to, top)
+			if pos.IsValid() && top.to.Compare(pos) >= 0 {
+				pos = top.to.Next()
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	for _, r := range t {
+		closeBefore(r.from)
+		if len(open) > 0 {
+			emit(pos, r.from.Prev(), open[len(open)-1])
+		}
+		pos = r.from
+		open = append(open, r)
+	}
+	closeBefore(netip.Addr{})
+	return out
+}
+
+// lastAddr returns the last address of p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().As16()
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	return netip.AddrFrom16(b)
+}
+
+type asnCount struct {
+	ASN   uint32 `json:"asn"`
+	Name  string `json:"name,omitempty"`
+	Nodes int    `json:"nodes"`
+}
+
+// asnStats is the ASN breakdown of the reachable nodes of a key.
+// Unknown counts nodes whose host did not resolve or is in no range.
+type asnStats struct {
+	Nodes        int        `json:"nodes"`
+	Unknown      int        `json:"unknown,omitempty"`
+	TopShare     float64    `json:"top_share"`
+	Concentrated bool       `json:"concentrated,omitempty"`
+	ByASN        []asnCount `json:"by_asn"`
+}
+
+// countASNs breaks lines down by hosting AS, most nodes first.
+func countASNs(ctx context.Context, lines []string, t asnTable, c ASNCfg, timeout time.Duration) asnStats {
+	hosts := make([]string, len(lines))
+	for i, l := range lines {
+		if n, err := parseNode(l); err == nil {
+			hosts[i] = n.Host
+		}
+	}
+	resolved := resolveHosts(ctx, hosts, timeout, 20)
+
+	st := asnStats{Nodes: len(lines)}
+	counts := map[uint32]*asnCount{}
+	for _, h := range hosts {
+		addrs := resolved[h]
+		if len(addrs) == 0 {
+			st.Unknown++
+			continue
+		}
+		r, ok := t.lookup(slices.MinFunc(addrs, netip.Addr.Compare))
+		if !ok {
+			st.Unknown++
+			continue
+		}
+		if counts[r.asn] == nil {
+			counts[r.asn] = &asnCount{ASN: r.asn, Name: r.name}
+		}
+		counts[r.asn].Nodes++
+	}
+	st.ByASN = make([]asnCount, 0, len(counts))
+	for _, ac := range counts {
+		st.ByASN = append(st.ByASN, *ac)
+	}
+	sort.Slice(st.ByASN, func(i, j int) bool {
+		if st.ByASN[i].Nodes != st.ByASN[j].Nodes {
+			return st.ByASN[i].Nodes > st.ByASN[j].Nodes
+		}
+		return st.ByASN[i].ASN < st.ByASN[j].ASN
+	})
+	if len(st.ByASN) > 0 && st.Nodes > 0 {
+		st.TopShare = float64(st.ByASN[0].Nodes) / float64(st.Nodes)
+		st.Concentrated = st.Nodes >= c.MinNodes && st.TopShare > c.WarnShare
+	}
+	return st
+}
+
+// reportASNs adds the ASN breakdown of reachable to rep and warns when the
+// key sits in one AS. It does nothing without an asn.source table.
+func (r *refiner) reportASNs(key string, reachable []string, rep *keyReport) {
+	if r.asns == nil || len(reachable) == 0 {
+		return
+	}
+	st := countASNs(r.ctx, reachable, r.asns, r.cfg.ASN, r.cfg.Probe.Timeout)
+	rep.ASNs = &st
+	if st.Concentrated {
+		top := st.ByASN[0]
+		name := fmt.Sprintf("AS%d", top.ASN)
+		if top.Name != "" {
+			name += " (" + top.Name + ")"
+		}
+		fmt.Fprintf(r.log, "!! %s: %d of %d reachable nodes (%.0f%%) are hosted in %s, one range block takes them all\n",
+			key, top.Nodes, st.Nodes, st.TopShare*100, name)
+	}
+}
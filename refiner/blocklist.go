@@ -0,0 +1,158 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+type BlocklistSource struct {
+	URL  string `yaml:"url"`
+	File string `yaml:"file"`
+}
+
+// blocklist matches nodes against community-maintained lists of servers to
+// avoid. Entries may be full links (their host is blocked), hostnames
+// ("*.example.com" or ".example.com" also blocks subdomains), IPs or CIDRs.
+type blocklist struct {
+	hosts    map[string]struct{}
+	suffixes []string
+	prefixes []netip.Prefix
+}
+
+// loadBlocklists reads the configured blocklists, skipping those that
+// fail to load.
+func (r *refiner) loadBlocklists() *blocklist {
+	bl := &blocklist{hosts: map[string]struct{}{}}
+	for _, src := range r.cfg.Blocklists {
+		var (
+			raw  []byte
+			err  error
+			name string
+		)
+		switch {
+		case src.URL != "":
+			name = src.URL
+			raw, _, err = fetchAs(r.ctx, r.client, r.log, src.URL, defaultUserAgent)
+		case src.File != "":
+			name = src.File
+			raw, err = os.ReadFile(src.File)
+		default:
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(r.log, "!! blocklist error %s: %v\n", name, err)
+			continue
+		}
+		n := bl.add(tryDecodeIfBase64(raw))
+		fmt.Fprintf(r.log, "Info: blocklist %s -> %d entries\n", name, n)
+	}
+	return bl
+}
+
+func (bl *blocklist) add(b []byte) int {
+	added := 0
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for sc.Scan() {
+		e := strings.TrimSpace(sc.Text())
+		if e == "" || reCommentLine.MatchString(e) {
+			continue
+		}
+		if strings.Contains(e, "://") {
+			n, err := parseNode(normalizeScheme(e))
+			if err != nil {
+				continue
+			}
+			e = n.Host
+		}
+		e = strings.ToLower(e)
+		if p, err := netip.ParsePrefix(e); err == nil {
+			bl.prefixes = append(bl.prefixes, p.Masked())
+		} else if a, err := netip.ParseAddr(e); err == nil {
+			bl.prefixes = append(bl.prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+		} else if strings.HasPrefix(e, "*.") || strings.HasPrefix(e, ".") {
+			bl.suffixes = append(bl.suffixes, "."+strings.TrimLeft(e, "*."))
+		} else {
+			bl.hosts[e] = struct{}{}
+		}
+		added++
+	}
+	return added
+}
+
+func (bl *blocklist) empty() bool {
+	return bl == nil || (len(bl.hosts) == 0 && len(bl.suffixes) == 0 && len(bl.prefixes) == 0)
+}
+
+func (bl *blocklist) blocksHost(host string) bool {
+	host = strings.ToLower(host)
+	if _, ok := bl.hosts[host]; ok {
+		return true
+	}
+	for _, s := range bl.suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bl *blocklist) blocksAddr(a netip.Addr) bool {
+	for _, p := range bl.prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter drops every line whose host is blocked. When the list holds IP
+// entries, domain hosts are resolved so nodes published by name are caught
+// too.
+func (bl *blocklist) filter(ctx context.Context, lines []string, timeout time.Duration) ([]string, int) {
+	if bl.empty() {
+		return lines, 0
+	}
+	hosts := make([]string, len(lines))
+	for i, l := range lines {
+		if n, err := parseNode(l); err == nil {
+			hosts[i] = n.Host
+		}
+	}
+	var resolved map[string][]netip.Addr
+	if len(bl.prefixes) > 0 {
+		resolved = resolveHosts(ctx, hosts, timeout, 20)
+	}
+
+	out := make([]string, 0, len(lines))
+	dropped := 0
+	for i, l := range lines {
+		if bl.blocks(hosts[i], resolved[hosts[i]]) {
+			dropped++
+			continue
+		}
+		out = append(out, l)
+	}
+	return out, dropped
+}
+
+func (bl *blocklist) blocks(host string, addrs []netip.Addr) bool {
+	if host == "" {
+		return false
+	}
+	if bl.blocksHost(host) {
+		return true
+	}
+	for _, a := range addrs {
+		if bl.blocksAddr(a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,313 @@
+package refiner
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClashCfg shapes "clash" outputs (Clash Meta / mihomo). Every config has
+// a select group, PROXY, listing the Pinned nodes (by node ID) first;
+// URLTest and Fallback add automatic groups that clients keep probing.
+// HealthCheck is suggested to clients importing "clash-provider" outputs.
+type ClashCfg struct {
+	URLTest     *ClashGroupCfg `yaml:"url_test"`
+	Fallback    *ClashGroupCfg `yaml:"fallback"`
+	Pinned      []string       `yaml:"pinned"`
+	HealthCheck *ClashGroupCfg `yaml:"health_check"`
+}
+
+// ClashGroupCfg is the health check of an automatic group. Tolerance, in
+// milliseconds, only applies to url-test.
+type ClashGroupCfg struct {
+	URL       string        `yaml:"url"`
+	Interval  time.Duration `yaml:"interval"`
+	Tolerance int           `yaml:"tolerance"`
+}
+
+const defaultHealthURL = "https://www.gstatic.com/generate_204"
+
+// merge returns c with the set fields of o applied on top.
+func (c ClashCfg) merge(o ClashCfg) ClashCfg {
+	if o.URLTest != nil {
+		c.URLTest = o.URLTest
+	}
+	if o.Fallback != nil {
+		c.Fallback = o.Fallback
+	}
+	if o.Pinned != nil {
+		c.Pinned = o.Pinned
+	}
+	if o.HealthCheck != nil {
+		c.HealthCheck = o.HealthCheck
+	}
+	return c
+}
+
+func (c ClashCfg) check() error {
+	for name, g := range map[string]*ClashGroupCfg{
+		"url_test": c.URLTest, "fallback": c.Fallback, "health_check": c.HealthCheck,
+	} {
+		if g == nil {
+			continue
+		}
+		if g.Interval < 0 || g.Tolerance < 0 {
+			return fmt.Errorf("clash.%s: interval and tolerance must not be negative", name)
+		}
+	}
+	return nil
+}
+
+func (g ClashGroupCfg) url() string {
+	if g.URL == "" {
+		return defaultHealthURL
+	}
+	return g.URL
+}
+
+// seconds is Interval in whole seconds, 300 when unset.
+func (g ClashGroupCfg) seconds() int {
+	if g.Interval <= 0 {
+		return 300
+	}
+	return int((g.Interval + time.Second - 1) / time.Second)
+}
+
+// clashReserved are the group and policy names of clash outputs, which no
+// proxy may take.
+var clashReserved = []string{"auto", "fallback", "PROXY", "DIRECT", "REJECT"}
+
+// clashProxies converts lines into Clash proxies with unique names, in
+// order, and returns the IDs of their nodes alongside. Names taken by a
+// group or an earlier proxy get a number. Lines Clash has no proxy type for
+// are left out.
+func clashProxies(lines []string) ([]map[string]any, []string) {
+	used := map[string]int{}
+	for _, r := range clashReserved {
+		used[r] = 1
+	}
+	var proxies []map[string]any
+	var ids []string
+	for _, l := range lines {
+		p, err := clashProxy(l)
+		if err != nil {
+			continue
+		}
+		base := p["name"].(string)
+		name := base
+		for used[name] > 0 {
+			used[base]++
+			name = fmt.Sprintf("%s %d", base, used[base])
+		}
+		used[name]++
+		p["name"] = name
+		proxies = append(proxies, p)
+		ids = append(ids, fingerprint(l))
+	}
+	return proxies, ids
+}
+
+// clashProxy builds the Clash proxy of line; vless, vmess, trojan and
+// shadowsocks are supported.
+func clashProxy(line string) (map[string]any, error) {
+	n, err := parseNode(line)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(n.Remark)
+	if name == "" {
+		name = fmt.Sprintf("%s %s:%d", n.Scheme, n.Host, n.Port)
+	}
+	p := map[string]any{"name": name, "server": n.Host, "port": n.Port, "udp": true}
+	switch n.Scheme {
+	case "vless":
+		p["type"] = "vless"
+		p["uuid"] = n.User
+		if f := n.param("flow"); f != "" {
+			p["flow"] = f
+		}
+	case "vmess":
+		aid, _ := strconv.Atoi(fmt.Sprint(n.Vmess["aid"]))
+		scy := n.param("scy")
+		if scy == "" {
+			scy = "auto"
+		}
+		p["type"] = "vmess"
+		p["uuid"] = n.User
+		p["alterId"] = aid
+		p["cipher"] = scy
+	case "trojan":
+		p["type"] = "trojan"
+		p["password"] = n.User
+	case "ss":
+		l, err := parseSSLink(line)
+		if err != nil {
+			return nil, err
+		}
+		p["type"] = "ss"
+		p["cipher"] = l.Method
+		p["password"] = l.Password
+		return p, nil
+	default:
+		return nil, fmt.Errorf("clash: unsupported scheme %s", n.Scheme)
+	}
+
+	switch n.Transport {
+	case "ws":
+		path := n.Path
+		if path == "" {
+			path = "/"
+		}
+		ws := map[string]any{"path": path}
+		if h := n.firstHostHeader(); h != "" {
+			ws["headers"] = map[string]any{"Host": h}
+		}
+		p["network"] = "ws"
+		p["ws-opts"] = ws
+	case "grpc":
+		p["network"] = "grpc"
+		p["grpc-opts"] = map[string]any{"grpc-service-name": n.ServiceName}
+	case "h2", "http":
+		h := map[string]any{"path": n.Path}
+		if n.HostHeader != "" {
+			h["host"] = strings.Split(n.HostHeader, ",")
+		}
+		p["network"] = "h2"
+		p["h2-opts"] = h
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("clash: unsupported transport %s", n.Transport)
+	}
+
+	sniKey := "servername"
+	if n.Scheme == "trojan" {
+		sniKey = "sni"
+	}
+	switch n.Security {
+	case "tls", "reality":
+		if n.Scheme != "trojan" {
+			p["tls"] = true
+		}
+		p[sniKey] = n.tlsServerName()
+		if fp := n.param("fp"); fp != "" {
+			p["client-fingerprint"] = fp
+		}
+		if alpn := n.param("alpn"); alpn != "" {
+			p["alpn"] = strings.Split(alpn, ",")
+		}
+		if n.param("allowInsecure") == "1" {
+			p["skip-cert-verify"] = true
+		}
+		if n.Security == "reality" {
+			p["reality-opts"] = map[string]any{"public-key": n.param("pbk"), "short-id": n.param("sid")}
+			if n.param("fp") == "" {
+				p["client-fingerprint"] = "chrome"
+			}
+		}
+	case "none":
+		if n.Scheme == "trojan" {
+			return nil, fmt.Errorf("clash: trojan needs tls")
+		}
+	}
+	return p, nil
+}
+
+// clashConfig encodes lines as a Clash config with the groups of c.
+func clashConfig(lines []string, c ClashCfg) ([]byte, error) {
+	proxies, ids := clashProxies(lines)
+	names := make([]string, len(proxies))
+	for i, p := range proxies {
+		names[i] = p["name"].(string)
+	}
+
+	// Pinned nodes open the select group, in the configured order.
+	pinned := map[string]bool{}
+	var sel []string
+	for _, id := range c.Pinned {
+		for i, pid := range ids {
+			if pid == strings.ToLower(strings.TrimSpace(id)) && !pinned[names[i]] {
+				pinned[names[i]] = true
+				sel = append(sel, names[i])
+			}
+		}
+	}
+	var groups []map[string]any
+	if g := c.URLTest; g != nil {
+		sel = append(sel, "auto")
+		groups = append(groups, map[string]any{
+			"name": "auto", "type": "url-test", "proxies": names,
+			"url": g.url(), "interval": g.seconds(), "tolerance": g.Tolerance,
+		})
+	}
+	if g := c.Fallback; g != nil {
+		sel = append(sel, "fallback")
+		groups = append(groups, map[string]any{
+			"name": "fallback", "type": "fallback", "proxies": names,
+			"url": g.url(), "interval": g.seconds(),
+		})
+	}
+	for _, n := range names {
+		if !pinned[n] {
+			sel = append(sel, n)
+		}
+	}
+	if len(sel) == 0 {
+		sel = []string{"DIRECT"}
+	}
+	groups = append([]map[string]any{{"name": "PROXY", "type": "select", "proxies": sel}}, groups...)
+
+	if proxies == nil {
+		proxies = []map[string]any{}
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(struct {
+		Proxies     []map[string]any `yaml:"proxies"`
+		ProxyGroups []map[string]any `yaml:"proxy-groups"`
+		Rules       []string         `yaml:"rules"`
+	}{proxies, groups, []string{"MATCH,PROXY"}}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// clashProvider encodes lines as a Clash proxy-provider file, which holds
+// nothing but the proxies.
+func clashProvider(lines []string) ([]byte, error) {
+	proxies, _ := clashProxies(lines)
+	if proxies == nil {
+		proxies = []map[string]any{}
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]any{"proxies": proxies}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// providerHint returns the proxy-providers stanza, as comment lines, that a
+// client config should use to import the provider file of key with the
+// configured health check. Providers only get probed when the importing
+// config asks for it, so the stanza is all the file can offer.
+func (c ClashCfg) providerHint(key string) []string {
+	if c.HealthCheck == nil {
+		return nil
+	}
+	return []string{
+		"# proxy-providers:",
+		fmt.Sprintf("#   %s:", strings.ReplaceAll(key, "/", "-")),
+		"#     type: http",
+		"#     url: <URL of this file>",
+		"#     health-check:",
+		"#       enable: true",
+		"#       url: " + c.HealthCheck.url(),
+		fmt.Sprintf("#       interval: %d", c.HealthCheck.seconds()),
+	}
+}
@@ -0,0 +1,137 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CleanIPsCfg adds variants of Cloudflare-fronted ws/tls nodes whose
+// address is replaced by edge IPs from Source (a file or URL, one IP per
+// line) that are known to get through, keeping SNI and Host so the worker
+// behind them is still reached. PerNode caps the variants of one node
+// (default 3); DropOriginal exports only the variants.
+type CleanIPsCfg struct {
+	Source       string `yaml:"source"`
+	PerNode      int    `yaml:"per_node"`
+	DropOriginal bool   `yaml:"drop_original"`
+}
+
+// loadCleanIPs reads the IP list of src, once per run.
+func (r *refiner) loadCleanIPs(cache map[string][]netip.Addr, src string) ([]netip.Addr, error) {
+	if ips, ok := cache[src]; ok {
+		return ips, nil
+	}
+	b, err := r.readSource(src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("clean_ips %s: %w", src, err)
+	}
+	var out []netip.Addr
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		e := strings.TrimSpace(sc.Text())
+		if a, err := netip.ParseAddr(e); err == nil {
+			out = append(out, a.Unmap())
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("clean_ips %s: no IP addresses", src)
+	}
+	cache[src] = out
+	return out, nil
+}
+
+// substituteCleanIPs adds up to perNode variants of every Cloudflare-fronted
+// ws/tls line, each on the next IP of ips, so the variants spread over the
+// whole list. It returns the new lines and the number of variants.
+func substituteCleanIPs(ctx context.Context, lines []string, ips []netip.Addr, perNode int, dropOriginal bool, timeout time.Duration) ([]string, int) {
+	nodes := make([]*node, len(lines))
+	var hosts []string
+	for i, l := range lines {
+		n, err := parseNode(l)
+		if err != nil || n.Transport != "ws" || n.Security != "tls" {
+			continue
+		}
+		nodes[i] = n
+		hosts = append(hosts, n.Host)
+	}
+	if len(hosts) == 0 {
+		return lines, 0
+	}
+	resolved := resolveHosts(ctx, hosts, timeout, 20)
+
+	if perNode <= 0 || perNode > len(ips) {
+		perNode = len(ips)
+	}
+	out := make([]string, 0, len(lines))
+	added, next := 0, 0
+	for i, l := range lines {
+		n := nodes[i]
+		if n == nil || !behindCloudflare(resolved[n.Host]) {
+			out = append(out, l)
+			continue
+		}
+		if !dropOriginal {
+			out = append(out, l)
+		}
+		for j := 0; j < perNode; j++ {
+			ip := ips[(next+j)%len(ips)]
+			if v, ok := withAddress(l, n, ip); ok {
+				out = append(out, v)
+				added++
+			}
+		}
+		next = (next + perNode) % len(ips)
+	}
+	return out, added
+}
+
+// withAddress points line at ip, pinning SNI and Host to the original
+// server name when the link relied on the address for them. The IP is
+// appended to the remark.
+func withAddress(line string, n *node, ip netip.Addr) (string, bool) {
+	name := n.Host
+	if _, err := netip.ParseAddr(name); err == nil {
+		name = ""
+	}
+	remark := strings.TrimSpace(n.Remark + " " + ip.String())
+	if strings.HasPrefix(line, "vmess://") {
+		m, err := decodeVmessPayload(line)
+		if err != nil {
+			return line, false
+		}
+		m["add"] = ip.String()
+		if name != "" && jsonString(m, "sni") == "" {
+			m["sni"] = name
+		}
+		if name != "" && jsonString(m, "host") == "" {
+			m["host"] = name
+		}
+		m["ps"] = remark
+		out, err := encodeVmess(m)
+		return out, err == nil
+	}
+
+	u, err := url.Parse(line)
+	if err != nil {
+		return line, false
+	}
+	q := u.Query()
+	if name != "" && q.Get("sni") == "" {
+		q.Set("sni", name)
+	}
+	if name != "" && q.Get("host") == "" {
+		q.Set("host", name)
+	}
+	u.RawQuery = q.Encode()
+	u.Host = net.JoinHostPort(ip.String(), strconv.Itoa(n.Port))
+	u.Fragment = remark
+	return u.String(), true
+}
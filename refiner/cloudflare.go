@@ -0,0 +1,93 @@
+package refiner
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// cloudflareRanges are Cloudflare's published edge ranges
+// (https://www.cloudflare.com/ips/).
+var cloudflareRanges = mustPrefixes(
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+)
+
+func mustPrefixes(ss ...string) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		out = append(out, netip.MustParsePrefix(s))
+	}
+	return out
+}
+
+func isCloudflareAddr(a netip.Addr) bool {
+	for _, p := range cloudflareRanges {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// collapseCloudflareDuplicates keeps a single representative of ws nodes that
+// reach the same worker through different Cloudflare edge addresses. Such
+// nodes share scheme, credential, Host header and path; only the address in
+// front differs. Lines keep their original order.
+func collapseCloudflareDuplicates(ctx context.Context, lines []string, timeout time.Duration) ([]string, int) {
+	nodes := make([]*node, len(lines))
+	var hosts []string
+	for i, l := range lines {
+		n, err := parseNode(l)
+		if err != nil || n.Transport != "ws" {
+			continue
+		}
+		nodes[i] = n
+		hosts = append(hosts, n.Host)
+	}
+	if len(hosts) == 0 {
+		return lines, 0
+	}
+	resolved := resolveHosts(ctx, hosts, timeout, 20)
+
+	seen := make(map[string]struct{})
+	out := make([]string, 0, len(lines))
+	collapsed := 0
+	for i, l := range lines {
+		n := nodes[i]
+		if n == nil || !behindCloudflare(resolved[n.Host]) {
+			out = append(out, l)
+			continue
+		}
+		backend := n.firstHostHeader()
+		if backend == "" {
+			backend = n.SNI
+		}
+		if backend == "" {
+			out = append(out, l)
+			continue
+		}
+		k := n.Scheme + "|" + n.User + "|" + strings.ToLower(backend) + "|" + n.Path
+		if _, dup := seen[k]; dup {
+			collapsed++
+			continue
+		}
+		seen[k] = struct{}{}
+		out = append(out, l)
+	}
+	return out, collapsed
+}
+
+func behindCloudflare(addrs []netip.Addr) bool {
+	for _, a := range addrs {
+		if isCloudflareAddr(a) {
+			return true
+		}
+	}
+	return false
+}
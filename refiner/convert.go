@@ -0,0 +1,189 @@
+package refiner
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// convertVmessToVless rewrites vmess nodes that carry no vmess-level
+// encryption (scy auto/none) over ws or grpc into the equivalent vless link.
+// Anything else is returned unchanged, as is the count of converted lines.
+func convertVmessToVless(lines []string) ([]string, int) {
+	out := make([]string, 0, len(lines))
+	converted := 0
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "vmess://") {
+			out = append(out, l)
+			continue
+		}
+		n, err := parseNode(l)
+		if err != nil {
+			out = append(out, l)
+			continue
+		}
+		if v, ok := vmessAsVless(n); ok {
+			out = append(out, v)
+			converted++
+			continue
+		}
+		out = append(out, l)
+	}
+	return out, converted
+}
+
+func vmessAsVless(n *node) (string, bool) {
+	switch strings.ToLower(jsonString(n.Vmess, "scy")) {
+	case "", "auto", "none":
+	default:
+		return "", false
+	}
+	if n.Transport != "ws" && n.Transport != "grpc" {
+		return "", false
+	}
+	if n.User == "" {
+		return "", false
+	}
+
+	q := url.Values{}
+	q.Set("encryption", "none")
+	q.Set("type", n.Transport)
+	q.Set("security", n.Security)
+	if n.SNI != "" {
+		q.Set("sni", n.SNI)
+	}
+	if n.HostHeader != "" {
+		q.Set("host", n.HostHeader)
+	}
+	switch n.Transport {
+	case "ws":
+		if n.Path != "" {
+			q.Set("path", n.Path)
+		}
+	case "grpc":
+		q.Set("serviceName", n.ServiceName)
+	}
+	for _, k := range []string{"fp", "alpn"} {
+		if v := jsonString(n.Vmess, k); v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	u := url.URL{
+		Scheme:   "vless",
+		User:     url.User(n.User),
+		Host:     net.JoinHostPort(n.Host, strconv.Itoa(n.Port)),
+		RawQuery: q.Encode(),
+		Fragment: n.Remark,
+	}
+	return u.String(), true
+}
+
+// ssLink is a shadowsocks link broken into its parts, whichever of the
+// SIP002 or legacy encodings it arrived in.
+type ssLink struct {
+	Method   string
+	Password string
+	Host     string
+	Port     string
+	RawQuery string
+	Remark   string
+}
+
+// expandLegacySS rewrites a legacy ss://BASE64(method:password@host:port)#tag
+// link into SIP002 form so the URL-based parsers can handle it. Other links
+// are returned unchanged.
+func expandLegacySS(line string) string {
+	if !strings.HasPrefix(line, "ss://") {
+		return line
+	}
+	rest := strings.TrimPrefix(line, "ss://")
+	body, frag, _ := strings.Cut(rest, "#")
+	if strings.Contains(body, "@") {
+		return line
+	}
+	body, query, _ := strings.Cut(body, "?")
+	dec, err := decodeVmessBase64(body)
+	if err != nil {
+		return line
+	}
+	at := strings.LastIndexByte(string(dec), '@')
+	if at < 0 {
+		return line
+	}
+	out := "ss://" + base64.RawURLEncoding.EncodeToString(dec[:at]) + "@" + string(dec[at+1:])
+	if query != "" {
+		out += "?" + query
+	}
+	if frag != "" {
+		out += "#" + frag
+	}
+	return out
+}
+
+func parseSSLink(line string) (*ssLink, error) {
+	u, err := url.Parse(expandLegacySS(line))
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.Hostname() == "" || u.Port() == "" {
+		return nil, errors.New("ss: missing userinfo, host or port")
+	}
+	l := &ssLink{Host: u.Hostname(), Port: u.Port(), RawQuery: u.RawQuery, Remark: u.Fragment}
+	if pass, ok := u.User.Password(); ok {
+		l.Method, l.Password = u.User.Username(), pass
+		return l, nil
+	}
+	dec, err := decodeVmessBase64(u.User.Username())
+	if err != nil {
+		return nil, fmt.Errorf("ss userinfo: %w", err)
+	}
+	method, pass, ok := strings.Cut(string(dec), ":")
+	if !ok {
+		return nil, errors.New("ss userinfo is not method:password")
+	}
+	l.Method, l.Password = method, pass
+	return l, nil
+}
+
+// canonicalSS re-encodes a shadowsocks link as SIP002 with base64url
+// userinfo, or with format "legacy" as the fully base64 form older clients
+// expect. Links with plugin parameters cannot be expressed in the legacy
+// form and stay SIP002.
+func canonicalSS(line, format string) (string, error) {
+	l, err := parseSSLink(line)
+	if err != nil {
+		return "", err
+	}
+	hostport := net.JoinHostPort(l.Host, l.Port)
+	frag := ""
+	if l.Remark != "" {
+		frag = "#" + (&url.URL{Fragment: l.Remark}).EscapedFragment()
+	}
+
+	if format == "legacy" && l.RawQuery == "" {
+		return "ss://" + base64.StdEncoding.EncodeToString([]byte(l.Method+":"+l.Password+"@"+hostport)) + frag, nil
+	}
+	out := "ss://" + base64.RawURLEncoding.EncodeToString([]byte(l.Method+":"+l.Password)) + "@" + hostport
+	if l.RawQuery != "" {
+		out += "?" + l.RawQuery
+	}
+	return out + frag, nil
+}
+
+func convertSSFormat(lines []string, format string) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if strings.HasPrefix(l, "ss://") {
+			if c, err := canonicalSS(l, format); err == nil {
+				l = c
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
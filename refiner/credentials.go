@@ -0,0 +1,68 @@
+package refiner
+
+import (
+	"strings"
+)
+
+type credentialStats struct {
+	Nodes     int `json:"nodes"`
+	Distinct  int `json:"distinct"`
+	TopShared int `json:"top_shared"`
+}
+
+// credentialOf returns the secret a node authenticates with: the vless/vmess
+// id, trojan password or shadowsocks method:password.
+func credentialOf(line string) string {
+	n, err := parseNode(line)
+	if err != nil {
+		return ""
+	}
+	if n.Scheme == "ss" {
+		if l, err := parseSSLink(line); err == nil {
+			return l.Method + ":" + l.Password
+		}
+	}
+	if n.Scheme == "vless" || n.Scheme == "vmess" {
+		return strings.ToLower(n.User)
+	}
+	return n.User
+}
+
+func countCredentials(lines []string) credentialStats {
+	counts := map[string]int{}
+	for _, l := range lines {
+		if c := credentialOf(l); c != "" {
+			counts[c]++
+		}
+	}
+	st := credentialStats{Nodes: len(lines), Distinct: len(counts)}
+	for _, n := range counts {
+		if n > st.TopShared {
+			st.TopShared = n
+		}
+	}
+	return st
+}
+
+// limitPerCredential keeps at most limit nodes per credential, in input
+// order. Lines without a recognizable credential are always kept.
+func limitPerCredential(lines []string, limit int) ([]string, int) {
+	if limit <= 0 {
+		return lines, 0
+	}
+	counts := map[string]int{}
+	out := make([]string, 0, len(lines))
+	dropped := 0
+	for _, l := range lines {
+		c := credentialOf(l)
+		if c != "" {
+			if counts[c] >= limit {
+				dropped++
+				continue
+			}
+			counts[c]++
+		}
+		out = append(out, l)
+	}
+	return out, dropped
+}
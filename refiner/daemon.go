@@ -0,0 +1,67 @@
+package refiner
+
+import (
+	"fmt"
+	"time"
+)
+
+// fetchedSource is the last body fetched for a subscription.
+type fetchedSource struct {
+	at   time.Time
+	body []byte
+}
+
+// daemon runs forever, starting a run every interval, or early when
+// r.refresh is signalled. A failed run is reported and retried on the next
+// tick rather than ending the process. With probe.full_every, only every
+// Nth run probes all nodes. Under systemd it reports readiness, status and
+// watchdog pings.
+func (r *refiner) daemon(interval time.Duration) {
+	r.probes = newProbeCache(r.cfg.Probe.FullEvery)
+	sd := newSDNotifier()
+	if sd != nil {
+		r.obs = append(r.obs, sd)
+	}
+	sd.ready()
+	for {
+		start := time.Now()
+		r.status.begin(start.UTC())
+		sd.begin()
+		err := r.run()
+		r.probes.next()
+		r.mail.report(err)
+		if err != nil {
+			fmt.Fprintf(r.log, "!! run failed: %v\n", err)
+		}
+		wait := interval - time.Since(start)
+		if wait < 0 {
+			wait = 0
+		}
+		r.status.end(err, time.Now().Add(wait).UTC())
+		sd.end(err, time.Now().Add(wait))
+		fmt.Fprintf(r.log, "Info: next run in %s\n", wait.Round(time.Second))
+		select {
+		case <-time.After(wait):
+		case <-r.refresh:
+			fmt.Fprintln(r.log, "Info: refresh requested, starting a run now")
+		}
+	}
+}
+
+// fetch returns the subscription body, reusing the cached copy while it is
+// younger than the source's min_fetch_interval.
+func (r *refiner) fetch(sub Subscription, now time.Time) ([]byte, error) {
+	if c, ok := r.fetched[sub.Key]; ok && now.Sub(c.at) < sub.MinFetchInterval {
+		fmt.Fprintf(r.log, "Info: %s -> reusing body fetched %s ago (min_fetch_interval %s)\n",
+			sub.Key, now.Sub(c.at).Round(time.Second), sub.MinFetchInterval)
+		return c.body, nil
+	}
+	body, err := r.readSource(sub.URL, r.allowedFor(sub))
+	if err != nil {
+		return nil, err
+	}
+	if sub.MinFetchInterval > 0 {
+		r.fetched[sub.Key] = fetchedSource{at: now, body: body}
+	}
+	return body, nil
+}
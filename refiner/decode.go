@@ -0,0 +1,109 @@
+package refiner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"regexp"
+	"strings"
+)
+
+// reB64Block matches a standalone base64 block inside a larger document,
+// optionally wrapped over several lines or carried in a data URI.
+var reB64Block = regexp.MustCompile(`(?:data:[\w.+-]+/[\w.+-]+(?:;[\w.+-]+=[^;,\s]*)*;base64,)?[A-Za-z0-9+/_-]{16,}={0,2}(?:[ \t]*\r?\n[ \t]*[A-Za-z0-9+/_-]{4,}={0,2})*`)
+
+// hasKnownScheme reports whether decoded text contains subscription links.
+func hasKnownScheme(b []byte) bool {
+	l := strings.ToLower(string(b))
+	return strings.Contains(l, "vless://") || strings.Contains(l, "vmess://") || strings.Contains(l, "ss://")
+}
+
+// decodeB64 decodes s with or without padding, standard or URL alphabet,
+// ignoring whitespace.
+func decodeB64(s string) ([]byte, bool) {
+	s = strings.Join(strings.Fields(s), "")
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if dec, err := enc.DecodeString(s); err == nil {
+			return dec, true
+		}
+	}
+	return nil, false
+}
+
+// decodeSegments decodes a body made of several independently padded
+// base64 chunks, as some feeds concatenate them: a chunk ends at a blank
+// line or at a line ending in padding. Every chunk must decode; the results
+// are joined by newlines.
+func decodeSegments(b []byte) ([]byte, bool) {
+	var segs []string
+	var cur strings.Builder
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			cur.WriteString(line)
+		}
+		if (line == "" || strings.HasSuffix(line, "=")) && cur.Len() > 0 {
+			segs = append(segs, cur.String())
+			cur.Reset()
+		}
+	}
+	if cur.Len() > 0 {
+		segs = append(segs, cur.String())
+	}
+	if len(segs) < 2 {
+		return nil, false
+	}
+	var out bytes.Buffer
+	for _, seg := range segs {
+		dec, ok := decodeB64(seg)
+		if !ok {
+			return nil, false
+		}
+		out.Write(bytes.TrimSpace(dec))
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), true
+}
+
+// decodeBlocks replaces every base64 block or data URI in b that decodes to
+// subscription links with its decoded text, so links in an HTML page or a
+// markdown code fence are found next to any plain ones. Blocks inside a
+// link (ss:// userinfo, vmess payloads) are left alone. It returns nil if
+// no block decoded to links.
+func decodeBlocks(b []byte) []byte {
+	var out bytes.Buffer
+	last, found := 0, false
+	for _, m := range reB64Block.FindAllIndex(b, -1) {
+		start, end := m[0], m[1]
+		if start > 0 && !isBlockBoundary(b[start-1]) {
+			continue
+		}
+		s := string(b[start:end])
+		if i := strings.Index(s, ";base64,"); i >= 0 && strings.HasPrefix(s, "data:") {
+			s = s[i+len(";base64,"):]
+		}
+		dec, ok := decodeB64(s)
+		if !ok || !hasKnownScheme(dec) {
+			continue
+		}
+		out.Write(b[last:start])
+		out.WriteByte('\n')
+		out.Write(bytes.TrimSpace(dec))
+		out.WriteByte('\n')
+		last, found = end, true
+	}
+	if !found {
+		return nil
+	}
+	out.Write(b[last:])
+	return out.Bytes()
+}
+
+// isBlockBoundary reports whether c may precede a standalone block: markup,
+// quotes and whitespace do, the "://" or "@" of a link do not.
+func isBlockBoundary(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '>', '"', '\'', '`', '(', '[', '=', ',':
+		return true
+	}
+	return false
+}
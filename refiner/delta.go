@@ -0,0 +1,135 @@
+package refiner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// deltaVersions is how many node sets per key the delta endpoint
+// remembers.
+const deltaVersions = 50
+
+// deltaStore keeps the recent node sets of every key, fed by the run's
+// export events, so clients can ask what changed since the set they have.
+// It lives in memory: after a restart, old hashes get the full list.
+type deltaStore struct {
+	NopObserver
+
+	mu   sync.Mutex
+	keys map[string][]nodeSet
+}
+
+// nodeSet maps node IDs to links; hash identifies the set of IDs.
+type nodeSet struct {
+	hash  string
+	nodes map[string]string
+}
+
+func newNodeSet(nodes []Node) nodeSet {
+	ns := nodeSet{nodes: make(map[string]string, len(nodes))}
+	for _, n := range nodes {
+		if n.ID != "" {
+			ns.nodes[n.ID] = n.Link
+		}
+	}
+	ids := make([]string, 0, len(ns.nodes))
+	for id := range ns.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	ns.hash = hex.EncodeToString(sum[:8])
+	return ns
+}
+
+func (d *deltaStore) OnExport(ev ExportEvent) {
+	ns := newNodeSet(ev.Nodes)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.keys == nil {
+		d.keys = map[string][]nodeSet{}
+	}
+	versions := d.keys[ev.Key]
+	if len(versions) > 0 && versions[len(versions)-1].hash == ns.hash {
+		return
+	}
+	versions = append(versions, ns)
+	if len(versions) > deltaVersions {
+		versions = versions[len(versions)-deltaVersions:]
+	}
+	d.keys[ev.Key] = versions
+}
+
+// deltaNode is one added or removed node.
+type deltaNode struct {
+	ID   string `json:"id"`
+	Link string `json:"link"`
+}
+
+// deltaReport answers a delta request. Full is set when since was empty
+// or is no longer known, and Added then holds every node.
+type deltaReport struct {
+	Key     string      `json:"key"`
+	Since   string      `json:"since,omitempty"`
+	Hash    string      `json:"hash"`
+	Full    bool        `json:"full,omitempty"`
+	Added   []deltaNode `json:"added"`
+	Removed []deltaNode `json:"removed"`
+}
+
+// delta compares the current nodes of key with the set hashed since. ok is
+// false for keys that have not been exported yet.
+func (d *deltaStore) delta(key, since string) (rep deltaReport, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	versions := d.keys[key]
+	if len(versions) == 0 {
+		return deltaReport{}, false
+	}
+	cur := versions[len(versions)-1]
+	rep = deltaReport{Key: key, Since: since, Hash: cur.hash, Added: []deltaNode{}, Removed: []deltaNode{}}
+	var old *nodeSet
+	for i := range versions {
+		if since != "" && versions[i].hash == since {
+			old = &versions[i]
+		}
+	}
+	if old == nil {
+		rep.Full = true
+		old = &nodeSet{}
+	}
+	for id, link := range cur.nodes {
+		if _, had := old.nodes[id]; !had {
+			rep.Added = append(rep.Added, deltaNode{ID: id, Link: link})
+		}
+	}
+	for id, link := range old.nodes {
+		if _, has := cur.nodes[id]; !has {
+			rep.Removed = append(rep.Removed, deltaNode{ID: id, Link: link})
+		}
+	}
+	sort.Slice(rep.Added, func(i, j int) bool { return rep.Added[i].ID < rep.Added[j].ID })
+	sort.Slice(rep.Removed, func(i, j int) bool { return rep.Removed[i].ID < rep.Removed[j].ID })
+	return rep, true
+}
+
+// serveDelta answers <key>/delta requests; it reports false for other
+// paths and unknown keys, which are then served as files.
+func (s *server) serveDelta(w http.ResponseWriter, req *http.Request, token, name string) bool {
+	key, ok := strings.CutSuffix(name, "/delta")
+	if !ok || s.deltas == nil {
+		return false
+	}
+	rep, ok := s.deltas.delta(key, req.URL.Query().Get("since"))
+	if !ok {
+		return false
+	}
+	s.logAccess(req, token, name, http.StatusOK)
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, rep)
+	return true
+}
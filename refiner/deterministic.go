@@ -0,0 +1,27 @@
+package refiner
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// outputStamp is the time written into manifests, reports and
+// countries.json. With deterministic it is SOURCE_DATE_EPOCH, or the Unix
+// epoch when that is unset, so identical runs produce identical files;
+// otherwise it is now.
+func outputStamp(deterministic bool, now time.Time) (time.Time, error) {
+	if !deterministic {
+		return now, nil
+	}
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, fmt.Errorf("SOURCE_DATE_EPOCH %q is not a Unix timestamp", v)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
@@ -0,0 +1,93 @@
+package refiner
+
+import (
+	"fmt"
+	"io"
+)
+
+// probeCache carries reachable probe results from one daemon cycle to the
+// next. With probe.full_every N, every Nth cycle probes everything; the
+// cycles between only probe nodes that are new or failed last time and
+// reuse the earlier verdict on the rest.
+type probeCache struct {
+	every int
+	cycle int
+	// ok maps keys to the reachable results of their last cycle, by line.
+	ok map[string]map[string]probeResult
+}
+
+func newProbeCache(every int) *probeCache {
+	if every <= 1 {
+		return nil
+	}
+	return &probeCache{every: every, ok: map[string]map[string]probeResult{}}
+}
+
+// full reports whether this cycle probes every node. A nil cache always
+// does.
+func (c *probeCache) full() bool {
+	return c == nil || c.cycle%c.every == 0
+}
+
+// next advances to the following cycle.
+func (c *probeCache) next() {
+	if c != nil {
+		c.cycle++
+	}
+}
+
+// split returns the lines of key that need probing this cycle and the
+// remembered results of the others.
+func (c *probeCache) split(key string, lines []string) ([]string, []probeResult) {
+	if c.full() {
+		return lines, nil
+	}
+	var fresh []string
+	var reused []probeResult
+	for _, l := range lines {
+		if res, ok := c.ok[key][l]; ok {
+			reused = append(reused, res)
+		} else {
+			fresh = append(fresh, l)
+		}
+	}
+	return fresh, reused
+}
+
+// probeDiff probes lines of key, or on intermediate cycles only those
+// split picks, and returns all results in the order of lines, at most
+// maxNodes of them when it is set. probe runs the actual probes.
+func (c *probeCache) probeDiff(log io.Writer, key string, lines []string, maxNodes int, probe func([]string) []probeResult) []probeResult {
+	fresh, reused := c.split(key, lines)
+	if !c.full() {
+		fmt.Fprintf(log, "Info: %s -> differential cycle: probing %d new or failed nodes, reusing %d results\n",
+			key, len(fresh), len(reused))
+	}
+	results := probe(fresh)
+	if len(reused) > 0 {
+		byLine := make(map[string]probeResult, len(results)+len(reused))
+		for _, res := range append(results, reused...) {
+			byLine[res.line] = res
+		}
+		results = results[:0:0]
+		for _, l := range lines {
+			if res, ok := byLine[l]; ok {
+				results = append(results, res)
+			}
+		}
+		// Reused results count against the cap like probed ones.
+		if maxNodes > 0 && len(results) > maxNodes {
+			results = results[:maxNodes]
+		}
+	}
+	if c != nil {
+		ok := map[string]probeResult{}
+		for _, res := range results {
+			if res.err == nil {
+				ok[res.line] = res
+			}
+		}
+		c.ok[key] = ok
+	}
+	return results
+}
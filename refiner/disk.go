@@ -0,0 +1,87 @@
+package refiner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DiskCfg guards against a disk filling up mid-run. TempDir holds the
+// temporary files of refine, the library and throughput tests instead of
+// the system default; exports are still written next to their final path,
+// so they can be renamed into place. Before each run, the export directory,
+// the state file's directory and TempDir must have MinFreeMB free; without
+// MinFreeMB nothing is checked.
+type DiskCfg struct {
+	TempDir   string `yaml:"temp_dir"`
+	MinFreeMB int64  `yaml:"min_free_mb"`
+}
+
+func (c DiskCfg) check() error {
+	if c.MinFreeMB < 0 {
+		return errors.New("disk.min_free_mb must not be negative")
+	}
+	return nil
+}
+
+// mkdirTemp creates a temporary directory in TempDir, creating TempDir
+// first when needed.
+func (c DiskCfg) mkdirTemp(pattern string) (string, error) {
+	if c.TempDir != "" {
+		if err := os.MkdirAll(c.TempDir, 0o755); err != nil {
+			return "", fmt.Errorf("disk.temp_dir: %w", err)
+		}
+	}
+	return os.MkdirTemp(c.TempDir, pattern)
+}
+
+// diskPreflight fails when a directory the run writes to lacks the space
+// required by DiskCfg. File systems that cannot report free space pass.
+func (r *refiner) diskPreflight() error {
+	c := r.cfg.Disk
+	if c.TempDir != "" {
+		if err := os.MkdirAll(c.TempDir, 0o755); err != nil {
+			return fmt.Errorf("disk.temp_dir: %w", err)
+		}
+	}
+	if c.MinFreeMB == 0 {
+		return nil
+	}
+	minFree := uint64(c.MinFreeMB) << 20
+	dirs := []string{r.outDir}
+	if r.cfg.State.Path != "" {
+		dirs = append(dirs, filepath.Dir(r.cfg.State.Path))
+	}
+	if c.TempDir != "" {
+		dirs = append(dirs, c.TempDir)
+	}
+	for _, dir := range dirs {
+		free, ok := freeSpace(existingDir(dir))
+		if !ok || free >= minFree {
+			continue
+		}
+		return fmt.Errorf("disk preflight: %s has %s free, the run needs %s (disk.min_free_mb %d)",
+			dir, formatMB(free), formatMB(minFree), c.MinFreeMB)
+	}
+	return nil
+}
+
+// existingDir returns dir or its closest existing parent.
+func existingDir(dir string) string {
+	dir, _ = filepath.Abs(dir)
+	for {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+func formatMB(n uint64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
@@ -0,0 +1,141 @@
+package refiner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNSCacheCfg tunes the prober's resolver cache. Feeds often put hundreds
+// of nodes on a handful of domains; each is looked up once per TTL, with
+// failures remembered for NegativeTTL, and at most Concurrency lookups in
+// flight at a time.
+type DNSCacheCfg struct {
+	TTL         time.Duration `yaml:"ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	Concurrency int           `yaml:"concurrency"`
+}
+
+const (
+	defaultDNSTTL         = 5 * time.Minute
+	defaultDNSNegativeTTL = time.Minute
+	defaultDNSConcurrency = 16
+
+	// maxDNSEntries triggers dropping expired entries, so a daemon fed
+	// ever-changing hosts does not grow the cache without bound.
+	maxDNSEntries = 4096
+)
+
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// dnsLookup is a lookup in flight; later callers for the same host wait
+// for it instead of asking the resolver again.
+type dnsLookup struct {
+	done chan struct{}
+	dnsEntry
+}
+
+type dnsCache struct {
+	ttl, negativeTTL time.Duration
+	sem              chan struct{}
+
+	mu       sync.Mutex
+	entries  map[string]dnsEntry
+	inflight map[string]*dnsLookup
+}
+
+func newDNSCache(cfg DNSCacheCfg) *dnsCache {
+	c := &dnsCache{
+		ttl: cfg.TTL, negativeTTL: cfg.NegativeTTL,
+		entries: map[string]dnsEntry{}, inflight: map[string]*dnsLookup{},
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultDNSTTL
+	}
+	if c.negativeTTL <= 0 {
+		c.negativeTTL = defaultDNSNegativeTTL
+	}
+	n := cfg.Concurrency
+	if n <= 0 {
+		n = defaultDNSConcurrency
+	}
+	c.sem = make(chan struct{}, n)
+	return c
+}
+
+// resolve returns the dialing-ordered addresses of host, from the cache
+// when a fresh answer or failure is there. The returned slice may be
+// shared and must not be modified. Callers asking for a host already being
+// looked up wait for that lookup; each gives up only on its own ctx.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[host]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.ips, e.err
+	}
+	l, ok := c.inflight[host]
+	if !ok {
+		l = &dnsLookup{done: make(chan struct{})}
+		c.inflight[host] = l
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		// The lookup is shared, so the caller starting it must not cut it
+		// short for the others.
+		go c.lookup(context.WithoutCancel(ctx), host, l)
+	}
+	select {
+	case <-l.done:
+		return l.ips, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dnsLookupTimeout bounds a shared lookup, which no caller's deadline ends.
+const dnsLookupTimeout = 15 * time.Second
+
+// lookup resolves host for l and caches the answer.
+func (c *dnsCache) lookup(ctx context.Context, host string, l *dnsLookup) {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	c.sem <- struct{}{}
+	l.ips, l.err = resolveProbeIPs(ctx, host)
+	<-c.sem
+
+	now := time.Now()
+	c.mu.Lock()
+	delete(c.inflight, host)
+	if len(c.entries) >= maxDNSEntries {
+		c.prune(now)
+	}
+	// A lookup that ran out of time says nothing certain about the host,
+	// so only real answers and resolver errors are kept.
+	switch {
+	case l.err == nil:
+		c.entries[host] = dnsEntry{ips: l.ips, expires: now.Add(c.ttl)}
+	case !errors.Is(l.err, context.Canceled) && !errors.Is(l.err, context.DeadlineExceeded):
+		c.entries[host] = dnsEntry{err: l.err, expires: now.Add(c.negativeTTL)}
+	}
+	c.mu.Unlock()
+	close(l.done)
+}
+
+// prune drops expired entries; c.mu must be held.
+func (c *dnsCache) prune(now time.Time) {
+	for h, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, h)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package refiner
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EmailCfg mails operators when a run fails or a key exports no nodes.
+// Server is host:port; port 465 speaks TLS from the start, other ports
+// upgrade with STARTTLS when the server offers it. Username and Password
+// (best kept in secrets_file) authenticate with PLAIN.
+type EmailCfg struct {
+	Server   string   `yaml:"server"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+func (c EmailCfg) check() error {
+	if c.Server == "" {
+		if len(c.To) > 0 || c.From != "" {
+			return errors.New("email: server is required")
+		}
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(c.Server); err != nil || port == "" {
+		return fmt.Errorf("email.server %q must be host:port", c.Server)
+	}
+	if c.From == "" || len(c.To) == 0 {
+		return errors.New("email: from and to are required")
+	}
+	return nil
+}
+
+// mailer collects the keys of a run that exported no nodes, with why, and
+// mails a report once the run is over. A report equal to the last one sent
+// is not sent again, so a daemon does not mail the same failure every run.
+// A nil *mailer ignores everything.
+type mailer struct {
+	NopObserver
+
+	cfg   EmailCfg
+	empty map[string]string
+	last  string
+	// hidden are the per-source members of weighted keys, which are
+	// never exported themselves.
+	hidden map[string]bool
+}
+
+func newMailer(c EmailCfg, subs []Subscription) *mailer {
+	if c.Server == "" {
+		return nil
+	}
+	m := &mailer{cfg: c, hidden: map[string]bool{}}
+	for _, s := range subs {
+		if s.hidden {
+			m.hidden[s.Key] = true
+		}
+	}
+	return m
+}
+
+// OnFetch marks every fetched key empty until it exports nodes.
+func (m *mailer) OnFetch(ev FetchEvent) {
+	if m == nil || m.hidden[ev.Key] {
+		return
+	}
+	if m.empty == nil {
+		m.empty = map[string]string{}
+	}
+	m.empty[ev.Key] = "no valid nodes"
+	if ev.Err != nil {
+		m.empty[ev.Key] = ev.Err.Error()
+	}
+}
+
+func (m *mailer) OnExport(ev ExportEvent) {
+	if m == nil {
+		return
+	}
+	if m.empty == nil {
+		m.empty = map[string]string{}
+	}
+	if len(ev.Nodes) > 0 {
+		delete(m.empty, ev.Key)
+	} else {
+		m.empty[ev.Key] = fmt.Sprintf("no reachable nodes of %d valid", ev.Valid)
+	}
+}
+
+// report mails the outcome of the run that just ended with err.
+func (m *mailer) report(err error) {
+	if m == nil {
+		return
+	}
+	var empty []string
+	for k, why := range m.empty {
+		empty = append(empty, fmt.Sprintf("%s: %s", k, why))
+	}
+	m.empty = nil
+	sort.Strings(empty)
+
+	var subject string
+	var body strings.Builder
+	switch {
+	case err != nil:
+		subject = "run failed"
+		fmt.Fprintf(&body, "The run failed: %v\n", err)
+	case len(empty) > 0:
+		subject = fmt.Sprintf("%d keys exported no nodes", len(empty))
+	default:
+		m.last = ""
+		return
+	}
+	if len(empty) > 0 {
+		fmt.Fprintf(&body, "Keys that exported no nodes:\n\n  %s\n", strings.Join(empty, "\n  "))
+	}
+	if body.String() == m.last {
+		return
+	}
+	if host, err := os.Hostname(); err == nil {
+		subject += " on " + host
+	}
+	if err := m.send("xraysubrefiner: "+subject, body.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "!! email: %v\n", err)
+		return
+	}
+	m.last = body.String()
+}
+
+// send delivers one plain text message to every recipient.
+func (m *mailer) send(subject, body string) error {
+	c := m.cfg
+	host, port, _ := net.SplitHostPort(c.Server)
+	d := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if port == "465" {
+		conn, err = tls.DialWithDialer(d, "tcp", c.Server, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", c.Server)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	cl, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer cl.Close()
+	if port != "465" {
+		if ok, _ := cl.Extension("STARTTLS"); ok {
+			if err := cl.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Username != "" {
+		if err := cl.Auth(smtp.PlainAuth("", c.Username, c.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := cl.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := cl.Rcpt(to); err != nil {
+			return fmt.Errorf("%s: %w", to, err)
+		}
+	}
+	w, err := cl.Data()
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		c.From, strings.Join(c.To, ", "), subject, time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return cl.Quit()
+}
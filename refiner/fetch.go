@@ -0,0 +1,207 @@
+package refiner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultUserAgent is sent unless a host is known to need another one.
+const defaultUserAgent = "XraySubRefiner/1.1"
+
+// FetchCfg controls how subscription sources are fetched. On 403 or 429
+// the fetch is retried with each of UserAgents (browser-like defaults when
+// empty); a 429 Retry-After up to MaxRetryAfter is waited out first.
+// Fingerprint ("chrome", "firefox", ... as in xray's fp) fetches https
+// sources with that browser's TLS ClientHello and HTTP/2. MaxRedirects
+// (default 10, 0 = none) bounds redirects; https never redirects to http.
+type FetchCfg struct {
+	UserAgents    []string      `yaml:"user_agents"`
+	MaxRetryAfter time.Duration `yaml:"max_retry_after"`
+	Fingerprint   string        `yaml:"fingerprint"`
+	MaxRedirects  *int          `yaml:"max_redirects"`
+}
+
+const defaultMaxRedirects = 10
+
+// maxRedirects is MaxRedirects, or its default when unset.
+func (c FetchCfg) maxRedirects() int {
+	if c.MaxRedirects == nil {
+		return defaultMaxRedirects
+	}
+	return *c.MaxRedirects
+}
+
+// checkRedirect enforces fetch.max_redirects and refuses https to http
+// downgrades, which have turned sources into HTML error pages.
+func checkRedirect(max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return fmt.Errorf("stopped after %d redirects (fetch.max_redirects)", max)
+		}
+		if prev := via[len(via)-1]; prev.URL.Scheme == "https" && req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing redirect from https to %s", req.URL.Redacted())
+		}
+		return nil
+	}
+}
+
+var browserUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+}
+
+// statusError is a non-200 response.
+type statusError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string { return fmt.Sprintf("status %d", e.code) }
+
+// fetchAs GETs rawurl with the given User-Agent and returns the body and
+// its Content-Type.
+func fetchAs(ctx context.Context, client *http.Client, log io.Writer, rawurl, ua string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", ua)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if final := resp.Request.URL.String(); final != rawurl {
+		fmt.Fprintf(log, "Info: %s -> redirected to %s\n", rawurl, resp.Request.URL.Redacted())
+	}
+	if resp.StatusCode != 200 {
+		se := &statusError{code: resp.StatusCode}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			se.retryAfter = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(resp.Header.Get("Retry-After")); err == nil {
+			se.retryAfter = time.Until(t)
+		}
+		return nil, "", se
+	}
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.Header.Get("Content-Type"), err
+}
+
+var (
+	reHTMLStart = regexp.MustCompile(`(?is)^(?:\x{FEFF})?\s*(?:<!--.*?-->\s*)*<(?:!doctype\s+html|html|head|body)[\s>]`)
+	reHTMLTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+var reAnyLink = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*)://`)
+
+// hasLinks reports whether b contains a link of an allowed scheme. Web
+// links do not count for the wildcard: every page carries some.
+func hasLinks(b []byte, allowed map[string]struct{}) bool {
+	_, wild := allowed[anyScheme]
+	for _, m := range reAnyLink.FindAllSubmatch(b, -1) {
+		sch := strings.ToLower(string(m[1]))
+		if _, ok := allowed[sch]; ok {
+			return true
+		}
+		if wild && sch != "http" && sch != "https" {
+			return true
+		}
+	}
+	return false
+}
+
+// htmlPage reports a source that answered 200 with a web page instead of a
+// subscription: Cloudflare challenges, captive portals, parked domains. A
+// document counts as such when it is served as text/html or starts like
+// HTML and contains no link of an allowed scheme, even after base64
+// decoding. The page title goes into the error.
+func htmlPage(contentType string, body []byte, allowed map[string]struct{}) error {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt != "text/html" && mt != "application/xhtml+xml" && !reHTMLStart.Match(body) {
+		return nil
+	}
+	for _, b := range [][]byte{body, tryDecodeIfBase64(body)} {
+		if hasLinks(b, allowed) {
+			return nil
+		}
+	}
+	title := "untitled"
+	if m := reHTMLTitle.FindSubmatch(body); m != nil {
+		if t := strings.Join(strings.Fields(html.UnescapeString(string(m[1]))), " "); t != "" {
+			title = t
+		}
+	}
+	if r := []rune(title); len(r) > 120 {
+		title = string(r[:120]) + "..."
+	}
+	return fmt.Errorf("got an HTML page instead of a subscription (title %q)", title)
+}
+
+// fetchSource fetches a subscription URL, starting with the User-Agent
+// that last worked for its host and rotating through the configured ones
+// when the host answers 403 or 429.
+func (r *refiner) fetchSource(rawurl string, allowed map[string]struct{}) ([]byte, error) {
+	host := rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		host = u.Host
+	}
+	first := defaultUserAgent
+	if ua, ok := r.userAgents[host]; ok {
+		first = ua
+	}
+	candidates := r.cfg.Fetch.UserAgents
+	if len(candidates) == 0 {
+		candidates = browserUserAgents
+	}
+
+	tried := map[string]bool{}
+	var lastErr error
+	for _, ua := range append([]string{first, defaultUserAgent}, candidates...) {
+		if tried[ua] {
+			continue
+		}
+		tried[ua] = true
+		var se *statusError
+		if errors.As(lastErr, &se) && se.code == http.StatusTooManyRequests && se.retryAfter > 0 {
+			if se.retryAfter > r.cfg.Fetch.MaxRetryAfter {
+				return nil, fmt.Errorf("%w, Retry-After %s exceeds fetch.max_retry_after", lastErr, se.retryAfter.Round(time.Second))
+			}
+			select {
+			case <-time.After(se.retryAfter):
+			case <-r.ctx.Done():
+				return nil, r.ctx.Err()
+			}
+		}
+
+		body, ctype, err := fetchAs(r.ctx, r.client, r.log, rawurl, ua)
+		if err == nil {
+			if allowed != nil {
+				if err := htmlPage(ctype, body, allowed); err != nil {
+					return nil, err
+				}
+			}
+			if ua != first {
+				fmt.Fprintf(r.log, "Info: %s -> fetched with User-Agent %q, using it from now on\n", host, ua)
+				r.userAgents[host] = ua
+			}
+			return body, nil
+		}
+		if !errors.As(err, &se) || (se.code != http.StatusForbidden && se.code != http.StatusTooManyRequests) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,89 @@
+package refiner
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// utlsTransport fetches https URLs with a browser ClientHello (uTLS) and
+// speaks HTTP/2 when the server picks it, for sources behind anti-bot CDNs
+// that reject Go's own TLS fingerprint. Plain http URLs use the default
+// transport.
+type utlsTransport struct {
+	hello  utls.ClientHelloID
+	dialer net.Dialer
+	plain  http.RoundTripper
+	h2     *http2.Transport
+
+	mu    sync.Mutex
+	conns map[string]*http2.ClientConn
+}
+
+func newUTLSTransport(fingerprint string) *utlsTransport {
+	return &utlsTransport{
+		hello:  utlsHelloID(fingerprint),
+		dialer: net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second},
+		plain:  http.DefaultTransport,
+		h2:     &http2.Transport{},
+		conns:  map[string]*http2.ClientConn{},
+	}
+}
+
+func (t *utlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.plain.RoundTrip(req)
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+
+	t.mu.Lock()
+	cc := t.conns[addr]
+	t.mu.Unlock()
+	if cc != nil && cc.CanTakeNewRequest() {
+		return cc.RoundTrip(req)
+	}
+
+	conn, err := t.dialTLS(req.Context(), addr, req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		cc, err := t.h2.NewClientConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		t.mu.Lock()
+		t.conns[addr] = cc
+		t.mu.Unlock()
+		return cc.RoundTrip(req)
+	}
+
+	// HTTP/1.1: one request on this connection, closed with the body.
+	once := &http.Transport{
+		DialTLSContext:    func(context.Context, string, string) (net.Conn, error) { return conn, nil },
+		DisableKeepAlives: true,
+	}
+	return once.RoundTrip(req)
+}
+
+func (t *utlsTransport) dialTLS(ctx context.Context, addr, sni string) (*utls.UConn, error) {
+	raw, err := t.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	uc := utls.UClient(raw, &utls.Config{ServerName: sni}, t.hello)
+	if err := uc.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return uc, nil
+}
@@ -0,0 +1,61 @@
+package refiner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// fingerprint is the stable ID of a node: a short hash of its scheme,
+// server, port and credential, so a node can be followed across runs while
+// its remark, parameters or encoding change. It is "" for unparsable lines.
+func fingerprint(line string) string {
+	n, err := parseNode(line)
+	if err != nil {
+		return ""
+	}
+	scheme := n.Scheme
+	if scheme == "hy2" {
+		scheme = "hysteria2"
+	}
+	key := strings.Join([]string{scheme, strings.ToLower(n.Host), strconv.Itoa(n.Port), credentialOf(line)}, "\x00")
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// appendIDs adds " [<fingerprint>]" to the remark of every line.
+func appendIDs(lines []string) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if id := fingerprint(l); id != "" {
+			l = withRemark(l, func(r string) string { return strings.TrimSpace(r + " [" + id + "]") })
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// withRemark rewrites the remark of line with edit: the ps field of vmess
+// links, the #fragment of everything else. Lines it cannot rewrite are
+// returned unchanged.
+func withRemark(line string, edit func(string) string) string {
+	if strings.HasPrefix(line, "vmess://") {
+		m, err := decodeVmessPayload(line)
+		if err != nil {
+			return line
+		}
+		m["ps"] = edit(jsonString(m, "ps"))
+		out, err := encodeVmess(m)
+		if err != nil {
+			return line
+		}
+		return out
+	}
+	base, frag, _ := strings.Cut(line, "#")
+	if r, err := url.PathUnescape(frag); err == nil {
+		frag = r
+	}
+	return base + "#" + url.PathEscape(edit(frag))
+}
@@ -0,0 +1,199 @@
+package refiner
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// FixCfg enables repairs of link settings that are known to break.
+// SNIHost handles ws nodes over TLS whose SNI and Host header disagree in a
+// way CDNs reject: "fix" aligns them, "drop" removes such nodes. PortRules
+// set parameters by port; AutoTLS appends autoTLSRules to them.
+type FixCfg struct {
+	SNIHost   string     `yaml:"sni_host"`
+	PortRules []PortRule `yaml:"port_rules"`
+	AutoTLS   bool       `yaml:"auto_tls"`
+}
+
+// sniHostFix returns the SNI and Host header n should carry, and whether n
+// is broken at all. Broken are: SNI and Host on different domains (CDNs
+// refuse such fronting), and an IP address with only one of the two set,
+// since the client then fills the other in with the bare IP.
+func sniHostFix(n *node) (sni, host string, broken bool) {
+	if n.Security != "tls" || (n.Transport != "ws" && n.Transport != "httpupgrade") {
+		return "", "", false
+	}
+	sni, host = n.SNI, n.firstHostHeader()
+	isIP := net.ParseIP(n.Host) != nil
+	switch {
+	case sni != "" && host != "" && !strings.EqualFold(baseDomain(sni), baseDomain(host)):
+		return host, host, true
+	case isIP && sni == "" && host != "":
+		return host, host, true
+	case isIP && host == "" && sni != "":
+		return sni, sni, true
+	}
+	return "", "", false
+}
+
+// baseDomain approximates the registrable domain as the last two labels.
+func baseDomain(h string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(h), "."), ".")
+	if len(labels) <= 2 {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// fixSNIHost applies FixCfg.SNIHost to lines, returning the result and how
+// many lines were rewritten or dropped.
+func fixSNIHost(lines []string, mode string) ([]string, int) {
+	out := make([]string, 0, len(lines))
+	changed := 0
+	for _, l := range lines {
+		n, err := parseNode(l)
+		if err != nil {
+			out = append(out, l)
+			continue
+		}
+		sni, host, broken := sniHostFix(n)
+		if !broken {
+			out = append(out, l)
+			continue
+		}
+		if mode == "drop" {
+			changed++
+			continue
+		}
+		if fixed, err := withSNIHost(l, n, sni, host); err == nil {
+			l = fixed
+			changed++
+		}
+		out = append(out, l)
+	}
+	return out, changed
+}
+
+func withSNIHost(line string, n *node, sni, host string) (string, error) {
+	if n.Vmess != nil {
+		n.Vmess["sni"], n.Vmess["host"] = sni, host
+		return encodeVmess(n.Vmess)
+	}
+	u, err := url.Parse(line)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("sni", sni)
+	q.Set("host", host)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// PortRule sets link parameters on nodes whose port is one of Ports (and,
+// when given, whose scheme is one of Schemes). Security restricts the rule
+// to links whose security parameter currently has that value; "unset"
+// matches links that leave it out.
+type PortRule struct {
+	Ports    []int             `yaml:"ports"`
+	Schemes  []string          `yaml:"schemes"`
+	Security string            `yaml:"security"`
+	Set      map[string]string `yaml:"set"`
+}
+
+// autoTLSRules are what fix.auto_tls adds: Cloudflare's HTTPS ports imply
+// TLS, its plain-HTTP ports rule it out.
+var autoTLSRules = []PortRule{
+	{Ports: []int{443, 8443, 2053, 2083, 2087, 2096}, Security: "unset", Set: map[string]string{"security": "tls"}},
+	{Ports: []int{80, 8080, 8880, 2052, 2082, 2086, 2095}, Set: map[string]string{"security": "none"}},
+}
+
+func (p PortRule) matches(n *node) bool {
+	if !matchesAny(p.Schemes, n.Scheme) {
+		return false
+	}
+	hit := false
+	for _, port := range p.Ports {
+		if port == n.Port {
+			hit = true
+			break
+		}
+	}
+	if !hit {
+		return false
+	}
+	switch cur := rawParam(n, "security"); p.Security {
+	case "":
+		return true
+	case "unset":
+		return cur == ""
+	default:
+		return strings.EqualFold(cur, p.Security)
+	}
+}
+
+// vmessKeys maps share-link parameter names to vmess JSON keys.
+var vmessKeys = map[string]string{"security": "tls", "type": "net"}
+
+// rawParam is the parameter as the link spells it, without the defaults
+// parseNode fills in.
+func rawParam(n *node, key string) string {
+	if n.Vmess != nil {
+		if k, ok := vmessKeys[key]; ok {
+			key = k
+		}
+	}
+	return n.param(key)
+}
+
+// applyPortRules rewrites each line by the first rule that matches it and
+// returns the lines and how many changed.
+func applyPortRules(lines []string, rules []PortRule) ([]string, int) {
+	out := make([]string, 0, len(lines))
+	changed := 0
+	for _, l := range lines {
+		n, err := parseNode(l)
+		if err != nil || n.Vmess == nil && n.Query == nil {
+			out = append(out, l)
+			continue
+		}
+		for _, rule := range rules {
+			if !rule.matches(n) {
+				continue
+			}
+			if r, err := withParams(l, n, rule.Set); err == nil && r != l {
+				l = r
+				changed++
+			}
+			break
+		}
+		out = append(out, l)
+	}
+	return out, changed
+}
+
+func withParams(line string, n *node, set map[string]string) (string, error) {
+	if n.Vmess != nil {
+		for k, v := range set {
+			if vk, ok := vmessKeys[k]; ok {
+				k = vk
+			}
+			if k == "tls" && v == "none" {
+				v = ""
+			}
+			n.Vmess[k] = v
+		}
+		return encodeVmess(n.Vmess)
+	}
+	u, err := url.Parse(line)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range set {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,181 @@
+package refiner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fixtures records HTTP responses and probe results of a run into dir, or
+// replays them from there, so filter and selection changes can be tested
+// against a fixed input without the network.
+type fixtures struct {
+	dir    string
+	replay bool
+}
+
+// useFixtures routes the refiner's HTTP client and probes through the
+// fixtures in dir.
+func (r *refiner) useFixtures(dir string, replay bool) {
+	r.fixtures = &fixtures{dir: dir, replay: replay}
+	r.client.Transport = r.fixtures.transport(r.client.Transport)
+}
+
+// httpFixture is one recorded response, stored under http/ by the hash of
+// its request.
+type httpFixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// probeFixture is the recorded verdict on one node.
+type probeFixture struct {
+	Error      string          `json:"error,omitempty"`
+	Latency    time.Duration   `json:"latency,omitempty"`
+	Cert       *certInfo       `json:"cert,omitempty"`
+	Unverified bool            `json:"unverified,omitempty"`
+	Vantage    map[string]bool `json:"vantage,omitempty"`
+	Mbps       float64         `json:"mbps,omitempty"`
+	Jitter     time.Duration   `json:"jitter,omitempty"`
+	Loss       float64         `json:"loss,omitempty"`
+	Method     string          `json:"method,omitempty"`
+	Checked    *time.Time      `json:"checked,omitempty"`
+}
+
+// errNotRecorded marks requests and nodes missing from a replayed fixture.
+var errNotRecorded = errors.New("not in the replayed fixtures")
+
+func (f *fixtures) httpPath(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	return filepath.Join(f.dir, "http", hex.EncodeToString(sum[:8])+".json")
+}
+
+// transport wraps next so responses are recorded or replayed.
+func (f *fixtures) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		path := f.httpPath(req)
+		if f.replay {
+			b, err := os.ReadFile(path)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), errNotRecorded)
+			}
+			if err != nil {
+				return nil, err
+			}
+			var fx httpFixture
+			if err := json.Unmarshal(b, &fx); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			return &http.Response{
+				Status: fmt.Sprintf("%d %s", fx.Status, http.StatusText(fx.Status)), StatusCode: fx.Status,
+				Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+				Header: fx.Header, Body: io.NopCloser(bytes.NewReader(fx.Body)),
+				ContentLength: int64(len(fx.Body)), Request: req,
+			}, nil
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		b, err := json.MarshalIndent(httpFixture{
+			Method: req.Method, URL: req.URL.String(), Status: resp.StatusCode, Header: resp.Header, Body: body,
+		}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		return resp, writeFileAtomic(path, b)
+	})
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return fn(req) }
+
+func (f *fixtures) probePath(key string) string {
+	return filepath.Join(f.dir, "probe", filepath.FromSlash(key)+".json")
+}
+
+// recordProbes stores the probe results of key.
+func (f *fixtures) recordProbes(key string, results []probeResult) error {
+	m := make(map[string]probeFixture, len(results))
+	for _, r := range results {
+		fx := probeFixture{
+			Latency: r.latency, Cert: r.cert, Unverified: r.unverified, Vantage: r.vantage,
+			Mbps: r.mbps, Jitter: r.jitter, Loss: r.loss, Method: r.method,
+		}
+		if !r.checked.IsZero() {
+			fx.Checked = &r.checked
+		}
+		if r.err != nil {
+			fx.Error = r.err.Error()
+		}
+		m[r.line] = fx
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := f.probePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// replayProbes returns the recorded results of key for lines, in order.
+// Lines without a recording fail as not probed.
+func (f *fixtures) replayProbes(key string, lines []string) ([]probeResult, error) {
+	b, err := os.ReadFile(f.probePath(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	m := map[string]probeFixture{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.probePath(key), err)
+		}
+	}
+	out := make([]probeResult, len(lines))
+	for i, l := range lines {
+		fx, ok := m[l]
+		r := probeResult{
+			line: l, latency: fx.Latency, cert: fx.Cert, unverified: fx.Unverified, vantage: fx.Vantage,
+			mbps: fx.Mbps, jitter: fx.Jitter, loss: fx.Loss, method: fx.Method,
+		}
+		if fx.Checked != nil {
+			r.checked = *fx.Checked
+		}
+		switch {
+		case !ok:
+			r.err = errNotRecorded
+		case fx.Error != "":
+			r.err = errors.New(fx.Error)
+		}
+		out[i] = r
+	}
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package refiner
+
+import (
+	"net/url"
+	"strings"
+)
+
+// normalizeFragments rewrites remarks that strict clients (Streisand,
+// sing-box) reject, failing the whole import: URL fragments holding a
+// second "#", stray "%" or raw control whitespace become one
+// percent-encoded fragment, and vmess names lose their line breaks. Encoded
+// invisible characters are scrubbed from both. Other links are left byte
+// for byte. It returns how many links changed.
+func normalizeFragments(lines []string) ([]string, int) {
+	changed := 0
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = l
+		if !brokenFragment(l) {
+			continue
+		}
+		if fixed := withRemark(l, cleanRemark); fixed != l {
+			out[i] = fixed
+			changed++
+		}
+	}
+	return out, changed
+}
+
+// brokenFragment reports whether line's remark needs normalizing.
+func brokenFragment(line string) bool {
+	if strings.HasPrefix(line, "vmess://") {
+		m, err := decodeVmessPayload(line)
+		if err != nil {
+			return false
+		}
+		ps, _ := m["ps"].(string)
+		return strings.ContainsAny(ps, "\r\n\t") || scrubText(ps) != ps
+	}
+	_, frag, ok := strings.Cut(line, "#")
+	if !ok {
+		return false
+	}
+	if strings.ContainsAny(frag, "#\r\n\t") {
+		return true
+	}
+	name, err := url.PathUnescape(frag)
+	return err != nil || scrubText(name) != name
+}
+
+// cleanRemark turns every run of whitespace in s into one space and drops
+// invisible characters.
+func cleanRemark(s string) string {
+	return scrubText(strings.Join(strings.Fields(s), " "))
+}
@@ -0,0 +1,110 @@
+package refiner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SourcesCfg tracks source health. After DegradeAfter consecutive fetch
+// failures a source is degraded: it is only tried again every Recheck, and
+// runs in between use its last good body (or keep its previous exports).
+// Webhook receives a JSON event when a source degrades or recovers.
+type SourcesCfg struct {
+	DegradeAfter int           `yaml:"degrade_after"`
+	Recheck      time.Duration `yaml:"recheck"`
+	Webhook      string        `yaml:"webhook"`
+}
+
+// sourceHealth persists in state under "sources".
+type sourceHealth struct {
+	Failures  int       `json:"failures"`
+	Degraded  bool      `json:"degraded,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	LastTry   time.Time `json:"last_try"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var errSourceDegraded = errors.New("source degraded")
+
+// sourceEvent is the webhook payload.
+type sourceEvent struct {
+	Event    string    `json:"event"`
+	Key      string    `json:"key"`
+	URL      string    `json:"url"`
+	Failures int       `json:"failures,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// fetchTracked fetches sub like fetch, keeping its health in sources.
+// It returns errSourceDegraded for a degraded source with nothing cached.
+func (r *refiner) fetchTracked(sub Subscription, now time.Time, sources map[string]*sourceHealth) ([]byte, error) {
+	c := r.cfg.Sources
+	if c.DegradeAfter <= 0 {
+		return r.fetch(sub, now)
+	}
+	h := sources[sub.Key]
+	if h == nil {
+		h = &sourceHealth{}
+		sources[sub.Key] = h
+	}
+	if h.Degraded && now.Sub(h.LastTry) < c.Recheck {
+		return r.lastGoodBody(sub.Key, h)
+	}
+
+	h.LastTry = now
+	body, err := r.fetch(sub, now)
+	if err != nil {
+		h.Failures++
+		h.LastError = err.Error()
+		if !h.Degraded && h.Failures >= c.DegradeAfter {
+			h.Degraded, h.Since = true, now
+			fmt.Fprintf(r.log, "!! %s: source degraded after %d consecutive failures, retrying every %s\n", sub.Key, h.Failures, c.Recheck)
+			r.notify(sourceEvent{Event: "source_degraded", Key: sub.Key, URL: sub.URL, Failures: h.Failures, Error: h.LastError, Time: now})
+		}
+		if h.Degraded {
+			fmt.Fprintf(r.log, "!! fetch error %s: %v\n", sub.URL, err)
+			return r.lastGoodBody(sub.Key, h)
+		}
+		return nil, err
+	}
+	if h.Degraded {
+		fmt.Fprintf(r.log, "Info: %s -> source recovered after %s\n", sub.Key, now.Sub(h.Since).Round(time.Second))
+		r.notify(sourceEvent{Event: "source_recovered", Key: sub.Key, URL: sub.URL, Time: now})
+	}
+	*h = sourceHealth{LastTry: now}
+	r.lastGood[sub.Key] = body
+	return body, nil
+}
+
+func (r *refiner) lastGoodBody(key string, h *sourceHealth) ([]byte, error) {
+	if b, ok := r.lastGood[key]; ok {
+		fmt.Fprintf(r.log, "Info: %s -> source degraded since %s, using its last good body\n", key, h.Since.Format(time.RFC3339))
+		return b, nil
+	}
+	return nil, errSourceDegraded
+}
+
+// notify posts ev to the configured webhook. Failures are only logged.
+func (r *refiner) notify(ev sourceEvent) {
+	if r.cfg.Sources.Webhook == "" {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	resp, err := r.client.Post(r.cfg.Sources.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		fmt.Fprintf(r.log, "!! webhook: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		fmt.Fprintf(r.log, "!! webhook: status %d\n", resp.StatusCode)
+	}
+}
@@ -0,0 +1,144 @@
+package refiner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// ValidationCfg adds checks on top of link syntax. ResolveHosts drops nodes
+// whose domain does not resolve, or resolves only to non-routable
+// addresses.
+type ValidationCfg struct {
+	ResolveHosts bool `yaml:"resolve_hosts"`
+}
+
+// placeholderDomains are names feeds use as fillers; nodes on them never
+// work.
+var placeholderDomains = []string{"example.com", "example.net", "example.org"}
+
+// reservedTLDs never resolve on the public internet (RFC 2606, RFC 6761,
+// RFC 6762).
+var reservedTLDs = map[string]bool{"localhost": true, "local": true, "invalid": true, "test": true, "example": true}
+
+// reservedPrefixes are the documentation ranges (RFC 5737, RFC 3849) and
+// carrier-grade NAT space (RFC 6598), which netip does not count as private.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// validateHost rejects hosts that cannot be a working server address:
+// malformed names (RFC 1123 labels, ASCII only, so IDNs must be punycode),
+// reserved and placeholder domains, and non-routable IPs.
+func validateHost(h string) error {
+	h = strings.TrimSuffix(h, ".")
+	if a, err := netip.ParseAddr(h); err == nil {
+		if !routable(a) {
+			return fmt.Errorf("host %s is not a routable address", h)
+		}
+		return nil
+	}
+
+	if len(h) == 0 || len(h) > 253 {
+		return fmt.Errorf("host %q has invalid length", h)
+	}
+	labels := strings.Split(strings.ToLower(h), ".")
+	for _, l := range labels {
+		if err := checkLabel(l); err != nil {
+			return fmt.Errorf("host %q: %w", h, err)
+		}
+	}
+	tld := labels[len(labels)-1]
+	if strings.Trim(tld, "0123456789") == "" {
+		return fmt.Errorf("host %q has a numeric top-level label", h)
+	}
+	if len(labels) == 1 {
+		return fmt.Errorf("host %q is not a fully qualified name", h)
+	}
+	if reservedTLDs[tld] {
+		return fmt.Errorf("host %q is on reserved domain .%s", h, tld)
+	}
+	lower := strings.ToLower(h)
+	for _, d := range placeholderDomains {
+		if lower == d || strings.HasSuffix(lower, "."+d) {
+			return fmt.Errorf("host %q is a placeholder domain", h)
+		}
+	}
+	return nil
+}
+
+func checkLabel(l string) error {
+	if len(l) == 0 || len(l) > 63 {
+		return errors.New("empty or over-long label")
+	}
+	if l[0] == '-' || l[len(l)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with a hyphen", l)
+	}
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		// Underscores are not RFC 1123 but common in working CDN names.
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("label %q contains characters outside [a-z0-9-_]", l)
+		}
+	}
+	return nil
+}
+
+func routable(a netip.Addr) bool {
+	a = a.Unmap()
+	if a.IsLoopback() || a.IsUnspecified() || a.IsPrivate() || a.IsLinkLocalUnicast() ||
+		a.IsLinkLocalMulticast() || a.IsMulticast() || a.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// dropUnresolvable removes lines whose host does not resolve or resolves
+// only to non-routable addresses, recording them in rej.
+func dropUnresolvable(ctx context.Context, lines []string, timeout time.Duration, rej *rejects) []string {
+	hosts := make([]string, len(lines))
+	for i, l := range lines {
+		if n, err := parseNode(l); err == nil {
+			hosts[i] = n.Host
+		}
+	}
+	resolved := resolveHosts(ctx, hosts, timeout, 20)
+
+	out := make([]string, 0, len(lines))
+	for i, l := range lines {
+		if hosts[i] == "" {
+			out = append(out, l)
+			continue
+		}
+		addrs, ok := resolved[hosts[i]]
+		if !ok {
+			rej.add(l, "validation", fmt.Sprintf("host %s does not resolve", hosts[i]))
+			continue
+		}
+		usable := false
+		for _, a := range addrs {
+			if routable(a) {
+				usable = true
+				break
+			}
+		}
+		if !usable {
+			rej.add(l, "validation", fmt.Sprintf("host %s resolves only to non-routable addresses", hosts[i]))
+			continue
+		}
+		out = append(out, l)
+	}
+	return out
+}
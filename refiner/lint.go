@@ -0,0 +1,293 @@
+package refiner
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// lintProblem is one thing a mainstream client would reject in an export.
+type lintProblem struct {
+	path   string
+	line   int // 0 for problems of the whole file or of a structured entry
+	id     string
+	reason string
+}
+
+func (p lintProblem) String() string {
+	loc := p.path
+	if p.line > 0 {
+		loc += ":" + strconv.Itoa(p.line)
+	}
+	if p.id != "" {
+		return fmt.Sprintf("%s: %s: %s", loc, p.id, p.reason)
+	}
+	return fmt.Sprintf("%s: %s", loc, p.reason)
+}
+
+// runLintExport re-parses the files of an export directory the way strict
+// clients do and lists every node they would reject:
+//
+//	xraysubrefiner lint-export -exec "subconverter-check" export
+//
+// Each -exec command is also run on every subscription file, with the path
+// as its last argument; a non-zero exit counts as a rejection. The exit
+// status is 1 when anything was found, so the command can gate publishing.
+func runLintExport(args []string) {
+	fs := flag.NewFlagSet("lint-export", flag.ExitOnError)
+	var execs []string
+	fs.Func("exec", "external checker run on every subscription file (repeatable)", func(s string) error {
+		if strings.TrimSpace(s) == "" {
+			return fmt.Errorf("empty command")
+		}
+		execs = append(execs, s)
+		return nil
+	})
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: xraysubrefiner lint-export [-exec cmd]... <dir>")
+		os.Exit(2)
+	}
+
+	files, nodes, problems, err := lintExport(fs.Arg(0), execs)
+	must(err)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Fprintf(os.Stderr, "Info: lint-export -> %d files, %d nodes, %d problems\n", files, nodes, len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// lintExport checks every export file under dir and returns how many files
+// and nodes it looked at with the problems found.
+func lintExport(dir string, execs []string) (files, nodes int, problems []lintProblem, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || reportFiles[d.Name()] {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var n int
+		var ps []lintProblem
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			return nil
+		case ".json":
+			n, ps = lintXray(path, b)
+		case ".yaml", ".yml":
+			n, ps = lintClash(path, b)
+		default:
+			n, ps = lintLinks(path, b)
+		}
+		if n < 0 {
+			return nil
+		}
+		files++
+		nodes += n
+		problems = append(problems, ps...)
+		for _, c := range execs {
+			if p, ok := lintExec(c, path); !ok {
+				problems = append(problems, p)
+			}
+		}
+		return nil
+	})
+	return files, nodes, problems, err
+}
+
+// lintLinks checks a plain or base64 subscription. It returns -1 for files
+// that are neither.
+func lintLinks(path string, b []byte) (int, []lintProblem) {
+	var body []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		body = append(body, l)
+	}
+	text := strings.Join(body, "\n")
+	if !strings.Contains(text, "://") {
+		dec, ok := decodeB64(text)
+		if !ok || !strings.Contains(string(dec), "://") {
+			return -1, nil
+		}
+		text = string(dec)
+	}
+	var problems []lintProblem
+	n := 0
+	for i, l := range strings.Split(text, "\n") {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		n++
+		if err := lintLink(l); err != nil {
+			problems = append(problems, lintProblem{path: path, line: i + 1, id: fingerprint(l), reason: err.Error()})
+		}
+	}
+	return n, problems
+}
+
+// lintLink applies the checks of the strictest clients to one link, which
+// are stricter than what the refiner accepts from feeds.
+func lintLink(line string) error {
+	switch {
+	case line != strings.TrimSpace(line):
+		return fmt.Errorf("surrounding whitespace")
+	case scrubText(line) != line:
+		return fmt.Errorf("invisible control, zero-width or bidi characters")
+	case len(line) > maxLinkLength:
+		return fmt.Errorf("%d bytes, over the %d byte limit", len(line), maxLinkLength)
+	case brokenFragment(line):
+		return fmt.Errorf("malformed remark")
+	}
+	if err := validateLinkSyntax(line); err != nil {
+		return err
+	}
+	if strings.HasPrefix(line, "vmess://") {
+		body, _, _ := strings.Cut(strings.TrimPrefix(line, "vmess://"), "#")
+		dec, ok := decodeB64(body)
+		if !ok || !json.Valid(dec) {
+			return fmt.Errorf("vmess payload is not base64 encoded JSON")
+		}
+	} else if _, err := url.Parse(line); err != nil {
+		return err
+	}
+	_, err := parseNode(line)
+	return err
+}
+
+// lintXray checks an "xray" export. It returns -1 for JSON files that are
+// not one.
+func lintXray(path string, b []byte) (int, []lintProblem) {
+	var confs []map[string]json.RawMessage
+	if json.Unmarshal(b, &confs) != nil {
+		return -1, nil
+	}
+	var problems []lintProblem
+	for i, c := range confs {
+		var remark string
+		_ = json.Unmarshal(c["remarks"], &remark)
+		var obs []struct {
+			Tag      string          `json:"tag"`
+			Protocol string          `json:"protocol"`
+			Settings json.RawMessage `json:"settings"`
+		}
+		where := fmt.Sprintf("config %d", i+1)
+		switch err := json.Unmarshal(c["outbounds"], &obs); {
+		case err != nil:
+			problems = append(problems, lintProblem{path: path, reason: fmt.Sprintf("%s: outbounds: %v", where, err)})
+		case len(obs) == 0 || obs[0].Protocol == "" || len(obs[0].Settings) == 0:
+			problems = append(problems, lintProblem{path: path, reason: where + ": first outbound has no protocol or settings"})
+		}
+		if strings.TrimSpace(remark) == "" {
+			problems = append(problems, lintProblem{path: path, reason: where + ": no remarks"})
+		}
+		tags := map[string]bool{}
+		for _, ob := range obs {
+			if ob.Tag != "" && tags[ob.Tag] {
+				problems = append(problems, lintProblem{path: path, reason: fmt.Sprintf("%s: duplicate outbound tag %q", where, ob.Tag)})
+			}
+			tags[ob.Tag] = true
+		}
+	}
+	return len(confs), problems
+}
+
+// lintClash checks a "clash" or "clash-provider" export. It returns -1 for
+// YAML files without proxies.
+func lintClash(path string, b []byte) (int, []lintProblem) {
+	var doc struct {
+		Proxies []map[string]any `yaml:"proxies"`
+		Groups  []struct {
+			Name    string   `yaml:"name"`
+			Proxies []string `yaml:"proxies"`
+		} `yaml:"proxy-groups"`
+	}
+	groups := map[string]bool{"DIRECT": true, "REJECT": true}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		if bytes.Contains(b, []byte("proxies:")) {
+			return 0, []lintProblem{{path: path, reason: err.Error()}}
+		}
+		return -1, nil
+	}
+	if doc.Proxies == nil {
+		return -1, nil
+	}
+	var problems []lintProblem
+	names := map[string]bool{}
+	for i, p := range doc.Proxies {
+		name, _ := p["name"].(string)
+		where := fmt.Sprintf("proxy %d", i+1)
+		if name != "" {
+			where = fmt.Sprintf("proxy %q", name)
+		}
+		bad := func(format string, a ...any) {
+			problems = append(problems, lintProblem{path: path, reason: where + ": " + fmt.Sprintf(format, a...)})
+		}
+		switch {
+		case name == "":
+			bad("no name")
+		case names[name]:
+			bad("duplicate name")
+		}
+		names[name] = true
+		if t, _ := p["type"].(string); t == "" {
+			bad("no type")
+		}
+		if s, _ := p["server"].(string); s == "" {
+			bad("no server")
+		}
+		if port, ok := p["port"].(int); !ok || port < 1 || port > 65535 {
+			bad("port %v out of range", p["port"])
+		}
+	}
+	for _, g := range doc.Groups {
+		groups[g.Name] = true
+	}
+	for _, g := range doc.Groups {
+		for _, m := range g.Proxies {
+			if !names[m] && !groups[m] {
+				problems = append(problems, lintProblem{path: path, reason: fmt.Sprintf("group %q: unknown member %q", g.Name, m)})
+			}
+		}
+	}
+	return len(doc.Proxies), problems
+}
+
+// lintExec runs the external checker cmd on path.
+func lintExec(cmd, path string) (lintProblem, bool) {
+	argv := append(strings.Fields(cmd), path)
+	out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+	if err == nil {
+		return lintProblem{}, true
+	}
+	reason := fmt.Sprintf("%s: %v", argv[0], err)
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		reason += ": " + strings.ReplaceAll(msg, "\n", "; ")
+	}
+	return lintProblem{path: path, reason: reason}, false
+}
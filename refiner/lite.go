@@ -0,0 +1,228 @@
+package refiner
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// LiteCfg sizes outputs with lite: true (the default "lite" output). N is
+// the window of newest entries considered; Strategy "tail" (the default)
+// keeps them all, "per_host" at most PerHostLimit (default 1) per host,
+// newest first, and "rotate" a different MaxTotal of them every round, so
+// successive runs spread subscribers over the whole healthy pool. MaxTotal
+// caps what is left. An unset N is MaxTotal for "tail" and the whole list
+// for "per_host" and "rotate"; an unset MaxTotal is N, and both default to
+// 100.
+type LiteCfg struct {
+	Strategy     string `yaml:"strategy"`
+	MaxTotal     int    `yaml:"max_total"`
+	PerHostLimit int    `yaml:"per_host_limit"`
+	N            int    `yaml:"n"`
+	// RotateEvery advances rotate rounds by the run timestamp; unset, a
+	// round is a run with state.path, or else an hour.
+	RotateEvery time.Duration `yaml:"rotate_every"`
+
+	// round and seed, the key, pick the rotate sample.
+	round uint64
+	seed  string
+}
+
+const defaultLiteSize = 100
+
+// merge returns l with the set fields of o applied on top.
+func (l LiteCfg) merge(o LiteCfg) LiteCfg {
+	if o.Strategy != "" {
+		l.Strategy = o.Strategy
+	}
+	if o.MaxTotal != 0 {
+		l.MaxTotal = o.MaxTotal
+	}
+	if o.PerHostLimit != 0 {
+		l.PerHostLimit = o.PerHostLimit
+	}
+	if o.N != 0 {
+		l.N = o.N
+	}
+	if o.RotateEvery != 0 {
+		l.RotateEvery = o.RotateEvery
+	}
+	return l
+}
+
+// check rejects settings that contradict each other, before defaults are
+// filled in.
+func (l LiteCfg) check() error {
+	switch l.Strategy {
+	case "", "tail", "per_host", "rotate":
+	default:
+		return fmt.Errorf("lite.strategy must be tail, per_host or rotate, got %q", l.Strategy)
+	}
+	if l.N < 0 || l.MaxTotal < 0 || l.PerHostLimit < 0 || l.RotateEvery < 0 {
+		return fmt.Errorf("lite: n, max_total, per_host_limit and rotate_every must not be negative")
+	}
+	if l.N > 0 && l.MaxTotal > l.N {
+		return fmt.Errorf("lite.max_total (%d) is larger than lite.n (%d), which already bounds the list; raise n or drop max_total", l.MaxTotal, l.N)
+	}
+	return nil
+}
+
+// window is how many of the newest entries lite considers; 0 is all.
+func (l LiteCfg) window() int {
+	switch {
+	case l.N > 0:
+		return l.N
+	case l.Strategy == "per_host" || l.Strategy == "rotate":
+		return 0
+	case l.MaxTotal > 0:
+		return l.MaxTotal
+	}
+	return defaultLiteSize
+}
+
+// limit applies the strategy and MaxTotal to the window picked from lines,
+// keeping prefer's schemes first when it has to drop some.
+func (l LiteCfg) limit(lines []string, prefer []string) []string {
+	if l.Strategy == "per_host" {
+		lines = limitPerHost(lines, l.PerHostLimit)
+	}
+	max := l.MaxTotal
+	if max <= 0 {
+		max = l.window()
+	}
+	if l.Strategy == "rotate" {
+		if max <= 0 {
+			max = defaultLiteSize
+		}
+		return rotateSample(lines, max, l.round, l.seed)
+	}
+	if max > 0 && len(lines) > max {
+		lines = keepPreferred(lines, max, prefer, newer)
+	}
+	return lines
+}
+
+// limitPerHost keeps the newest perHost (default 1) lines of every host,
+// in their original order.
+func limitPerHost(lines []string, perHost int) []string {
+	if perHost <= 0 {
+		perHost = 1
+	}
+	keep := make([]bool, len(lines))
+	seen := map[string]int{}
+	for i := len(lines) - 1; i >= 0; i-- {
+		h := hostKey(lines[i])
+		if seen[h] < perHost {
+			seen[h]++
+			keep[i] = true
+		}
+	}
+	out := lines[:0:0]
+	for i, l := range lines {
+		if keep[i] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// NormalCfg caps outputs with normal: true (the default "normal" output),
+// which otherwise hold every reachable node; some clients hang importing
+// thousands. Strategy picks the MaxTotal kept: "tail" (default) the newest,
+// "latency" the fastest, "per_host" the newest PerHostLimit (default 1) per
+// host before the newest MaxTotal of those. Order is kept either way.
+type NormalCfg struct {
+	MaxTotal     int    `yaml:"max_total"`
+	Strategy     string `yaml:"strategy"`
+	PerHostLimit int    `yaml:"per_host_limit"`
+}
+
+// merge returns c with the set fields of o applied on top.
+func (c NormalCfg) merge(o NormalCfg) NormalCfg {
+	if o.MaxTotal != 0 {
+		c.MaxTotal = o.MaxTotal
+	}
+	if o.Strategy != "" {
+		c.Strategy = o.Strategy
+	}
+	if o.PerHostLimit != 0 {
+		c.PerHostLimit = o.PerHostLimit
+	}
+	return c
+}
+
+func (c NormalCfg) check() error {
+	switch c.Strategy {
+	case "", "tail", "latency", "per_host":
+	default:
+		return fmt.Errorf("normal.strategy must be tail, latency or per_host, got %q", c.Strategy)
+	}
+	if c.MaxTotal < 0 || c.PerHostLimit < 0 {
+		return fmt.Errorf("normal: max_total and per_host_limit must not be negative")
+	}
+	return nil
+}
+
+// limit applies MaxTotal to lines with the configured strategy, keeping
+// prefer's schemes first.
+func (c NormalCfg) limit(lines []string, results map[string]*probeResult, prefer []string) []string {
+	if c.Strategy == "per_host" {
+		lines = limitPerHost(lines, c.PerHostLimit)
+	}
+	if c.MaxTotal <= 0 || len(lines) <= c.MaxTotal {
+		return lines
+	}
+	if c.Strategy != "latency" {
+		return keepPreferred(lines, c.MaxTotal, prefer, newer)
+	}
+	return keepPreferred(lines, c.MaxTotal, prefer, func(lines []string, i, j int) bool {
+		return latencyOf(results, lines[i]) < latencyOf(results, lines[j])
+	})
+}
+
+// rotateSample picks size of lines for the given round, in their original
+// order. Lines are ranked by a hash of seed and line, which is stable
+// across runs, and each round takes the next size of that ranking, so every
+// line comes up once per len(lines)/size rounds however the pool is
+// ordered.
+func rotateSample(lines []string, size int, round uint64, seed string) []string {
+	if len(lines) <= size {
+		return lines
+	}
+	rank := make([]uint64, len(lines))
+	idx := make([]int, len(lines))
+	for i, l := range lines {
+		h := fnv.New64a()
+		h.Write([]byte(seed))
+		h.Write([]byte{0})
+		h.Write([]byte(l))
+		rank[i], idx[i] = h.Sum64(), i
+	}
+	sort.Slice(idx, func(a, b int) bool { return rank[idx[a]] < rank[idx[b]] })
+	n := uint64(len(lines))
+	start := round % n * uint64(size) % n
+	picked := make([]bool, len(lines))
+	for i := uint64(0); i < uint64(size); i++ {
+		picked[idx[(start+i)%n]] = true
+	}
+	out := make([]string, 0, size)
+	for i, l := range lines {
+		if picked[i] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// rotationRound is the rotate round of a run stamped stamp, the runs-th
+// recorded in state when stateful.
+func rotationRound(l LiteCfg, stamp time.Time, runs int, stateful bool) uint64 {
+	switch {
+	case l.RotateEvery > 0:
+		return uint64(stamp.Unix() / int64(max(l.RotateEvery/time.Second, 1)))
+	case stateful:
+		return uint64(runs)
+	}
+	return uint64(stamp.Unix() / 3600)
+}
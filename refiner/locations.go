@@ -0,0 +1,195 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GeoIPCfg verifies that location nodes really are in their country.
+// Source is a URL or file path template for per-country CIDR lists (one
+// prefix per line, e.g. ipdeny.com zone files); {cc} is replaced by the
+// lower-case and {CC} by the upper-case country code.
+type GeoIPCfg struct {
+	Source string `yaml:"source"`
+}
+
+var reCountryCode = regexp.MustCompile(`^[A-Za-z]{2}$`)
+
+// applyLocationDefaults fills unset fields of every location from defaults
+// and derives its country from the last key segment ("location/DE") when
+// none is given.
+func applyLocationDefaults(locs []Subscription, defaults Subscription) error {
+	for i := range locs {
+		l := &locs[i]
+		l.location = true
+		l.Probe = defaults.Probe.merge(l.Probe)
+		if l.MinFetchInterval == 0 {
+			l.MinFetchInterval = defaults.MinFetchInterval
+		}
+		if l.ProtocolRatio == nil {
+			l.ProtocolRatio = defaults.ProtocolRatio
+		}
+		if l.FreshnessHalfLife == 0 {
+			l.FreshnessHalfLife = defaults.FreshnessHalfLife
+		}
+		if l.AllowedSchemes == nil {
+			l.AllowedSchemes = defaults.AllowedSchemes
+		}
+		l.Profile = defaults.Profile.merge(l.Profile)
+		if l.ExpandPorts.Ports == "" && !l.ExpandPorts.Comments {
+			l.ExpandPorts = defaults.ExpandPorts
+		}
+		if l.CleanIPs.Source == "" {
+			l.CleanIPs = defaults.CleanIPs
+		}
+		l.Xray = defaults.Xray.merge(l.Xray)
+		l.Clash = defaults.Clash.merge(l.Clash)
+		l.Lite = defaults.Lite.merge(l.Lite)
+		l.Normal = defaults.Normal.merge(l.Normal)
+		if l.Country == "" {
+			if seg := l.Key[strings.LastIndex(l.Key, "/")+1:]; reCountryCode.MatchString(seg) {
+				l.Country = seg
+			}
+		}
+		if l.Country != "" && !reCountryCode.MatchString(l.Country) {
+			return fmt.Errorf("location %s: country must be a two-letter code, got %q", l.Key, l.Country)
+		}
+		l.Country = strings.ToUpper(l.Country)
+	}
+	return nil
+}
+
+// countryPrefixes loads the CIDR list of cc, once per run.
+func (r *refiner) countryPrefixes(cache map[string][]netip.Prefix, cc string) ([]netip.Prefix, error) {
+	if p, ok := cache[cc]; ok {
+		return p, nil
+	}
+	src := strings.NewReplacer("{cc}", strings.ToLower(cc), "{CC}", cc).Replace(r.cfg.GeoIP.Source)
+	b, err := r.readSource(src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("geoip %s: %w", src, err)
+	}
+	var out []netip.Prefix
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		e := strings.TrimSpace(sc.Text())
+		if p, err := netip.ParsePrefix(e); err == nil {
+			out = append(out, p.Masked())
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("geoip %s: no prefixes", src)
+	}
+	cache[cc] = out
+	return out, nil
+}
+
+// filterCountry drops lines whose host resolves only to addresses outside
+// prefixes. Hosts that do not resolve are kept; probing decides on them.
+func filterCountry(ctx context.Context, lines []string, prefixes []netip.Prefix, cc string, timeout time.Duration, rej *rejects) []string {
+	hosts := make([]string, len(lines))
+	for i, l := range lines {
+		if n, err := parseNode(l); err == nil {
+			hosts[i] = n.Host
+		}
+	}
+	resolved := resolveHosts(ctx, hosts, timeout, 20)
+
+	out := make([]string, 0, len(lines))
+	for i, l := range lines {
+		addrs := resolved[hosts[i]]
+		if len(addrs) == 0 || inPrefixes(addrs, prefixes) {
+			out = append(out, l)
+			continue
+		}
+		rej.add(l, "geoip", fmt.Sprintf("host %s is not in %s", hosts[i], cc))
+	}
+	return out
+}
+
+func inPrefixes(addrs []netip.Addr, prefixes []netip.Prefix) bool {
+	for _, a := range addrs {
+		for _, p := range prefixes {
+			if p.Contains(a.Unmap()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countryEntry is one location in countries.json. UpdatedAt is the last
+// run that refined the key; entries of keys that failed this run are
+// carried over from the previous file.
+type countryEntry struct {
+	Country   string         `json:"country,omitempty"`
+	Key       string         `json:"key"`
+	Nodes     int            `json:"nodes"`
+	Protocols map[string]int `json:"protocols"`
+	Outputs   []string       `json:"outputs"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+type countriesFile struct {
+	GeneratedAt time.Time      `json:"generated_at"`
+	Countries   []countryEntry `json:"countries"`
+}
+
+// countSchemes counts lines per scheme.
+func countSchemes(lines []string) map[string]int {
+	out := map[string]int{}
+	for _, l := range lines {
+		out[schemeOf(l)]++
+	}
+	return out
+}
+
+// writeCountries writes the top-level countries.json summarizing every
+// configured location, sorted by country code and key.
+func writeCountries(root string, entries []countryEntry, locs []Subscription, now time.Time) error {
+	if len(locs) == 0 {
+		return nil
+	}
+	path := filepath.Join(root, "countries.json")
+	have := map[string]bool{}
+	for _, e := range entries {
+		have[e.Key] = true
+	}
+	configured := map[string]bool{}
+	for _, l := range locs {
+		configured[l.Key] = true
+	}
+	var prev countriesFile
+	if b, err := os.ReadFile(path); err == nil && json.Unmarshal(b, &prev) == nil {
+		for _, e := range prev.Countries {
+			if configured[e.Key] && !have[e.Key] {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Country != entries[j].Country {
+			return entries[i].Country < entries[j].Country
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	b, err := json.MarshalIndent(countriesFile{GeneratedAt: now, Countries: entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
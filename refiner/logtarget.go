@@ -0,0 +1,109 @@
+package refiner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Syslog priorities, as journald and syslog number them.
+const (
+	prioCrit    = 2
+	prioErr     = 3
+	prioWarning = 4
+	prioInfo    = 6
+)
+
+// logSink receives one log line with its priority.
+type logSink func(prio int, line string)
+
+// flushLog closes the redirected stdout and stderr and waits until their
+// lines reached the log target. It is a no-op for "stderr".
+var flushLog = func() {}
+
+// setLogTarget sends what the process prints to target: "stderr" (the
+// default) leaves stdout and stderr alone; "journald" prefixes every line
+// with its priority in the form journald parses from a service's output;
+// "syslog" hands the lines to the local syslog daemon instead. The priority
+// is taken from the line: "!! run failed" is an error, other "!!" lines are
+// warnings and the rest is informational. Fatal errors are critical.
+func setLogTarget(target string) error {
+	var sink logSink
+	switch target {
+	case "", "stderr":
+		return nil
+	case "journald":
+		out := os.Stderr
+		sink = func(prio int, line string) { fmt.Fprintf(out, "<%d>%s\n", prio, line) }
+	case "syslog":
+		var err error
+		if sink, err = syslogSink("xraysubrefiner"); err != nil {
+			return fmt.Errorf("-log syslog: %w", err)
+		}
+	default:
+		return fmt.Errorf("-log must be stderr, journald or syslog, got %q", target)
+	}
+
+	// One pipe for both keeps progress and errors in order.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	os.Stdout, os.Stderr = pw, pw
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardLines(pr, sink)
+	}()
+	var once sync.Once
+	flushLog = func() {
+		once.Do(func() {
+			pw.Close()
+			<-done
+		})
+	}
+	log.SetFlags(0)
+	log.SetOutput(prioWriter{sink, prioCrit})
+	return nil
+}
+
+// forwardLines passes the lines read from r to sink until r ends.
+func forwardLines(r io.Reader, sink logSink) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) != "" {
+			sink(linePriority(line), line)
+		}
+	}
+}
+
+func linePriority(line string) int {
+	switch {
+	case strings.HasPrefix(line, "!! run failed"):
+		return prioErr
+	case strings.HasPrefix(line, "!!"):
+		return prioWarning
+	}
+	return prioInfo
+}
+
+// prioWriter logs every write at one priority. Only log.Fatal writes to
+// it, so it flushes the lines printed before, which would be lost on exit.
+type prioWriter struct {
+	sink logSink
+	prio int
+}
+
+func (w prioWriter) Write(b []byte) (int, error) {
+	flushLog()
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		w.sink(w.prio, line)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package refiner
+
+import "log/syslog"
+
+// syslogSink connects to the local syslog daemon, logging as tag to the
+// daemon facility.
+func syslogSink(tag string) (logSink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return func(prio int, line string) {
+		switch prio {
+		case prioCrit:
+			_ = w.Crit(line)
+		case prioErr:
+			_ = w.Err(line)
+		case prioWarning:
+			_ = w.Warning(line)
+		default:
+			_ = w.Info(line)
+		}
+	}, nil
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package refiner
+
+import "errors"
+
+func syslogSink(string) (logSink, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
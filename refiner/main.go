@@ -0,0 +1,1610 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Subscription struct {
+	Key   string      `yaml:"key"`
+	URL   string      `yaml:"url"`
+	Probe ProbeLimits `yaml:"probe"`
+
+	// MinFetchInterval limits how often the source is fetched in daemon
+	// mode; runs in between reuse the last fetched body.
+	MinFetchInterval time.Duration `yaml:"min_fetch_interval"`
+
+	// ProtocolRatio shares the slots of tail outputs (lite) between
+	// schemes, e.g. {vless: 60%, vmess: 20%, ss: 20%}.
+	ProtocolRatio map[string]string `yaml:"protocol_ratio"`
+	ratio         map[string]float64
+
+	// FreshnessHalfLife favours recently first-seen nodes in selection
+	// (needs state.path): a node's weight halves every FreshnessHalfLife.
+	FreshnessHalfLife time.Duration `yaml:"freshness_half_life"`
+
+	// Merge makes this key the union of already refined keys, without
+	// fetching or probing anything itself.
+	Merge []string `yaml:"merge"`
+
+	// Sources refines each of several URLs on its own and merges them,
+	// weighted, into this key in place of URL.
+	Sources []WeightedSource `yaml:"sources"`
+	weights []int
+	// hidden keys are the per-source members of a key with sources; they
+	// are refined but not exported.
+	hidden bool
+
+	// Country is the ISO code of a location; it defaults to a two-letter
+	// last key segment.
+	Country  string `yaml:"country"`
+	location bool
+
+	// PreviousKeys are former names of this key; their state history is
+	// carried over and their outputs kept for state.rename_grace.
+	PreviousKeys []string `yaml:"previous_keys"`
+
+	// AllowedSchemes replaces the global allowed_schemes for this key;
+	// "*" passes every link on to validation.
+	AllowedSchemes []string `yaml:"allowed_schemes"`
+	allowed        map[string]struct{}
+
+	// Profile overrides the global profile fields for this key.
+	Profile ProfileCfg `yaml:"profile"`
+
+	ExpandPorts ExpandPortsCfg `yaml:"expand_ports"`
+	CleanIPs    CleanIPsCfg    `yaml:"clean_ips"`
+	// Xray overrides the global xray output settings for this key.
+	Xray XrayCfg `yaml:"xray"`
+	// Clash overrides the global clash output settings for this key.
+	Clash ClashCfg `yaml:"clash"`
+	// Lite and Normal override the global lite sizing and normal cap for
+	// this key.
+	Lite   LiteCfg   `yaml:"lite"`
+	Normal NormalCfg `yaml:"normal"`
+}
+
+type ProbeStrategy struct {
+	Match   string        `yaml:"match"`
+	Method  string        `yaml:"method"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ProbeLimits bound how much probing a key gets. Zero fields inherit.
+type ProbeLimits struct {
+	// Enabled false skips probing and exports every valid node.
+	Enabled     *bool         `yaml:"enabled"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Concurrency int           `yaml:"concurrency"`
+	MaxNodes    int           `yaml:"max_nodes"`
+	// Slice probes keys with more candidates in rotating windows of this
+	// many nodes, one per run.
+	Slice int `yaml:"slice"`
+}
+
+// merge returns l with the non-zero fields of o applied on top.
+func (l ProbeLimits) merge(o ProbeLimits) ProbeLimits {
+	if o.Enabled != nil {
+		l.Enabled = o.Enabled
+	}
+	if o.Timeout > 0 {
+		l.Timeout = o.Timeout
+	}
+	if o.Concurrency > 0 {
+		l.Concurrency = o.Concurrency
+	}
+	if o.MaxNodes > 0 {
+		l.MaxNodes = o.MaxNodes
+	}
+	if o.Slice > 0 {
+		l.Slice = o.Slice
+	}
+	return l
+}
+
+type ProbeCfg struct {
+	ProbeLimits `yaml:",inline"`
+
+	Family     string `yaml:"family"`
+	SourceAddr string `yaml:"source_addr"`
+	Interface  string `yaml:"interface"`
+	WSCheck    bool   `yaml:"ws_check"`
+	GRPCCheck  bool   `yaml:"grpc_check"`
+
+	// ICMPFallback pings hosts whose TCP dial timed out.
+	ICMPFallback bool `yaml:"icmp_fallback"`
+	// Samples above one takes extra connect timings for jitter and loss.
+	Samples int `yaml:"samples"`
+
+	TLSCheck         TLSCheckCfg `yaml:"tls_check"`
+	RealityCheck     bool        `yaml:"reality_check"`
+	DropExpiredCerts bool        `yaml:"drop_expired_certs"`
+	DropSelfSigned   bool        `yaml:"drop_self_signed_certs"`
+
+	Strategies []ProbeStrategy `yaml:"strategies"`
+	Default    ProbeStrategy   `yaml:"default"`
+
+	Adaptive AdaptiveTimeoutCfg `yaml:"adaptive_timeout"`
+
+	// Workers bounds the probes in flight across all keys (default:
+	// concurrency); MaxOpenSockets the sockets they hold open, 0 for no
+	// limit.
+	Workers        int `yaml:"workers"`
+	MaxOpenSockets int `yaml:"max_open_sockets"`
+
+	DNS DNSCacheCfg `yaml:"dns"`
+
+	// FullEvery probes everything only every Nth daemon cycle; the cycles
+	// between probe new and previously failed nodes only.
+	FullEvery int `yaml:"full_every"`
+}
+
+type DedupeCfg struct {
+	CollapseCloudflare bool `yaml:"collapse_cloudflare"`
+}
+
+type ConvertCfg struct {
+	VmessToVless bool   `yaml:"vmess_to_vless"`
+	SSFormat     string `yaml:"ss_format"`
+}
+
+type StateCfg struct {
+	Path    string `yaml:"path"`
+	History int    `yaml:"history"`
+	// RenameGrace is how long outputs are still written under a key's
+	// previous_keys after a rename.
+	RenameGrace time.Duration `yaml:"rename_grace"`
+}
+
+type QuarantineCfg struct {
+	FlapThreshold  int `yaml:"flap_threshold"`
+	ReinstateAfter int `yaml:"reinstate_after"`
+}
+
+type CredentialsCfg struct {
+	WarnShared         int `yaml:"warn_shared"`
+	PerCredentialLimit int `yaml:"per_credential_limit"`
+}
+
+type ReportCfg struct {
+	JSON    bool `yaml:"json"`
+	CSV     bool `yaml:"csv"`
+	Rejects bool `yaml:"rejects"`
+	// Sidecar writes <output>.probe.json next to every output.
+	Sidecar bool `yaml:"sidecar"`
+}
+
+type Config struct {
+	SecretsFile    string            `yaml:"secrets_file"`
+	AllowedSchemes []string          `yaml:"allowed_schemes"`
+	SchemeAliases  map[string]string `yaml:"scheme_aliases"`
+	Split          SplitCfg          `yaml:"split"`
+	Lite           LiteCfg           `yaml:"lite"`
+	Normal         NormalCfg         `yaml:"normal"`
+	Probe          ProbeCfg          `yaml:"probe"`
+	Agents         AgentsCfg         `yaml:"agents"`
+	Throughput     ThroughputCfg     `yaml:"throughput"`
+	Reports        ReportCfg         `yaml:"reports"`
+	Dedupe         DedupeCfg         `yaml:"dedupe"`
+	Convert        ConvertCfg        `yaml:"convert"`
+	Vmess          VmessCfg          `yaml:"vmess"`
+	Normalize      NormalizeCfg      `yaml:"normalize"`
+	Fix            FixCfg            `yaml:"fix"`
+	Validation     ValidationCfg     `yaml:"validation"`
+	Remarks        RemarksCfg        `yaml:"remarks"`
+	Blocklists     []BlocklistSource `yaml:"blocklists"`
+	State          StateCfg          `yaml:"state"`
+	Quarantine     QuarantineCfg     `yaml:"quarantine"`
+	GraceRuns      int               `yaml:"grace_runs"`
+	Credentials    CredentialsCfg    `yaml:"credentials"`
+	Outputs        []OutputCfg       `yaml:"outputs"`
+	Export         ExportCfg         `yaml:"export"`
+	Snapshots      SnapshotCfg       `yaml:"snapshots"`
+	Metadata       MetadataCfg       `yaml:"metadata"`
+	Subscriptions  []Subscription    `yaml:"subscriptions"`
+	Locations      []Subscription    `yaml:"locations"`
+	LocDefaults    Subscription      `yaml:"location_defaults"`
+	GeoIP          GeoIPCfg          `yaml:"geoip"`
+	Serve          ServeCfg          `yaml:"serve"`
+	Sources        SourcesCfg        `yaml:"sources"`
+	Fetch          FetchCfg          `yaml:"fetch"`
+	Deterministic  bool              `yaml:"deterministic"`
+	Profile        ProfileCfg        `yaml:"profile"`
+	Xray           XrayCfg           `yaml:"xray"`
+	Clash          ClashCfg          `yaml:"clash"`
+	Email          EmailCfg          `yaml:"email"`
+	RunAs          RunAsCfg          `yaml:"run_as"`
+	Disk           DiskCfg           `yaml:"disk"`
+	SharedIPs      SharedIPsCfg      `yaml:"shared_ips"`
+	ASN            ASNCfg            `yaml:"asn"`
+
+	// TransportOutputs adds per-transport outputs to Outputs.
+	TransportOutputs TransportOutputsCfg `yaml:"transport_outputs"`
+
+	// warnings are problems that make a run unsafe only in some
+	// environments; -strict turns them into errors.
+	warnings []string
+}
+
+var (
+	rePossibleB64      = regexp.MustCompile(`^[A-Za-z0-9+/=\r\n]+$`)
+	reCommentLine      = regexp.MustCompile(`^\s*(#|//|;).*$`)
+	reInvalidFileChars = regexp.MustCompile(`[<>:"\\|?*\x00-\x1F]`)
+)
+
+func must(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Main runs the xraysubrefiner command line on os.Args.
+func Main() {
+	cfgPath := flag.String("config", "config.yaml", "path to config.yaml")
+	outDir := flag.String("out", "export", "output directory")
+	timeout := flag.Duration("timeout", 20*time.Second, "HTTP client timeout")
+	probeTimeout := flag.Duration("probe-timeout", 0, "probe timeout per node (overrides probe.timeout)")
+	probeConcurrency := flag.Int("probe-concurrency", 0, "concurrent probes per key (overrides probe.concurrency)")
+	probeMaxNodes := flag.Int("probe-max-nodes", 0, "max nodes probed per key (overrides probe.max_nodes)")
+	interval := flag.Duration("interval", 0, "run continuously, starting a new run this often (0 = run once)")
+	strict := flag.Bool("strict", false, "treat config warnings as errors")
+	record := flag.String("record", "", "record HTTP responses and probe results into this directory")
+	replay := flag.String("replay", "", "replay HTTP responses and probe results recorded with -record")
+	logTarget := flag.String("log", "stderr", "stderr | journald | syslog")
+	installService := flag.Bool("install-service", false, "install a Windows service running the daemon with the other flags, then exit")
+	uninstallService := flag.Bool("uninstall-service", false, "remove the Windows service, then exit")
+	serviceName := flag.String("service-name", "xraysubrefiner", "Windows service name")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "refine":
+			runRefine(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "token":
+			runToken(os.Args[2:])
+			return
+		case "lint-export":
+			runLintExport(os.Args[2:])
+			return
+		}
+	}
+	flag.Parse()
+	must(setLogTarget(*logTarget))
+	defer flushLog()
+	if *installService || *uninstallService {
+		must(manageService(*serviceName, *installService))
+		return
+	}
+	// Services start in System32; relative paths in config.yaml are taken
+	// from its directory instead.
+	asService := serviceMode()
+	if asService {
+		must(os.Chdir(filepath.Dir(*cfgPath)))
+	}
+
+	cfg, err := LoadConfig(*cfgPath)
+	must(err)
+	must(cfg.checkWarnings(*strict))
+	cfg.Probe.ProbeLimits = cfg.Probe.ProbeLimits.merge(ProbeLimits{
+		Timeout:     *probeTimeout,
+		Concurrency: *probeConcurrency,
+		MaxNodes:    *probeMaxNodes,
+	})
+
+	r, err := newRefiner(cfg, *outDir, *timeout, os.Stderr)
+	must(err)
+	switch {
+	case *record != "" && *replay != "":
+		log.Fatal("-record and -replay are mutually exclusive")
+	case *record != "":
+		r.useFixtures(*record, false)
+	case *replay != "":
+		r.useFixtures(*replay, true)
+	}
+	must(r.dropPrivileges())
+	if *interval > 0 {
+		if asService {
+			must(runService(*serviceName, func() { r.daemon(*interval) }))
+			return
+		}
+		r.daemon(*interval)
+		return
+	}
+	err = r.run()
+	r.mail.report(err)
+	must(err)
+}
+
+// newRefiner prepares the HTTP client, prober and scheme filter for cfg.
+func newRefiner(cfg *Config, outDir string, timeout time.Duration, log io.Writer) (*refiner, error) {
+	client := &http.Client{Timeout: timeout, CheckRedirect: checkRedirect(cfg.Fetch.maxRedirects())}
+	if cfg.Fetch.Fingerprint != "" {
+		client.Transport = newUTLSTransport(cfg.Fetch.Fingerprint)
+	}
+
+	dialer, err := newProbeDialer(cfg.Probe, cfg.Probe.Timeout, log)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]struct{})
+
+	if len(cfg.AllowedSchemes) == 0 {
+		return nil, errors.New("allowed_schemes is missing or empty in config.yaml")
+	}
+
+	for _, s := range cfg.AllowedSchemes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			return nil, errors.New("allowed_schemes contains an empty value in config.yaml")
+		}
+		allowed[s] = struct{}{}
+	}
+
+	r := &refiner{
+		cfg:        cfg,
+		outDir:     outDir,
+		client:     client,
+		prober:     newProber(cfg.Probe, dialer),
+		allowed:    allowed,
+		fetched:    map[string]fetchedSource{},
+		sources:    map[string]*sourceHealth{},
+		slices:     map[string]*sliceState{},
+		lastGood:   map[string][]byte{},
+		userAgents: map[string]string{},
+		progress:   os.Stdout,
+		log:        log,
+		ctx:        context.Background(),
+	}
+	if r.mail = newMailer(cfg.Email, append(cfg.Subscriptions, cfg.Locations...)); r.mail != nil {
+		r.obs = observers{r.mail}
+	}
+	return r, nil
+}
+
+// refiner holds what stays fixed across runs; run does one full pass over
+// all subscriptions.
+type refiner struct {
+	cfg     *Config
+	outDir  string
+	client  *http.Client
+	prober  *prober
+	allowed map[string]struct{}
+
+	// fetched caches source bodies for min_fetch_interval, keyed by key.
+	fetched map[string]fetchedSource
+	// progress receives the per-key progress lines, log the Info and !!
+	// lines of every stage.
+	progress io.Writer
+	log      io.Writer
+	stdin    []byte
+	// countries collects the location entries of countries.json per run.
+	countries []countryEntry
+	// aliases maps keys to previous keys whose outputs are still written.
+	aliases map[string][]string
+	// status and refresh are set in serve mode: the dashboard reads the
+	// run history and can start a run early.
+	status  *runStatus
+	refresh chan struct{}
+	// sources holds source health when there is no state file; lastGood
+	// the last body each source returned.
+	sources  map[string]*sourceHealth
+	lastGood map[string][]byte
+	// slices holds time-sliced probing progress when there is no state
+	// file.
+	slices map[string]*sliceState
+	// userAgents remembers per host the User-Agent that got through.
+	userAgents map[string]string
+	// ctx bounds source fetches, DNS lookups and probes; obs is told
+	// about every stage.
+	ctx context.Context
+	obs observers
+	// fixtures records or replays HTTP responses and probe results.
+	fixtures *fixtures
+	// probes keeps results between daemon cycles for probe.full_every.
+	probes *probeCache
+	// runs is the state's run counter of the current run.
+	runs int
+	// mail reports failed runs and empty keys by email.
+	mail *mailer
+	// shared holds the shared addresses found in the current run; asns
+	// the asn.source table, loaded at asnsAt.
+	shared *sharedIPs
+	asns   asnTable
+	asnsAt time.Time
+}
+
+// pendingExport is a key of the current run waiting to be exported.
+type pendingExport struct {
+	sub Subscription
+	rej *rejects
+}
+
+func (r *refiner) run() error {
+	cfg := r.cfg
+	// Check the disk before anything is downloaded.
+	if err := r.diskPreflight(); err != nil {
+		return err
+	}
+	blocked := r.loadBlocklists()
+
+	st, err := loadState(cfg.State.Path)
+	if err != nil {
+		return err
+	}
+	st.Runs++
+	r.runs = st.Runs
+	now := time.Now().UTC()
+	r.refreshASNs(now)
+	stamp, err := outputStamp(cfg.Deterministic, now)
+	if err != nil {
+		return err
+	}
+	// Source health survives process restarts only with state.path.
+	sources := r.sources
+	if cfg.State.Path != "" {
+		if st.Sources == nil {
+			st.Sources = map[string]*sourceHealth{}
+		}
+		sources = st.Sources
+		if st.UserAgents == nil {
+			st.UserAgents = map[string]string{}
+		}
+		r.userAgents = st.UserAgents
+	}
+
+	stage, err := beginExport(r.outDir, cfg.Export.Staging)
+	if err != nil {
+		return err
+	}
+
+	allSubs := append(cfg.Subscriptions, cfg.Locations...)
+	done := map[string]refinedKey{}
+	var pending []pendingExport
+	geo := map[string][]netip.Prefix{}
+	cleanIPs := map[string][]netip.Addr{}
+	r.countries = nil
+	r.aliases = map[string][]string{}
+	if cfg.State.Path != "" {
+		for _, sub := range allSubs {
+			st.migrate(r.log, sub, now)
+			r.aliases[sub.Key] = st.aliases(sub.Key, now, cfg.State.RenameGrace)
+		}
+		if err := r.retireRenames(stage.root, st, now); err != nil {
+			return err
+		}
+	}
+	for _, sub := range allSubs {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if len(sub.Merge) > 0 {
+			continue
+		}
+		fmt.Fprintf(r.progress, "Processing %s (%s)\n", sub.Key, sub.URL)
+		limits := cfg.Probe.ProbeLimits.merge(sub.Probe)
+		fetchStart := time.Now()
+		raw, err := r.fetchTracked(sub, now, sources)
+		r.obs.OnFetch(FetchEvent{Key: sub.Key, URL: sub.URL, Bytes: len(raw), Duration: time.Since(fetchStart), Err: err})
+		if errors.Is(err, errSourceDegraded) {
+			fmt.Fprintf(r.log, "Info: %s -> source degraded, keeping its previous exports\n", sub.Key)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(r.log, "!! fetch error %s: %v\n", sub.URL, err)
+			continue
+		}
+
+		rej := &rejects{key: sub.Key, keep: cfg.Reports.Rejects, obs: r.obs}
+		keyDir := filepath.Join(stage.root, sub.Key)
+
+		decoded := tryDecodeIfBase64(raw)
+		meta := captureMetadata(decoded, cfg.Metadata)
+		if sub.ExpandPorts.Comments {
+			var n int
+			if decoded, n = expandPortDirectives(r.log, decoded, sub.ExpandPorts.Max, sub.Key); n > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> expanded %d nodes over directive ports\n", sub.Key, n)
+			}
+		}
+		valid := parseAndFilterLines(decoded, r.allowedFor(sub), cfg.SchemeAliases, cfg.Split, rej)
+		var oversized int
+		if valid, oversized = dropOversized(valid, rej); oversized > 0 {
+			fmt.Fprintf(r.log, "Info: %s -> dropped %d links longer than %d bytes\n", sub.Key, oversized, maxLinkLength)
+		}
+		var fixedFrags int
+		if valid, fixedFrags = normalizeFragments(valid); fixedFrags > 0 {
+			fmt.Fprintf(r.log, "Info: %s -> normalized the remarks of %d links with broken fragments\n", sub.Key, fixedFrags)
+		}
+		valid = expandPorts(valid, sub.ExpandPorts.list)
+		normal := rej.dedupe(valid, "exact duplicate of another node")
+		if cfg.Vmess.Lenient {
+			var repaired int
+			normal, repaired = repairVmessLines(normal)
+			if repaired > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> repaired %d sloppy vmess payloads\n", sub.Key, repaired)
+				normal = rej.dedupe(normal, "duplicate of another node after vmess repair")
+			}
+		}
+		normal = filterValidLines(r.log, normal, sub.Key, rej)
+		if cfg.Remarks.enabled() {
+			before := len(normal)
+			normal = filterRemarks(normal, cfg.Remarks, now, rej)
+			if dropped := before - len(normal); dropped > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> dropped %d expired or advertising nodes\n", sub.Key, dropped)
+			}
+		}
+		if cfg.Validation.ResolveHosts {
+			before := len(normal)
+			normal = dropUnresolvable(r.ctx, normal, limits.Timeout, rej)
+			if dropped := before - len(normal); dropped > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> dropped %d nodes with unresolvable hosts\n", sub.Key, dropped)
+			}
+		}
+		normal = rej.dedupe(canonicalVmessLines(normal), "duplicate of another node after vmess canonicalization")
+		normal = rej.dedupe(normalizeLines(normal, cfg.Normalize), "duplicate of another node after normalization")
+		if len(cfg.Fix.PortRules) > 0 {
+			var changed int
+			normal, changed = applyPortRules(normal, cfg.Fix.PortRules)
+			if changed > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> port rules rewrote %d nodes\n", sub.Key, changed)
+				normal = rej.dedupe(normal, "duplicate of another node after port rules")
+			}
+		}
+		if cfg.Fix.SNIHost != "" {
+			before := normal
+			var changed int
+			normal, changed = fixSNIHost(normal, cfg.Fix.SNIHost)
+			if cfg.Fix.SNIHost == "drop" {
+				rej.diff(before, normal, "fix", "ws SNI and Host header mismatch")
+				if changed > 0 {
+					fmt.Fprintf(r.log, "Info: %s -> dropped %d nodes with mismatched SNI/Host\n", sub.Key, changed)
+				}
+			} else if changed > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> aligned SNI/Host of %d nodes\n", sub.Key, changed)
+				normal = rej.dedupe(normal, "duplicate of another node after SNI/Host alignment")
+			}
+		}
+
+		if cfg.Convert.VmessToVless {
+			var converted int
+			normal, converted = convertVmessToVless(normal)
+			if converted > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> converted %d vmess nodes to vless\n", sub.Key, converted)
+				normal = rej.dedupe(normal, "duplicate of another node after vmess to vless conversion")
+			}
+		}
+		if cfg.Convert.SSFormat != "" {
+			normal = rej.dedupe(convertSSFormat(normal, cfg.Convert.SSFormat), "duplicate of another node after ss format conversion")
+		}
+
+		fmt.Fprintf(r.log, "Info: %s -> %d lines after validation\n", sub.Key, len(normal))
+		if len(normal) == 0 {
+			fmt.Fprintf(r.log, "Info: %s has no valid configs after validation, skipping\n", sub.Key)
+			if err := rej.write(keyDir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !blocked.empty() {
+			var dropped int
+			before := normal
+			normal, dropped = blocked.filter(r.ctx, normal, limits.Timeout)
+			rej.diff(before, normal, "blocklist", "host is blocklisted")
+			if dropped > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> dropped %d blocklisted nodes\n", sub.Key, dropped)
+			}
+		}
+
+		if cfg.Dedupe.CollapseCloudflare {
+			var collapsed int
+			before := normal
+			normal, collapsed = collapseCloudflareDuplicates(r.ctx, normal, limits.Timeout)
+			rej.diff(before, normal, "dedupe", "duplicate of another Cloudflare-fronted node")
+			if collapsed > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> collapsed %d Cloudflare-fronted duplicates\n", sub.Key, collapsed)
+			}
+		}
+
+		if sub.location && sub.Country != "" && cfg.GeoIP.Source != "" {
+			prefixes, err := r.countryPrefixes(geo, sub.Country)
+			if err != nil {
+				fmt.Fprintf(r.log, "!! %s: %v, skipping country verification\n", sub.Key, err)
+			} else {
+				before := len(normal)
+				normal = filterCountry(r.ctx, normal, prefixes, sub.Country, limits.Timeout, rej)
+				if dropped := before - len(normal); dropped > 0 {
+					fmt.Fprintf(r.log, "Info: %s -> dropped %d nodes outside %s\n", sub.Key, dropped, sub.Country)
+				}
+			}
+		}
+
+		if sub.CleanIPs.Source != "" {
+			ips, err := r.loadCleanIPs(cleanIPs, sub.CleanIPs.Source)
+			if err != nil {
+				fmt.Fprintf(r.log, "!! %s: %v, skipping clean IP substitution\n", sub.Key, err)
+			} else {
+				var added int
+				normal, added = substituteCleanIPs(r.ctx, normal, ips, sub.CleanIPs.PerNode, sub.CleanIPs.DropOriginal, limits.Timeout)
+				if added > 0 {
+					fmt.Fprintf(r.log, "Info: %s -> added %d clean IP variants of Cloudflare-fronted nodes\n", sub.Key, added)
+				}
+			}
+		}
+
+		var results []probeResult
+		probed := limits.Enabled == nil || *limits.Enabled
+		if probed && r.fixtures != nil && r.fixtures.replay {
+			if results, err = r.fixtures.replayProbes(sub.Key, normal); err != nil {
+				return err
+			}
+		} else if probed {
+			probe := func(lines []string, maxNodes int) []probeResult {
+				res := probeAdaptive(r.log, sub.Key, lines, r.prober.withTimeout(limits.Timeout).withContext(r.ctx), limits.Concurrency, maxNodes)
+				if len(cfg.Agents.Endpoints) > 0 {
+					applyAgents(r.ctx, r.log, res, cfg.Agents, limits.Timeout, sub.Key)
+				}
+				if cfg.Throughput.Enabled {
+					measureThroughput(r.ctx, r.log, res, cfg.Throughput, sub.Key)
+				}
+				return res
+			}
+			if limits.Slice > 0 && len(normal) > limits.Slice {
+				results = probeSlice(r.log, sub.Key, normal, limits.Slice, r.sliceState(st, sub.Key), now, func(lines []string) []probeResult {
+					return probe(lines, 0)
+				})
+			} else {
+				results = r.probes.probeDiff(r.log, sub.Key, normal, limits.MaxNodes, func(lines []string) []probeResult {
+					return probe(lines, limits.MaxNodes)
+				})
+			}
+			if r.fixtures != nil {
+				if err := r.fixtures.recordProbes(sub.Key, results); err != nil {
+					return err
+				}
+			}
+		} else {
+			fmt.Fprintf(r.log, "Info: %s -> probing disabled, exporting all %d valid nodes unverified\n", sub.Key, len(normal))
+			results = unprobedResults(normal)
+		}
+		// Probes cut short by cancellation say nothing about the nodes.
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if probed && cfg.State.Path != "" {
+			ks := st.key(sub.Key)
+			ks.observe(results, now, cfg.State.History)
+			if held := ks.applyQuarantine(results, cfg.Quarantine.FlapThreshold, cfg.Quarantine.ReinstateAfter); held > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> %d reachable nodes held in quarantine\n", sub.Key, held)
+			}
+			ks.applyFreshness(results, now, sub.FreshnessHalfLife)
+			if kept := ks.applyGrace(results, cfg.GraceRuns); kept > 0 {
+				fmt.Fprintf(r.log, "Info: %s -> %d failed nodes kept within grace_runs\n", sub.Key, kept)
+			}
+		}
+		reachable := reachableLines(results)
+		rej.probed(normal, results)
+		if probed {
+			for _, res := range results {
+				r.obs.OnNodeProbed(ProbeEvent{Key: sub.Key, Link: res.line, Reachable: res.err == nil, Latency: res.latency, Err: res.err})
+			}
+		}
+
+		fmt.Fprintf(r.log, "Info: %s -> %d syntactically valid, %d reachable\n",
+			sub.Key, len(normal), len(reachable))
+
+		done[sub.Key] = refinedKey{reachable: reachable, results: results, meta: meta, valid: len(normal)}
+		if sub.hidden {
+			continue
+		}
+		// shared_ips needs the nodes of every key, so its exports wait
+		// until all are probed.
+		if cfg.SharedIPs.Enabled {
+			pending = append(pending, pendingExport{sub: sub, rej: rej})
+			continue
+		}
+		if err := r.export(stage.root, sub, sub.URL, done[sub.Key], rej, stamp); err != nil {
+			return err
+		}
+	}
+
+	r.shared = nil
+	if cfg.SharedIPs.Enabled {
+		r.shared = r.findSharedIPs(done)
+	}
+	for _, p := range pending {
+		if err := r.export(stage.root, p.sub, p.sub.URL, done[p.sub.Key], p.rej, stamp); err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range allSubs {
+		if len(sub.Merge) == 0 {
+			continue
+		}
+		fmt.Fprintf(r.progress, "Processing %s (merge of %s)\n", sub.Key, strings.Join(sub.Merge, ", "))
+		m := mergeKeys(sub.Merge, sub.weights, done)
+		done[sub.Key] = m
+		fmt.Fprintf(r.log, "Info: %s -> %d reachable from %d merged keys\n", sub.Key, len(m.reachable), len(sub.Merge))
+		if err := r.export(stage.root, sub, "merge:"+strings.Join(sub.Merge, ","), m, nil, stamp); err != nil {
+			return err
+		}
+	}
+
+	if err := writeCountries(stage.root, r.countries, cfg.Locations, stamp); err != nil {
+		return err
+	}
+	if err := writeSnapshot(stage.root, cfg.Snapshots, now); err != nil {
+		return err
+	}
+	if err := stage.commit(); err != nil {
+		return err
+	}
+	return saveState(cfg.State.Path, st)
+}
+
+// export applies the credential limits to the reachable nodes of one key
+// and writes its rejects, manifest, reports and outputs under root, dated
+// stamp.
+func (r *refiner) export(root string, sub Subscription, source string, k refinedKey, rej *rejects, stamp time.Time) error {
+	cfg := r.cfg
+	reachable, results, meta := k.reachable, k.results, k.meta
+	keyDir := filepath.Join(root, sub.Key)
+	creds := countCredentials(reachable)
+	if cfg.Credentials.WarnShared > 0 && creds.TopShared >= cfg.Credentials.WarnShared {
+		fmt.Fprintf(r.log, "!! %s: %d of %d reachable nodes share one credential (%d distinct), likely a single overloaded backend\n",
+			sub.Key, creds.TopShared, creds.Nodes, creds.Distinct)
+	}
+	if limited, dropped := limitPerCredential(reachable, cfg.Credentials.PerCredentialLimit); dropped > 0 {
+		fmt.Fprintf(r.log, "Info: %s -> dropped %d nodes over per_credential_limit\n", sub.Key, dropped)
+		rej.diff(reachable, limited, "credentials", "over per_credential_limit")
+		reachable = limited
+	}
+	if limited, dropped := r.shared.limit(reachable); dropped > 0 {
+		fmt.Fprintf(r.log, "Info: %s -> dropped %d nodes over shared_ips.max_per_ip\n", sub.Key, dropped)
+		rej.diff(reachable, limited, "shared_ip", "over shared_ips.max_per_ip on its address")
+		reachable = limited
+	}
+
+	if err := os.MkdirAll(keyDir, 0o755); err != nil {
+		return err
+	}
+	if err := rej.write(keyDir); err != nil {
+		return err
+	}
+	if cfg.Metadata.manifest() {
+		if err := writeManifest(keyDir, keyManifest{Key: sub.Key, Source: source, GeneratedAt: stamp, Metadata: meta}); err != nil {
+			return err
+		}
+	}
+	var header []string
+	if cfg.Metadata.header() {
+		header = meta
+	}
+	// The provider block goes into plain and Clash outputs, where its
+	// lines are comments; in front of a base64 body they would not be.
+	textHeader := append(cfg.Profile.merge(sub.Profile).commentLines(stamp), header...)
+
+	rep := buildKeyReport(sub.Key, results, stamp)
+	rep.Credentials = &creds
+	r.shared.annotate(&rep)
+	r.reportASNs(sub.Key, reachable, &rep)
+	if err := writeReports(keyDir, rep, cfg.Reports); err != nil {
+		return err
+	}
+
+	var entry *countryEntry
+	if sub.location {
+		r.countries = append(r.countries, countryEntry{
+			Country: sub.Country, Key: sub.Key, Nodes: len(reachable),
+			Protocols: countSchemes(reachable), UpdatedAt: stamp,
+		})
+		entry = &r.countries[len(r.countries)-1]
+	}
+
+	if len(r.obs) > 0 {
+		r.obs.OnExport(ExportEvent{Key: sub.Key, Valid: k.valid, Nodes: publicNodes(reachable, results)})
+	}
+	if len(reachable) == 0 {
+		fmt.Fprintf(r.log, "Info: %s has no reachable endpoints, skipping exports\n", sub.Key)
+		return nil
+	}
+
+	ec := exportCfgFor(cfg.Export, sub)
+	xc := cfg.Xray.merge(sub.Xray)
+	cc := cfg.Clash.merge(sub.Clash)
+	lite := cfg.Lite.merge(sub.Lite)
+	lite.round, lite.seed = rotationRound(lite, stamp, r.runs, cfg.State.Path != ""), sub.Key
+	normal := cfg.Normal.merge(sub.Normal)
+	byLine := resultsByLine(results)
+	for _, o := range cfg.Outputs {
+		path, err := exportPath(root, ec, sub.Key, o)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(root, path); err == nil && entry != nil {
+			entry.Outputs = append(entry.Outputs, filepath.ToSlash(rel))
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		lines := selectOutput(reachable, o, byLine, sub.ratio, lite, normal)
+		// The sidecar looks results up by the lines as probed.
+		selected := lines
+		if cfg.Remarks.Template != "" {
+			lines = applyRemarkTemplate(lines, cfg.Remarks.Template, byLine, cfg.Probe.Samples > 1)
+		}
+		if cfg.Remarks.AppendID {
+			lines = appendIDs(lines)
+		}
+		h := header
+		switch o.Format {
+		case "plain", "clash", "clash-provider":
+			h = textHeader
+		}
+		if o.Format == "clash-provider" {
+			h = append(append([]string(nil), h...), cc.providerHint(sub.Key)...)
+		}
+		if err := writeOutput(path, lines, o, h, xc, cc); err != nil {
+			return err
+		}
+		if cfg.Reports.Sidecar {
+			sc := o
+			ext := sidecarExt
+			sc.Extension = &ext
+			scPath, err := exportPath(root, ec, sub.Key, sc)
+			if err != nil {
+				return err
+			}
+			if err := writeSidecar(scPath, selected, byLine); err != nil {
+				return err
+			}
+		}
+		for _, old := range r.aliases[sub.Key] {
+			oldPath, err := exportPath(root, ec, old, o)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(oldPath), 0o755); err != nil {
+				return err
+			}
+			if err := writeOutput(oldPath, lines, o, h, xc, cc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkWarnings prints the config warnings; with strict they are fatal.
+func (c *Config) checkWarnings(strict bool) error {
+	for _, w := range c.warnings {
+		fmt.Fprintf(os.Stderr, "!! config: %s\n", w)
+	}
+	if strict && len(c.warnings) > 0 {
+		return fmt.Errorf("config warnings are fatal with -strict")
+	}
+	return nil
+}
+
+// LoadConfig reads the config at path, substitutes its ${NAME} references
+// from secrets_file or the environment and parses it like ParseConfig.
+// Errors name the file and the offending line.
+func LoadConfig(path string) (*Config, error) {
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, warnings, err := resolveSecrets(orig, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(b, orig)
+	var ce configErrors
+	if errors.As(err, &ce) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg.warnings = append(warnings, cfg.warnings...)
+	return cfg, nil
+}
+
+// ParseConfig decodes a config.yaml body, fills in the defaults of every
+// section (probe timeouts and limits, fetch.max_redirects, split
+// separators, ...) and validates it. Its result is what
+// RefineOptions.Config expects.
+func ParseConfig(b []byte) (*Config, error) {
+	return parseConfig(b, b)
+}
+
+// parseConfig parses b, the config with secrets substituted; decoding
+// errors point into orig, the config as written.
+func parseConfig(b, orig []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, describeYAMLError(err, b, orig)
+	}
+	cfg.Lite.Strategy = strings.ToLower(strings.TrimSpace(cfg.Lite.Strategy))
+	if err := cfg.Lite.check(); err != nil {
+		return nil, err
+	}
+	if cfg.Lite.PerHostLimit > 0 && cfg.Lite.Strategy != "per_host" {
+		return nil, fmt.Errorf("lite.per_host_limit needs strategy: per_host")
+	}
+	cfg.Normal.Strategy = strings.ToLower(strings.TrimSpace(cfg.Normal.Strategy))
+	if err := cfg.Normal.check(); err != nil {
+		return nil, err
+	}
+	if cfg.Normal.PerHostLimit > 0 && cfg.Normal.Strategy != "per_host" {
+		return nil, fmt.Errorf("normal.per_host_limit needs strategy: per_host")
+	}
+	if cfg.Probe.Timeout <= 0 {
+		cfg.Probe.Timeout = 2 * time.Second
+	}
+	if cfg.Probe.Concurrency <= 0 {
+		cfg.Probe.Concurrency = 50
+	}
+	if cfg.Probe.MaxNodes <= 0 {
+		cfg.Probe.MaxNodes = 1000
+	}
+	if cfg.Probe.Samples > 20 {
+		return nil, fmt.Errorf("probe.samples must be at most 20, got %d", cfg.Probe.Samples)
+	}
+	if err := cfg.Probe.Adaptive.check(); err != nil {
+		return nil, err
+	}
+	if cfg.Probe.MaxOpenSockets < 0 {
+		return nil, fmt.Errorf("probe.max_open_sockets must not be negative, got %d", cfg.Probe.MaxOpenSockets)
+	}
+	if d := cfg.Probe.DNS; d.TTL < 0 || d.NegativeTTL < 0 || d.Concurrency < 0 {
+		return nil, fmt.Errorf("probe.dns: ttl, negative_ttl and concurrency must not be negative")
+	}
+	if cfg.Probe.MaxOpenSockets == 1 && cfg.Probe.Samples > 1 {
+		return nil, fmt.Errorf("probe.max_open_sockets must be at least 2 with probe.samples")
+	}
+	if cfg.Probe.FullEvery < 0 {
+		return nil, fmt.Errorf("probe.full_every must not be negative, got %d", cfg.Probe.FullEvery)
+	}
+	cfg.Probe.Family = strings.ToLower(strings.TrimSpace(cfg.Probe.Family))
+	switch cfg.Probe.Family {
+	case "":
+		cfg.Probe.Family = "any"
+	case "any", "ipv4", "ipv6":
+	default:
+		return nil, fmt.Errorf("probe.family must be ipv4, ipv6 or any, got %q", cfg.Probe.Family)
+	}
+	if cfg.State.History <= 0 {
+		cfg.State.History = 10
+	}
+	if cfg.Quarantine.ReinstateAfter <= 0 {
+		cfg.Quarantine.ReinstateAfter = 3
+	}
+	if cfg.Fetch.MaxRedirects == nil {
+		n := defaultMaxRedirects
+		cfg.Fetch.MaxRedirects = &n
+	} else if *cfg.Fetch.MaxRedirects < 0 {
+		return nil, fmt.Errorf("fetch.max_redirects must not be negative")
+	}
+	if cfg.Fetch.MaxRetryAfter <= 0 {
+		cfg.Fetch.MaxRetryAfter = 30 * time.Second
+	}
+	if cfg.Sources.DegradeAfter > 0 && cfg.Sources.Recheck <= 0 {
+		cfg.Sources.Recheck = 6 * time.Hour
+	}
+	if cfg.Serve.Listen == "" {
+		cfg.Serve.Listen = ":8080"
+	}
+	if rl := cfg.Serve.RateLimit; rl.Requests > 0 && rl.Per <= 0 {
+		cfg.Serve.RateLimit.Per = time.Minute
+	}
+	switch cfg.Serve.TrustProxy {
+	case "", "cloudflare":
+	case "forwarded":
+		if len(cfg.Serve.TrustedProxies) == 0 {
+			return nil, fmt.Errorf("serve.trust_proxy forwarded requires serve.trusted_proxies")
+		}
+	default:
+		return nil, fmt.Errorf("serve.trust_proxy must be cloudflare or forwarded, got %q", cfg.Serve.TrustProxy)
+	}
+	for _, p := range cfg.Serve.TrustedProxies {
+		if _, err := parsePrefixOrAddr(p); err != nil {
+			return nil, fmt.Errorf("serve.trusted_proxies: %w", err)
+		}
+	}
+	if tc := cfg.Serve.TLS; (tc.Cert == "") != (tc.Key == "") {
+		return nil, fmt.Errorf("serve.tls: cert and key must be set together")
+	} else if tc.Cert != "" && len(tc.Domains) > 0 {
+		return nil, fmt.Errorf("serve.tls: use either cert/key or domains, not both")
+	}
+	if cfg.Serve.TLS.CacheDir == "" {
+		cfg.Serve.TLS.CacheDir = "autocert"
+	}
+	if cfg.State.RenameGrace <= 0 {
+		cfg.State.RenameGrace = 30 * 24 * time.Hour
+	}
+	if cfg.Quarantine.FlapThreshold > 0 && cfg.State.Path == "" {
+		return nil, fmt.Errorf("quarantine requires state.path to be set")
+	}
+	if cfg.GraceRuns > 0 {
+		if cfg.State.Path == "" {
+			return nil, fmt.Errorf("grace_runs requires state.path to be set")
+		}
+		if cfg.GraceRuns >= cfg.State.History {
+			return nil, fmt.Errorf("grace_runs (%d) must be smaller than state.history (%d)", cfg.GraceRuns, cfg.State.History)
+		}
+	}
+	for _, st := range append(cfg.Probe.Strategies, cfg.Probe.Default) {
+		m := strings.ToLower(strings.TrimSpace(st.Method))
+		if m != "" && !probeMethods[m] {
+			return nil, fmt.Errorf("probe strategy %q: unknown method %q", st.Match, st.Method)
+		}
+	}
+	if len(cfg.Outputs) == 0 {
+		cfg.Outputs = append([]OutputCfg(nil), defaultOutputs...)
+	}
+	cfg.Outputs = append(cfg.Outputs, cfg.TransportOutputs.outputs()...)
+	seenOutputs := map[string]bool{}
+	for i := range cfg.Outputs {
+		o := &cfg.Outputs[i]
+		o.Name = strings.TrimSpace(o.Name)
+		o.Format = strings.ToLower(strings.TrimSpace(o.Format))
+		if o.Name == "" {
+			return nil, fmt.Errorf("outputs[%d]: name is required", i)
+		}
+		if err := checkPathComponent(sanitizeFileName(o.Name)); err != nil {
+			return nil, fmt.Errorf("outputs %q: %w", o.Name, err)
+		}
+		if seenOutputs[o.Name] {
+			return nil, fmt.Errorf("outputs: duplicate name %q", o.Name)
+		}
+		seenOutputs[o.Name] = true
+		switch o.Format {
+		case "":
+			o.Format = "base64"
+		case "base64", "plain":
+		case "xray":
+			if o.Extension == nil {
+				ext := "json"
+				o.Extension = &ext
+			}
+		case "clash", "clash-provider":
+			if o.Extension == nil {
+				ext := "yaml"
+				o.Extension = &ext
+			}
+		default:
+			return nil, fmt.Errorf("outputs %q: format must be base64, plain, xray, clash or clash-provider, got %q", o.Name, o.Format)
+		}
+		o.SortBy = strings.ToLower(strings.TrimSpace(o.SortBy))
+		switch o.SortBy {
+		case "", "latency", "throughput":
+		default:
+			return nil, fmt.Errorf("outputs %q: sort_by must be latency or throughput, got %q", o.Name, o.SortBy)
+		}
+		if o.SortBy != "" && o.Sort {
+			return nil, fmt.Errorf("outputs %q: sort and sort_by are mutually exclusive", o.Name)
+		}
+		for j, p := range o.PreferProtocols {
+			o.PreferProtocols[j] = strings.ToLower(strings.TrimSpace(p))
+		}
+		set := 0
+		for _, b := range []bool{o.Tail != 0, o.Lite, o.Normal} {
+			if b {
+				set++
+			}
+		}
+		if set > 1 {
+			return nil, fmt.Errorf("outputs %q: tail, lite and normal are mutually exclusive", o.Name)
+		}
+		if (o.SortBy == "throughput" || o.Filter.MinMbps > 0) && !cfg.Throughput.Enabled {
+			return nil, fmt.Errorf("outputs %q: throughput sorting and min_mbps require throughput.enabled", o.Name)
+		}
+		if v := o.Filter.IPVersion; v != 0 && v != 4 && v != 6 {
+			return nil, fmt.Errorf("outputs %q: ip_version must be 4 or 6, got %d", o.Name, v)
+		}
+	}
+	for _, ph := range []string{"{key}", "{output}"} {
+		if cfg.Export.Path != "" && !strings.Contains(cfg.Export.Path, ph) {
+			return nil, fmt.Errorf("export.path %q must contain %s", cfg.Export.Path, ph)
+		}
+	}
+	if p := cfg.Export.LocationPath; p != "" {
+		if !strings.Contains(p, "{output}") || !strings.Contains(p, "{key}") && !strings.Contains(p, "{country}") {
+			return nil, fmt.Errorf("export.location_path %q must contain {output} and {key} or {country}", p)
+		}
+	}
+	if err := cfg.Profile.check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Xray.check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Clash.check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Email.check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.RunAs.check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Disk.check(); err != nil {
+		return nil, err
+	}
+	cfg.Throughput.tempDir = cfg.Disk.TempDir
+	if err := cfg.SharedIPs.check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.ASN.check(); err != nil {
+		return nil, err
+	}
+	if cfg.ASN.WarnShare == 0 {
+		cfg.ASN.WarnShare = 0.8
+	}
+	if cfg.ASN.MinNodes == 0 {
+		cfg.ASN.MinNodes = 5
+	}
+	if cfg.ASN.Refresh == 0 {
+		cfg.ASN.Refresh = 24 * time.Hour
+	}
+	if cfg.SharedIPs.ExemptASNs == nil {
+		cfg.SharedIPs.ExemptASNs = cdnASNs
+	}
+	if cfg.SharedIPs.MinHosts == 0 {
+		cfg.SharedIPs.MinHosts = 3
+	}
+	if cfg.SharedIPs.PrefixV4 == 0 {
+		cfg.SharedIPs.PrefixV4 = 32
+	}
+	if cfg.SharedIPs.PrefixV6 == 0 {
+		cfg.SharedIPs.PrefixV6 = 128
+	}
+	if err := applyLocationDefaults(cfg.Locations, cfg.LocDefaults); err != nil {
+		return nil, err
+	}
+	subs, err := expandSources(cfg.Subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	locs, err := expandSources(cfg.Locations)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Subscriptions, cfg.Locations = subs, locs
+	for _, l := range cfg.Locations {
+		if l.Country == "" && strings.Contains(cfg.Export.LocationPath, "{country}") {
+			return nil, fmt.Errorf("location %s: export.location_path uses {country}, set country", l.Key)
+		}
+	}
+	for _, sub := range append(cfg.Subscriptions, cfg.Locations...) {
+		if err := checkKey(sub.Key); err != nil {
+			return nil, err
+		}
+	}
+	warnings, err := checkDuplicateKeys(append(cfg.Subscriptions, cfg.Locations...))
+	if err != nil {
+		return nil, err
+	}
+	cfg.warnings = append(cfg.warnings, warnings...)
+	if err := checkMerges(append(cfg.Subscriptions, cfg.Locations...)); err != nil {
+		return nil, err
+	}
+	for _, subs := range [][]Subscription{cfg.Subscriptions, cfg.Locations} {
+		for i := range subs {
+			r, err := parseRatio(subs[i].ProtocolRatio)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+			}
+			subs[i].ratio = r
+			if err := subs[i].Profile.check(); err != nil {
+				return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+			}
+			if err := subs[i].Xray.check(); err != nil {
+				return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+			}
+			if err := subs[i].Clash.check(); err != nil {
+				return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+			}
+			subs[i].Lite.Strategy = strings.ToLower(strings.TrimSpace(subs[i].Lite.Strategy))
+			if err := cfg.Lite.merge(subs[i].Lite).check(); err != nil {
+				return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+			}
+			subs[i].Normal.Strategy = strings.ToLower(strings.TrimSpace(subs[i].Normal.Strategy))
+			if err := subs[i].Normal.check(); err != nil {
+				return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+			}
+			if err := subs[i].ExpandPorts.compile(); err != nil {
+				return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+			}
+			if subs[i].CleanIPs.PerNode < 0 {
+				return nil, fmt.Errorf("%s: clean_ips.per_node must not be negative", subs[i].Key)
+			}
+			if subs[i].CleanIPs.PerNode == 0 {
+				subs[i].CleanIPs.PerNode = 3
+			}
+			if subs[i].AllowedSchemes != nil {
+				if subs[i].allowed, err = parseSchemes(subs[i].AllowedSchemes); err != nil {
+					return nil, fmt.Errorf("%s: %w", subs[i].Key, err)
+				}
+				if len(subs[i].allowed) == 0 {
+					return nil, fmt.Errorf("%s: allowed_schemes is empty", subs[i].Key)
+				}
+			}
+			if len(subs[i].PreviousKeys) > 0 && cfg.State.Path == "" {
+				return nil, fmt.Errorf("%s: previous_keys requires state.path", subs[i].Key)
+			}
+			for _, old := range subs[i].PreviousKeys {
+				if err := checkKey(old); err != nil {
+					return nil, fmt.Errorf("%s: previous_keys: %w", subs[i].Key, err)
+				}
+				for _, other := range append(cfg.Subscriptions, cfg.Locations...) {
+					if other.Key == old {
+						return nil, fmt.Errorf("%s: previous key %q is still configured", subs[i].Key, old)
+					}
+				}
+			}
+			if subs[i].FreshnessHalfLife > 0 && cfg.State.Path == "" {
+				return nil, fmt.Errorf("%s: freshness_half_life requires state.path", subs[i].Key)
+			}
+		}
+	}
+	if cfg.Snapshots.Enabled {
+		for _, sub := range append(cfg.Subscriptions, cfg.Locations...) {
+			if sub.Key == snapshotsDir || strings.HasPrefix(sub.Key, snapshotsDir+"/") {
+				return nil, fmt.Errorf("key %q collides with the snapshots directory", sub.Key)
+			}
+		}
+		if cfg.Deterministic {
+			cfg.warnings = append(cfg.warnings, "snapshots add a directory to the export tree on every run, even with deterministic")
+		}
+	}
+	cfg.Export.Staging = strings.ToLower(strings.TrimSpace(cfg.Export.Staging))
+	switch cfg.Export.Staging {
+	case "", "rename", "symlink":
+	default:
+		return nil, fmt.Errorf("export.staging must be rename or symlink, got %q", cfg.Export.Staging)
+	}
+	cfg.Convert.SSFormat = strings.ToLower(strings.TrimSpace(cfg.Convert.SSFormat))
+	switch cfg.Convert.SSFormat {
+	case "", "sip002", "legacy":
+	default:
+		return nil, fmt.Errorf("convert.ss_format must be sip002 or legacy, got %q", cfg.Convert.SSFormat)
+	}
+	if cfg.Throughput.XrayPath == "" {
+		cfg.Throughput.XrayPath = "xray"
+	}
+	if cfg.Throughput.URL == "" {
+		cfg.Throughput.URL = "https://speed.cloudflare.com/__down?bytes=10000000"
+	}
+	if cfg.Throughput.MaxBytes <= 0 {
+		cfg.Throughput.MaxBytes = 10 << 20
+	}
+	if cfg.Throughput.Duration <= 0 {
+		cfg.Throughput.Duration = 10 * time.Second
+	}
+	if cfg.Throughput.Concurrency <= 0 {
+		cfg.Throughput.Concurrency = 4
+	}
+	if cfg.Throughput.MaxNodes <= 0 {
+		cfg.Throughput.MaxNodes = 50
+	}
+	cfg.Fix.SNIHost = strings.ToLower(strings.TrimSpace(cfg.Fix.SNIHost))
+	switch cfg.Fix.SNIHost {
+	case "", "fix", "drop":
+	default:
+		return nil, fmt.Errorf("fix.sni_host must be fix or drop, got %q", cfg.Fix.SNIHost)
+	}
+	if cfg.Fix.AutoTLS {
+		cfg.Fix.PortRules = append(cfg.Fix.PortRules, autoTLSRules...)
+	}
+	for i, pr := range cfg.Fix.PortRules {
+		if len(pr.Ports) == 0 || len(pr.Set) == 0 {
+			return nil, fmt.Errorf("fix.port_rules[%d]: ports and set are required", i)
+		}
+	}
+	for scheme := range cfg.Normalize {
+		if scheme == "vmess" {
+			return nil, fmt.Errorf("normalize: vmess links carry their settings in JSON, not a query")
+		}
+		if scheme != strings.ToLower(scheme) {
+			return nil, fmt.Errorf("normalize: scheme %q must be lower case", scheme)
+		}
+	}
+	if err := cfg.Remarks.compile(); err != nil {
+		return nil, err
+	}
+	aliases, err := parseAliases(cfg.SchemeAliases)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SchemeAliases = aliases
+	if cfg.Split.Separators == nil {
+		cfg.Split.Separators = append([]string(nil), defaultSeparators...)
+	}
+	for i, sep := range cfg.Split.Separators {
+		if strings.TrimSpace(sep) == "" && sep != " " && sep != "\t" {
+			return nil, fmt.Errorf("split.separators[%d]: empty separator", i)
+		}
+		cfg.Split.Separators[i] = reHTMLBreak.ReplaceAllString(sep, "<br>")
+	}
+	if err := cfg.Metadata.compile(); err != nil {
+		return nil, fmt.Errorf("metadata.patterns: %w", err)
+	}
+	cfg.Metadata.Emit = strings.ToLower(strings.TrimSpace(cfg.Metadata.Emit))
+	switch cfg.Metadata.Emit {
+	case "":
+		cfg.Metadata.Emit = "header"
+	case "header", "manifest", "both":
+	default:
+		return nil, fmt.Errorf("metadata.emit must be header, manifest or both, got %q", cfg.Metadata.Emit)
+	}
+	cfg.Agents.Require = strings.ToLower(strings.TrimSpace(cfg.Agents.Require))
+	switch cfg.Agents.Require {
+	case "":
+		cfg.Agents.Require = "all"
+	case "all", "any":
+	default:
+		return nil, fmt.Errorf("agents.require must be all or any, got %q", cfg.Agents.Require)
+	}
+	cfg.Agents.LocalName = strings.TrimSpace(cfg.Agents.LocalName)
+	if cfg.Agents.LocalName == "" {
+		cfg.Agents.LocalName = "local"
+	}
+	seenAgents := map[string]bool{cfg.Agents.LocalName: true}
+	for i, a := range cfg.Agents.Endpoints {
+		if a.Name == "" || a.URL == "" || a.Token == "" {
+			return nil, fmt.Errorf("agents.endpoints[%d]: name, url and token are required", i)
+		}
+		if seenAgents[a.Name] {
+			return nil, fmt.Errorf("agents.endpoints: duplicate or reserved name %q", a.Name)
+		}
+		seenAgents[a.Name] = true
+	}
+	if cfg.Agents.SkipLocal && len(cfg.Agents.Endpoints) == 0 {
+		return nil, fmt.Errorf("agents.skip_local requires at least one agent endpoint")
+	}
+	for _, o := range cfg.Outputs {
+		// Only agents tag nodes with vantage points; without them the
+		// filter would leave the output empty.
+		if len(o.Filter.Vantage) > 0 && len(cfg.Agents.Endpoints) == 0 {
+			return nil, fmt.Errorf("outputs %q: filter.vantage requires agents.endpoints", o.Name)
+		}
+		for _, v := range o.Filter.Vantage {
+			if !seenAgents[v] || (v == cfg.Agents.LocalName && cfg.Agents.SkipLocal) {
+				return nil, fmt.Errorf("outputs %q: unknown vantage point %q", o.Name, v)
+			}
+		}
+	}
+	if cfg.Probe.SourceAddr != "" && cfg.Probe.Interface != "" {
+		return nil, fmt.Errorf("probe.source_addr and probe.interface are mutually exclusive")
+	}
+	return &cfg, nil
+}
+
+func tryDecodeIfBase64(b []byte) []byte {
+	trim := bytes.TrimSpace(b)
+	if len(trim) == 0 {
+		return trim
+	}
+	if !rePossibleB64.Match(trim) {
+		if dec := decodeBlocks(b); dec != nil {
+			return dec
+		}
+		return b
+	}
+	// Separate chunks are decoded one by one, even where the joined blob
+	// would happen to decode too.
+	if dec, ok := decodeSegments(trim); ok && hasKnownScheme(dec) {
+		return dec
+	}
+	dec, err := base64.StdEncoding.DecodeString(string(trim))
+	if err != nil {
+		dec2, err2 := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(trim), "\n", ""))
+		if err2 != nil {
+			return b
+		}
+		dec = dec2
+	}
+	if hasKnownScheme(dec) {
+		return dec
+	}
+	return b
+}
+
+func parseAndFilterLines(b []byte, allowed map[string]struct{}, aliases map[string]string, split SplitCfg, rej *rejects) []string {
+	var out []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	buf := make([]byte, 0, 1024*1024)
+	sc.Buffer(buf, 10*1024*1024)
+
+	for sc.Scan() {
+		line := strings.TrimSpace(scrubText(sc.Text()))
+		if line == "" || reCommentLine.MatchString(line) {
+			continue
+		}
+		items := splitPossible(line, split.Separators, allowed, aliases)
+		for _, it := range items {
+			it = strings.TrimSpace(it)
+			if it == "" || reCommentLine.MatchString(it) {
+				continue
+			}
+			it = aliasScheme(normalizeScheme(it), aliases)
+			if !schemeAllowed(allowed, it) {
+				if strings.Contains(it, "://") {
+					rej.add(it, "scheme", "scheme not in allowed_schemes")
+				} else {
+					rej.add(it, "scheme", "not a link")
+				}
+				continue
+			}
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+func normalizeScheme(s string) string {
+	idx := strings.Index(s, "://")
+	if idx < 0 {
+		return s
+	}
+	return strings.ToLower(s[:idx]) + s[idx:]
+}
+
+func dedupe(in []string) []string {
+	seen := map[string]struct{}{}
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		k := strings.TrimSpace(s)
+		if k == "" {
+			continue
+		}
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		out = append(out, k)
+	}
+	return out
+}
+
+func buildLiteTail(normal []string, n int) []string {
+	if n <= 0 {
+		n = 100
+	}
+	if n > len(normal) {
+		n = len(normal)
+	}
+	start := len(normal) - n
+	return append([]string(nil), normal[start:]...)
+}
+
+func hostKey(line string) string {
+	u, err := url.Parse(line)
+	if err == nil && u.Host != "" {
+		return strings.ToLower(u.Host)
+	}
+	if at := strings.Index(line, "@"); at >= 0 {
+		rest := line[at+1:]
+		stop := len(rest)
+		if i := strings.IndexAny(rest, "?#"); i >= 0 {
+			stop = i
+		}
+		hostport := rest[:stop]
+		return strings.ToLower(hostport)
+	}
+	return strings.ToLower(line)
+}
+
+func writeBase64Sorted(path string, lines []string) error {
+	cp := append([]string(nil), lines...)
+	sort.Strings(cp)
+	return writeBase64Atomic(path, cp)
+}
+
+func writeBase64NoSort(path string, lines []string) error {
+	return writeBase64Atomic(path, lines)
+}
+
+func writePlain(path string, lines []string, sorted bool) error {
+	cp := append([]string(nil), lines...)
+	if sorted {
+		sort.Strings(cp)
+	}
+	return writeFileAtomic(path, []byte(strings.Join(cp, "\n")))
+}
+
+func writeBase64Atomic(path string, lines []string) error {
+	payload := strings.Join(lines, "\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(payload))
+	return writeFileAtomic(path, []byte(encoded))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	// An unchanged file is left alone, so its mtime stays and mirrors and
+	// sync jobs see nothing to do.
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	tmpFile, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	w := bufio.NewWriter(tmpFile)
+	if _, err := w.Write(data); err != nil {
+		tmpFile.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmpFile.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	const maxRetries = 6
+	for i := 0; i < maxRetries; i++ {
+		_ = os.Remove(path)
+		if err := os.Rename(tmpPath, path); err != nil {
+			if isRetryableRenameErr(err) && i < maxRetries-1 {
+				time.Sleep(time.Duration(200*(i+1)) * time.Millisecond)
+				continue
+			}
+			_ = os.Remove(tmpPath)
+			return fmt.Errorf("rename failed (%d tries): %w", i+1, err)
+		}
+		return nil
+	}
+	_ = os.Remove(tmpPath)
+	return fmt.Errorf("rename failed after retries")
+}
+
+func sanitizeFileName(name string) string {
+	name = strings.TrimSpace(name)
+	name = strings.ReplaceAll(name, "/", "_")
+	name = reInvalidFileChars.ReplaceAllString(name, "_")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		name = "default"
+	}
+	if isReservedWindowsName(name) {
+		name = "_" + name
+	}
+	if len(name) > maxNameLen {
+		name = strings.TrimRight(truncateUTF8(name, maxNameLen), ". ")
+	}
+	return name
+}
@@ -0,0 +1,76 @@
+package refiner
+
+import "fmt"
+
+// refinedKey is what a processed key leaves behind for merge keys.
+type refinedKey struct {
+	reachable []string
+	results   []probeResult
+	meta      []string
+	// valid counts the nodes that passed validation.
+	valid int
+}
+
+// mergeKeys combines the refined nodes of members, first occurrence winning,
+// or interleaved by weightedOrder when weights are given. Members that
+// produced nothing this run (fetch errors) are skipped.
+func mergeKeys(members []string, weights []int, done map[string]refinedKey) refinedKey {
+	var m refinedKey
+	seen, seenRes, seenMeta := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, k := range members {
+		src := done[k]
+		for _, l := range src.reachable {
+			if !seen[l] {
+				seen[l] = true
+				m.reachable = append(m.reachable, l)
+			}
+		}
+		for _, r := range src.results {
+			if !seenRes[r.line] {
+				seenRes[r.line] = true
+				m.results = append(m.results, r)
+			}
+		}
+		for _, h := range src.meta {
+			if !seenMeta[h] {
+				seenMeta[h] = true
+				m.meta = append(m.meta, h)
+			}
+		}
+	}
+	if weights != nil {
+		lists := make([][]string, len(members))
+		for i, k := range members {
+			lists[i] = done[k].reachable
+		}
+		m.reachable = weightedOrder(lists, weights)
+	}
+	m.valid = len(m.reachable)
+	return m
+}
+
+// checkMerges requires merge members to be plain keys or merge keys
+// defined earlier, and merge keys to have no URL of their own.
+func checkMerges(subs []Subscription) error {
+	defined := map[string]bool{}
+	for _, sub := range subs {
+		if len(sub.Merge) == 0 {
+			defined[sub.Key] = true
+		}
+	}
+	for _, sub := range subs {
+		if len(sub.Merge) == 0 {
+			continue
+		}
+		if sub.URL != "" {
+			return fmt.Errorf("%s: merge keys take no url", sub.Key)
+		}
+		for _, k := range sub.Merge {
+			if !defined[k] {
+				return fmt.Errorf("%s: merge member %q must be a key, or a merge key defined before it", sub.Key, k)
+			}
+		}
+		defined[sub.Key] = true
+	}
+	return nil
+}
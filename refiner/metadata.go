@@ -0,0 +1,91 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MetadataCfg captures subscription comments matching any of Patterns
+// (regular expressions, matched against the whole comment line) and emits
+// them as a header in front of every output ("header"), into the key's
+// manifest.json ("manifest"), or both.
+type MetadataCfg struct {
+	Patterns []string `yaml:"patterns"`
+	Emit     string   `yaml:"emit"`
+
+	res []*regexp.Regexp
+}
+
+func (m *MetadataCfg) compile() error {
+	for _, p := range m.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		m.res = append(m.res, re)
+	}
+	return nil
+}
+
+func (m MetadataCfg) header() bool   { return len(m.res) > 0 && m.Emit != "manifest" }
+func (m MetadataCfg) manifest() bool { return len(m.res) > 0 && m.Emit != "header" }
+
+// captureMetadata returns the distinct comment lines of b that match a
+// configured pattern, in order of appearance.
+func captureMetadata(b []byte, m MetadataCfg) []string {
+	if len(m.res) == 0 {
+		return nil
+	}
+	var out []string
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if !reCommentLine.MatchString(line) || seen[line] {
+			continue
+		}
+		for _, re := range m.res {
+			if re.MatchString(line) {
+				seen[line] = true
+				out = append(out, line)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// withHeader puts the captured comment lines in front of an encoded output.
+func withHeader(header []string, body []byte) []byte {
+	var buf bytes.Buffer
+	for _, h := range header {
+		buf.WriteString(h)
+		buf.WriteByte('\n')
+	}
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+type keyManifest struct {
+	Key         string    `json:"key"`
+	Source      string    `json:"source"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Metadata    []string  `json:"metadata"`
+}
+
+func writeManifest(keyDir string, mf keyManifest) error {
+	if mf.Metadata == nil {
+		mf.Metadata = []string{}
+	}
+	b, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(keyDir, "manifest.json"), b)
+}
@@ -0,0 +1,161 @@
+package refiner
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// node is the decoded form of a subscription link: where it connects to and
+// the transport settings needed to probe it.
+type node struct {
+	Scheme     string
+	Host       string
+	Port       int
+	User       string // vless/vmess id, trojan password, ss userinfo
+	Transport  string // tcp, ws, grpc, ...
+	Security   string // none, tls, reality
+	SNI        string
+	HostHeader string
+	Path       string
+	// ServiceName is the gRPC service; vmess links carry it in "path".
+	ServiceName string
+	Remark      string
+
+	// Query holds the raw parameters of URL-style links; Vmess the decoded
+	// JSON payload of vmess links.
+	Query url.Values
+	Vmess map[string]any
+}
+
+// udpSchemes are QUIC-based protocols; TCP dials tell nothing about them.
+var udpSchemes = map[string]bool{"tuic": true, "hysteria2": true, "hy2": true, "hysteria": true}
+
+func parseNode(line string) (*node, error) {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "vless://"),
+		strings.HasPrefix(line, "trojan://"),
+		strings.HasPrefix(line, "ss://"),
+		strings.HasPrefix(line, "tuic://"),
+		strings.HasPrefix(line, "hysteria2://"),
+		strings.HasPrefix(line, "hy2://"),
+		strings.HasPrefix(line, "hysteria://"):
+		return parseURLNode(line)
+	case strings.HasPrefix(line, "vmess://"):
+		return parseVmessNode(line)
+	}
+	return nil, fmt.Errorf("unsupported scheme")
+}
+
+func parseURLNode(line string) (*node, error) {
+	u, err := url.Parse(expandLegacySS(line))
+	if err != nil {
+		return nil, err
+	}
+	h := u.Hostname()
+	pStr := u.Port()
+	if h == "" || pStr == "" {
+		return nil, fmt.Errorf("missing host or port")
+	}
+	p, err := strconv.Atoi(pStr)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	n := &node{
+		Scheme:      strings.ToLower(u.Scheme),
+		Host:        h,
+		Port:        p,
+		Transport:   strings.ToLower(q.Get("type")),
+		Security:    strings.ToLower(q.Get("security")),
+		SNI:         q.Get("sni"),
+		HostHeader:  q.Get("host"),
+		Path:        q.Get("path"),
+		ServiceName: q.Get("serviceName"),
+		Remark:      u.Fragment,
+		Query:       q,
+	}
+	if u.User != nil {
+		n.User = u.User.Username()
+	}
+	if n.Transport == "" {
+		n.Transport = "tcp"
+	}
+	if udpSchemes[n.Scheme] {
+		n.Transport = "quic"
+	}
+	if n.Security == "" {
+		n.Security = "none"
+		if n.Scheme == "trojan" || udpSchemes[n.Scheme] {
+			n.Security = "tls"
+		}
+	}
+	return n, nil
+}
+
+func parseVmessNode(line string) (*node, error) {
+	m, err := decodeVmessPayload(line)
+	if err != nil {
+		return nil, err
+	}
+
+	h := jsonString(m, "add")
+	if h == "" {
+		return nil, errors.New("vmess missing add")
+	}
+	p, err := extractPortFromJSON(m["port"])
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{
+		Scheme:     "vmess",
+		Host:       h,
+		Port:       p,
+		User:       jsonString(m, "id"),
+		Transport:  strings.ToLower(jsonString(m, "net")),
+		Security:   strings.ToLower(jsonString(m, "tls")),
+		SNI:        jsonString(m, "sni"),
+		HostHeader: jsonString(m, "host"),
+		Path:       jsonString(m, "path"),
+		Remark:     jsonString(m, "ps"),
+		Vmess:      m,
+	}
+	if n.Transport == "" {
+		n.Transport = "tcp"
+	}
+	if n.Transport == "grpc" {
+		n.ServiceName = n.Path
+	}
+	if n.Security == "" {
+		n.Security = "none"
+	}
+	return n, nil
+}
+
+func jsonString(m map[string]any, key string) string {
+	s, _ := m[key].(string)
+	return strings.TrimSpace(s)
+}
+
+// tlsServerName is the SNI a client would send for this node.
+func (n *node) tlsServerName() string {
+	if n.SNI != "" {
+		return n.SNI
+	}
+	if h := n.firstHostHeader(); h != "" {
+		return h
+	}
+	return n.Host
+}
+
+// firstHostHeader returns the first entry of a comma-separated host list,
+// which is what xray sends as the HTTP Host header.
+func (n *node) firstHostHeader() string {
+	h, _, _ := strings.Cut(n.HostHeader, ",")
+	return strings.TrimSpace(h)
+}
@@ -0,0 +1,80 @@
+package refiner
+
+import (
+	"net/url"
+	"strings"
+)
+
+// NormalizeRule rewrites the query of one scheme's links: Defaults fill in
+// parameters that are missing or empty, and StripUnknown drops parameters
+// that are neither in knownParams for the scheme nor listed in Known.
+type NormalizeRule struct {
+	Defaults     map[string]string `yaml:"defaults"`
+	StripUnknown bool              `yaml:"strip_unknown"`
+	Known        []string          `yaml:"known"`
+}
+
+// NormalizeCfg maps a scheme to its normalization rule.
+type NormalizeCfg map[string]NormalizeRule
+
+// knownParams are the share-link parameters xray-based clients understand,
+// per scheme.
+var knownParams = map[string][]string{
+	"vless": {"type", "security", "encryption", "flow", "sni", "fp", "alpn", "pbk", "sid", "spx",
+		"host", "path", "serviceName", "mode", "authority", "headerType", "seed", "quicSecurity", "key",
+		"allowInsecure", "extra"},
+	"trojan": {"type", "security", "flow", "sni", "fp", "alpn", "pbk", "sid", "spx",
+		"host", "path", "serviceName", "mode", "authority", "headerType", "seed", "quicSecurity", "key",
+		"allowInsecure", "peer"},
+	"ss":        {"plugin", "type", "security", "host", "path"},
+	"tuic":      {"sni", "alpn", "congestion_control", "udp_relay_mode", "allow_insecure", "insecure", "disable_sni"},
+	"hysteria2": {"sni", "insecure", "obfs", "obfs-password", "pinSHA256", "alpn", "up", "down"},
+	"hy2":       {"sni", "insecure", "obfs", "obfs-password", "pinSHA256", "alpn", "up", "down"},
+	"hysteria":  {"peer", "sni", "insecure", "auth", "auth_str", "protocol", "obfs", "obfsParam", "alpn", "upmbps", "downmbps"},
+}
+
+// normalizeLines applies the rule for each line's scheme. Links that fail
+// to parse, and vmess links (whose settings live in JSON), are unchanged.
+func normalizeLines(lines []string, rules NormalizeCfg) []string {
+	if len(rules) == 0 {
+		return lines
+	}
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		scheme, _, _ := strings.Cut(l, "://")
+		if rule, ok := rules[scheme]; ok && scheme != "vmess" {
+			l = normalizeLink(l, scheme, rule)
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func normalizeLink(line, scheme string, rule NormalizeRule) string {
+	u, err := url.Parse(expandLegacySS(line))
+	if err != nil {
+		return line
+	}
+	q := u.Query()
+	if rule.StripUnknown {
+		keep := map[string]bool{}
+		for _, k := range knownParams[scheme] {
+			keep[k] = true
+		}
+		for _, k := range rule.Known {
+			keep[k] = true
+		}
+		for k := range q {
+			if !keep[k] {
+				q.Del(k)
+			}
+		}
+	}
+	for k, v := range rule.Defaults {
+		if q.Get(k) == "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,103 @@
+package refiner
+
+import "time"
+
+// Observer is told about every stage of a run, e.g. to feed custom
+// metrics or alerting. The CLI's dashboard status is one; library users
+// pass theirs in RefineOptions. Calls come from the run's goroutine, one at
+// a time. Embed NopObserver to implement only some of the methods.
+type Observer interface {
+	OnFetch(FetchEvent)
+	OnNodeRejected(RejectEvent)
+	OnNodeProbed(ProbeEvent)
+	OnExport(ExportEvent)
+}
+
+// FetchEvent reports a source fetch; Err is set when it failed or the
+// source was skipped as degraded.
+type FetchEvent struct {
+	Key      string
+	URL      string
+	Bytes    int
+	Duration time.Duration
+	Err      error
+}
+
+// RejectEvent reports a line dropped at Stage, as listed in rejects.json.
+type RejectEvent struct {
+	Key    string
+	Link   string
+	Stage  string
+	Reason string
+}
+
+// ProbeEvent reports the verdict on one probed node, after grace runs and
+// quarantine.
+type ProbeEvent struct {
+	Key       string
+	Link      string
+	Reachable bool
+	Latency   time.Duration
+	Err       error
+}
+
+// ExportEvent reports the nodes a key exports. Valid counts the nodes that
+// passed validation, before probing.
+type ExportEvent struct {
+	Key   string
+	Valid int
+	Nodes []Node
+}
+
+// NopObserver ignores every event.
+type NopObserver struct{}
+
+func (NopObserver) OnFetch(FetchEvent)         {}
+func (NopObserver) OnNodeRejected(RejectEvent) {}
+func (NopObserver) OnNodeProbed(ProbeEvent)    {}
+func (NopObserver) OnExport(ExportEvent)       {}
+
+// observers fans events out to several observers.
+type observers []Observer
+
+func (obs observers) OnFetch(ev FetchEvent) {
+	for _, o := range obs {
+		o.OnFetch(ev)
+	}
+}
+
+func (obs observers) OnNodeRejected(ev RejectEvent) {
+	for _, o := range obs {
+		o.OnNodeRejected(ev)
+	}
+}
+
+func (obs observers) OnNodeProbed(ev ProbeEvent) {
+	for _, o := range obs {
+		o.OnNodeProbed(ev)
+	}
+}
+
+func (obs observers) OnExport(ev ExportEvent) {
+	for _, o := range obs {
+		o.OnExport(ev)
+	}
+}
+
+// publicNodes converts the exported lines of a key, with their latencies.
+func publicNodes(lines []string, results []probeResult) []Node {
+	byLine := resultsByLine(results)
+	out := make([]Node, 0, len(lines))
+	for _, line := range lines {
+		n, err := parseNode(line)
+		if err != nil {
+			continue
+		}
+		pn := publicNode(line, n)
+		if p := byLine[line]; p != nil && !p.unprobed {
+			pn.Latency = p.latency
+		}
+		out = append(out, pn)
+	}
+	return out
+}
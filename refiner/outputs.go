@@ -0,0 +1,354 @@
+package refiner
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type OutputFilter struct {
+	Schemes    []string `yaml:"schemes"`
+	Transports []string `yaml:"transports"`
+	Security   []string `yaml:"security"`
+	IPVersion  int      `yaml:"ip_version"`
+	// Vantage limits the output to nodes every named vantage point (agent
+	// name, or agents.local_name) reached this run.
+	Vantage []string `yaml:"vantage"`
+	// MinMbps keeps nodes whose measured throughput reaches it.
+	MinMbps float64 `yaml:"min_mbps"`
+}
+
+// OutputCfg declares one export file per key: which reachable nodes go in
+// (filter, then optionally only the last Tail of them, or as many as the
+// key's lite or normal settings allow with Lite or Normal), how they are
+// sorted and how the file is encoded. Sort orders lines alphabetically;
+// SortBy ("latency" or "throughput") orders them best first instead.
+type OutputCfg struct {
+	Name      string       `yaml:"name"`
+	Filter    OutputFilter `yaml:"filter"`
+	Format    string       `yaml:"format"`
+	Sort      bool         `yaml:"sort"`
+	SortBy    string       `yaml:"sort_by"`
+	Tail      int          `yaml:"tail"`
+	Lite      bool         `yaml:"lite"`
+	Normal    bool         `yaml:"normal"`
+	Extension *string      `yaml:"extension"`
+
+	// PreferProtocols ranks schemes for truncation: when the output has
+	// to drop lines, those of earlier schemes are kept first.
+	PreferProtocols []string `yaml:"prefer_protocols"`
+}
+
+// ExportCfg controls where outputs land under -out. Path is a template with
+// {key}, {output} and {ext} placeholders; Extension is the default {ext}.
+// LocationPath replaces Path for locations and may also use {country}.
+// Staging ("rename" or "symlink") publishes the whole run at once.
+type ExportCfg struct {
+	Path         string `yaml:"path"`
+	LocationPath string `yaml:"location_path"`
+	Extension    string `yaml:"extension"`
+	Staging      string `yaml:"staging"`
+}
+
+const defaultExportPath = "{key}/{output}{ext}"
+
+// defaultOutputs is the classic quartet written when config.yaml declares
+// no outputs.
+var defaultOutputs = []OutputCfg{
+	{Name: "normal", Sort: true, Normal: true},
+	{Name: "lite", Lite: true},
+	{Name: "ipv4", Filter: OutputFilter{IPVersion: 4}, Sort: true},
+	{Name: "ipv6", Filter: OutputFilter{IPVersion: 6}, Sort: true},
+}
+
+// TransportOutputsCfg adds one output per transport group to the outputs,
+// named after it (ws.txt, grpc.txt, ...), for users on networks where only
+// some transports survive. A group is a transport, or a security layer
+// (reality, tls, none).
+type TransportOutputsCfg struct {
+	Enabled   bool     `yaml:"enabled"`
+	Groups    []string `yaml:"groups"`
+	Format    string   `yaml:"format"`
+	Extension *string  `yaml:"extension"`
+}
+
+var defaultTransportGroups = []string{"ws", "grpc", "tcp", "reality"}
+
+// securityGroups are the groups that select on security, not transport.
+var securityGroups = map[string]bool{"reality": true, "tls": true, "none": true}
+
+// outputs returns the outputs c adds.
+func (c TransportOutputsCfg) outputs() []OutputCfg {
+	if !c.Enabled {
+		return nil
+	}
+	groups := c.Groups
+	if len(groups) == 0 {
+		groups = defaultTransportGroups
+	}
+	ext := ".txt"
+	if c.Extension != nil {
+		ext = *c.Extension
+	}
+	var out []OutputCfg
+	for _, g := range groups {
+		g = strings.ToLower(strings.TrimSpace(g))
+		o := OutputCfg{Name: g, Format: c.Format, Sort: true, Extension: &ext}
+		if securityGroups[g] {
+			o.Filter.Security = []string{g}
+		} else {
+			o.Filter.Transports = []string{g}
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+// selectOutput picks the lines of output o. ratio, when set, shares the
+// Tail slots between schemes; lite sizes Lite outputs and normal caps Normal
+// ones. Results weighted by freshness move fresh nodes ahead in SortBy
+// orders and to the end, where Tail picks from.
+func selectOutput(lines []string, o OutputCfg, results map[string]*probeResult, ratio map[string]float64, lite LiteCfg, normal NormalCfg) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		r := results[l]
+		if r == nil {
+			r = &probeResult{line: l}
+		}
+		if len(o.Filter.Vantage) > 0 && !reachedFrom(r.vantage, o.Filter.Vantage) {
+			continue
+		}
+		if o.Filter.MinMbps > 0 && r.mbps < o.Filter.MinMbps {
+			continue
+		}
+		if o.Filter.matches(l) {
+			out = append(out, l)
+		}
+	}
+	switch o.SortBy {
+	case "latency":
+		sort.SliceStable(out, func(i, j int) bool { return latencyOf(results, out[i]) < latencyOf(results, out[j]) })
+	case "throughput":
+		sort.SliceStable(out, func(i, j int) bool { return mbpsOf(results, out[i]) > mbpsOf(results, out[j]) })
+	}
+	tail := o.Tail
+	if o.Lite {
+		tail = lite.window()
+	}
+	if (tail > 0 || o.Lite) && o.SortBy == "" && weighted(results, out) {
+		sort.SliceStable(out, func(i, j int) bool { return freshnessOf(results, out[i]) < freshnessOf(results, out[j]) })
+	}
+	if tail > 0 && len(ratio) > 0 {
+		out = ratioTail(out, tail, ratio)
+	} else if tail > 0 && len(o.PreferProtocols) > 0 {
+		out = keepPreferred(out, tail, o.PreferProtocols, newer)
+	} else if tail > 0 {
+		out = buildLiteTail(out, tail)
+	}
+	if o.Lite {
+		out = lite.limit(out, o.PreferProtocols)
+	}
+	if o.Normal {
+		out = normal.limit(out, results, o.PreferProtocols)
+	}
+	return out
+}
+
+// latencyOf is the probe latency of line, divided by its freshness weight
+// when it has one, with unmeasured lines last.
+func latencyOf(results map[string]*probeResult, line string) time.Duration {
+	if r := results[line]; r != nil && r.latency > 0 {
+		if r.freshness > 0 {
+			if d := float64(r.latency) / r.freshness; d < 9e18 {
+				return time.Duration(d)
+			}
+			return time.Duration(math.MaxInt64 - 1)
+		}
+		return r.latency
+	}
+	return time.Duration(math.MaxInt64)
+}
+
+func mbpsOf(results map[string]*probeResult, line string) float64 {
+	if r := results[line]; r != nil {
+		if r.freshness > 0 {
+			return r.mbps * r.freshness
+		}
+		return r.mbps
+	}
+	return 0
+}
+
+func freshnessOf(results map[string]*probeResult, line string) float64 {
+	if r := results[line]; r != nil {
+		return r.freshness
+	}
+	return 0
+}
+
+func weighted(results map[string]*probeResult, lines []string) bool {
+	for _, l := range lines {
+		if freshnessOf(results, l) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f OutputFilter) matches(line string) bool {
+	if f.IPVersion != 0 && ipVersionOf(line) != f.IPVersion {
+		return false
+	}
+	if len(f.Schemes) == 0 && len(f.Transports) == 0 && len(f.Security) == 0 {
+		return true
+	}
+	n, err := parseNode(line)
+	if err != nil {
+		return false
+	}
+	return matchesAny(f.Schemes, n.Scheme) &&
+		matchesAny(f.Transports, n.Transport) &&
+		matchesAny(f.Security, n.Security)
+}
+
+// matchesAny reports whether v is one of set; an empty set matches anything.
+func matchesAny(set []string, v string) bool {
+	if len(set) == 0 {
+		return true
+	}
+	for _, s := range set {
+		if strings.EqualFold(strings.TrimSpace(s), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipVersionOf classifies a URL-style link's host as 4 (dotted quad) or 6
+// (everything else, bracketed literals included), and 0 when the link has
+// no URL host.
+func ipVersionOf(line string) int {
+	u, err := url.Parse(line)
+	if err != nil || u.Host == "" {
+		return 0
+	}
+	host := u.Host
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return 6
+	}
+	if strings.Contains(host, ":") {
+		host = strings.Split(host, ":")[0]
+	}
+	if strings.Count(host, ".") == 3 {
+		return 4
+	}
+	return 6
+}
+
+// writeOutput encodes lines as o.Format into path, preceded by header
+// comment lines when there are any.
+func writeOutput(path string, lines []string, o OutputCfg, header []string, xc XrayCfg, cc ClashCfg) error {
+	if o.Format == "clash" || o.Format == "clash-provider" {
+		if o.Sort {
+			lines = append([]string(nil), lines...)
+			sort.Strings(lines)
+		}
+		var b []byte
+		var err error
+		if o.Format == "clash" {
+			b, err = clashConfig(lines, cc)
+		} else {
+			b, err = clashProvider(lines)
+		}
+		if err != nil {
+			return err
+		}
+		if len(header) > 0 {
+			b = withHeader(header, b)
+		}
+		return writeFileAtomic(path, b)
+	}
+	if o.Format == "xray" {
+		if o.Sort {
+			lines = append([]string(nil), lines...)
+			sort.Strings(lines)
+		}
+		b, err := xrayConfigs(lines, xc)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(path, b)
+	}
+	if len(header) > 0 {
+		cp := append([]string(nil), lines...)
+		if o.Sort {
+			sort.Strings(cp)
+		}
+		body := []byte(strings.Join(cp, "\n"))
+		if o.Format != "plain" {
+			body = []byte(base64.StdEncoding.EncodeToString(body))
+		}
+		return writeFileAtomic(path, withHeader(header, body))
+	}
+	if o.Format == "plain" {
+		return writePlain(path, lines, o.Sort)
+	}
+	if o.Sort {
+		return writeBase64Sorted(path, lines)
+	}
+	return writeBase64NoSort(path, lines)
+}
+
+// exportCfgFor is ec as it applies to sub: locations use LocationPath.
+func exportCfgFor(ec ExportCfg, sub Subscription) ExportCfg {
+	if sub.location && ec.LocationPath != "" {
+		ec.Path = strings.ReplaceAll(ec.LocationPath, "{country}", sub.Country)
+	}
+	return ec
+}
+
+// exportPath expands the export path template for one key and output. Keys
+// may contain "/" to nest directories (e.g. "location/DE"); output names are
+// sanitized. Without an {ext} placeholder the extension is appended. The
+// result must stay inside outDir.
+func exportPath(outDir string, ec ExportCfg, key string, o OutputCfg) (string, error) {
+	ext := ec.Extension
+	if o.Extension != nil {
+		ext = *o.Extension
+	}
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	tmpl := ec.Path
+	if tmpl == "" {
+		tmpl = defaultExportPath
+	}
+	if !strings.Contains(tmpl, "{ext}") {
+		tmpl += "{ext}"
+	}
+	rel := strings.NewReplacer(
+		"{key}", key,
+		"{output}", sanitizeFileName(o.Name),
+		"{ext}", ext,
+	).Replace(tmpl)
+
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if rel == "." || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("export path %q for key %q escapes the output directory", rel, key)
+	}
+	for _, seg := range strings.Split(filepath.ToSlash(rel), "/") {
+		if err := checkPathComponent(seg); err != nil {
+			return "", fmt.Errorf("export path %q: %w", rel, err)
+		}
+	}
+	path := filepath.Join(outDir, rel)
+	if err := checkPathLen(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,31 @@
+package refiner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxLinkLength caps a single link. Real links stay well below it; longer
+// ones are nearly always two feeds a broken aggregator glued together, and
+// clients fail the whole import on them.
+const maxLinkLength = 8 << 10
+
+// dropOversized rejects the links of lines longer than maxLinkLength and
+// returns the rest with how many were dropped.
+func dropOversized(lines []string, rej *rejects) ([]string, int) {
+	out := lines[:0:0]
+	dropped := 0
+	for _, l := range lines {
+		if len(l) <= maxLinkLength {
+			out = append(out, l)
+			continue
+		}
+		dropped++
+		reason := fmt.Sprintf("%d bytes, over the %d byte limit", len(l), maxLinkLength)
+		if n := strings.Count(l, "://"); n > 1 {
+			reason += fmt.Sprintf("; holds %d scheme separators, likely links glued together", n)
+		}
+		rej.add(l, "length", reason)
+	}
+	return out, dropped
+}
@@ -0,0 +1,107 @@
+package refiner
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNameLen is the longest file name component common file systems accept.
+const maxNameLen = 255
+
+// isReservedWindowsName reports whether name (with or without extension) is
+// a DOS device name, which Windows refuses as a file name in any directory.
+// Export trees are often cloned onto Windows machines, so these names are
+// avoided everywhere.
+func isReservedWindowsName(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '1' && base[3] <= '9'
+	}
+	return false
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// checkPathComponent validates one path segment of a key or output name.
+func checkPathComponent(seg string) error {
+	switch {
+	case seg == "" || seg == "." || seg == "..":
+		return fmt.Errorf("empty or relative path segment %q", seg)
+	case len(seg) > maxNameLen:
+		return fmt.Errorf("path segment %.20q... is longer than %d bytes", seg, maxNameLen)
+	case isReservedWindowsName(seg):
+		return fmt.Errorf("%q is a reserved name on Windows", seg)
+	case strings.HasSuffix(seg, ".") || strings.HasSuffix(seg, " "):
+		return fmt.Errorf("%q ends with a dot or space, which Windows strips", seg)
+	case reInvalidFileChars.MatchString(seg):
+		return fmt.Errorf("%q contains characters not allowed in file names", seg)
+	}
+	return nil
+}
+
+// checkKey validates a subscription key, which may nest directories with
+// "/".
+func checkKey(key string) error {
+	for _, seg := range strings.Split(key, "/") {
+		if err := checkPathComponent(seg); err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// checkDuplicateKeys rejects keys defined more than once, whose exports
+// would overwrite each other mid-run. Keys that differ only in case are
+// returned as warnings: they collide on case-insensitive file systems
+// (Windows, macOS).
+func checkDuplicateKeys(subs []Subscription) ([]string, error) {
+	seen := map[string]bool{}
+	folded := map[string]string{}
+	var warnings []string
+	for _, sub := range subs {
+		if seen[sub.Key] {
+			return nil, fmt.Errorf("key %q is defined more than once", sub.Key)
+		}
+		seen[sub.Key] = true
+		f := strings.ToLower(sub.Key)
+		if other, ok := folded[f]; ok {
+			warnings = append(warnings, fmt.Sprintf("keys %q and %q differ only in case and collide on case-insensitive file systems", other, sub.Key))
+			continue
+		}
+		folded[f] = sub.Key
+	}
+	return warnings, nil
+}
+
+// checkPathLen rejects export paths the platform cannot create, leaving room
+// for the temp-file suffix used by writeFileAtomic.
+func checkPathLen(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if len(abs)+tempSuffixLen > maxPathLen {
+		return fmt.Errorf("export path %s is too long (%d > %d characters)", abs, len(abs)+tempSuffixLen, maxPathLen)
+	}
+	return nil
+}
+
+// tempSuffixLen is the worst-case length of the ".<random>.tmp" suffix
+// os.CreateTemp appends.
+const tempSuffixLen = 16
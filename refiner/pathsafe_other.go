@@ -0,0 +1,17 @@
+//go:build !windows
+
+package refiner
+
+import (
+	"errors"
+	"syscall"
+)
+
+// maxPathLen is the usual PATH_MAX.
+const maxPathLen = 4096
+
+// isRetryableRenameErr reports whether a rename failed for a transient
+// reason worth retrying.
+func isRetryableRenameErr(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETXTBSY)
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package refiner
+
+import (
+	"errors"
+	"syscall"
+)
+
+// maxPathLen is MAX_PATH minus the terminating NUL. Go itself copes with
+// longer absolute paths, but Explorer, git and most tools on Windows don't.
+const maxPathLen = 259
+
+const (
+	errorAccessDenied     syscall.Errno = 5
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// isRetryableRenameErr reports whether a rename failed only because another
+// process (a viewer, an antivirus scanner, the indexer) holds the file open.
+// Checking error codes rather than messages keeps this working on
+// non-English Windows installations.
+func isRetryableRenameErr(err error) bool {
+	return errors.Is(err, errorSharingViolation) ||
+		errors.Is(err, errorLockViolation) ||
+		errors.Is(err, errorAccessDenied)
+}
@@ -0,0 +1,81 @@
+package refiner
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// workerPool bounds the probe work of all keys and stages at once: every
+// job takes one of its slots, so a key with a large concurrency cannot
+// starve the runner, and a submitter blocks while the slots are taken
+// rather than piling up goroutines.
+type workerPool struct {
+	slots chan struct{}
+}
+
+func newWorkerPool(workers int) *workerPool {
+	if workers <= 0 {
+		workers = 50
+	}
+	return &workerPool{slots: make(chan struct{}, workers)}
+}
+
+// each runs fn(0) ... fn(n-1) on the pool, at most limit of them at a
+// time, and returns when all are done.
+func (p *workerPool) each(n, limit int, fn func(i int)) {
+	if limit <= 0 || limit > cap(p.slots) {
+		limit = cap(p.slots)
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		p.slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-p.slots; <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// socketLimit caps the sockets probes hold open across the process
+// (probe.max_open_sockets), against ephemeral-port and conntrack
+// exhaustion on large runs. A nil *socketLimit does not limit.
+type socketLimit chan struct{}
+
+func newSocketLimit(n int) socketLimit {
+	if n <= 0 {
+		return nil
+	}
+	return make(socketLimit, n)
+}
+
+// acquire waits for a free socket and returns the func releasing it.
+func (s socketLimit) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	select {
+	case s <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-s }) }, nil
+}
+
+// limitedConn releases its socket when closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
@@ -0,0 +1,189 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxPorts caps the copies one node expands into.
+const defaultMaxPorts = 16
+
+// ExpandPortsCfg turns a node into one copy per port, the usual pattern
+// for CDN-fronted configs that answer on every Cloudflare port. Ports
+// ("443,2053,2083" or "8440-8450") applies to every node of the key;
+// Comments honors "# ports: ..." lines in the feed for the nodes after
+// them, which only trusted feeds should be allowed to do. Lists of more
+// than Max ports (default 16) are rejected.
+type ExpandPortsCfg struct {
+	Ports    string `yaml:"ports"`
+	Comments bool   `yaml:"comments"`
+	Max      int    `yaml:"max"`
+
+	list []int
+}
+
+func (c *ExpandPortsCfg) compile() error {
+	if c.Max <= 0 {
+		c.Max = defaultMaxPorts
+	}
+	if strings.TrimSpace(c.Ports) == "" {
+		return nil
+	}
+	var err error
+	if c.list, err = parsePorts(c.Ports, c.Max); err != nil {
+		return fmt.Errorf("expand_ports.ports: %w", err)
+	}
+	return nil
+}
+
+// parsePorts reads a comma-separated list of ports and ranges, in order
+// and without duplicates, of at most max ports.
+func parsePorts(spec string, max int) ([]int, error) {
+	var out []int
+	seen := map[int]bool{}
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(f, "-")
+		a, err := strconv.Atoi(strings.TrimSpace(lo))
+		b := a
+		if err == nil && isRange {
+			b, err = strconv.Atoi(strings.TrimSpace(hi))
+		}
+		if err != nil || a < 1 || b > 65535 || a > b {
+			return nil, fmt.Errorf("%q is not a port or port range", f)
+		}
+		for p := a; p <= b; p++ {
+			if seen[p] {
+				continue
+			}
+			if len(out) == max {
+				return nil, fmt.Errorf("more than %d ports in %q", max, spec)
+			}
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// expandPorts replaces every line by one copy per port. Lines whose port
+// cannot be rewritten are kept as they are.
+func expandPorts(lines []string, ports []int) []string {
+	if len(ports) == 0 {
+		return lines
+	}
+	out := make([]string, 0, len(lines)*len(ports))
+	for _, l := range lines {
+		out = append(out, portVariants(l, ports)...)
+	}
+	return out
+}
+
+func portVariants(line string, ports []int) []string {
+	out := make([]string, 0, len(ports))
+	for _, p := range ports {
+		v, ok := withPort(line, p)
+		if !ok {
+			return []string{line}
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+var rePortsDirective = regexp.MustCompile(`(?i)^\s*(?:#|//|;)\s*ports\s*:\s*(.*)$`)
+
+// expandPortDirectives applies "# ports: ..." comment lines of a decoded
+// body to the lines after them, up to the next directive; an empty one
+// ends the expansion. Directives that do not parse are reported and
+// ignored.
+func expandPortDirectives(log io.Writer, b []byte, max int, key string) ([]byte, int) {
+	var out bytes.Buffer
+	var ports []int
+	expanded := 0
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if m := rePortsDirective.FindStringSubmatch(line); m != nil {
+			p, err := parsePorts(m[1], max)
+			if err != nil {
+				fmt.Fprintf(log, "!! %s: ignoring ports directive: %v\n", key, err)
+			} else {
+				ports = p
+			}
+		} else if t := strings.TrimSpace(line); len(ports) > 0 && t != "" && !reCommentLine.MatchString(t) {
+			for _, v := range portVariants(t, ports) {
+				out.WriteString(v)
+				out.WriteByte('\n')
+			}
+			expanded++
+			continue
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), expanded
+}
+
+// withPort returns line with its server port set to port: the port field
+// of vmess payloads, the authority port of URL-style links.
+func withPort(line string, port int) (string, bool) {
+	if strings.HasPrefix(line, "vmess://") {
+		return withVmessField(line, "port", strconv.Itoa(port))
+	}
+	_, colon, end, ok := serverBounds(line)
+	if !ok {
+		return line, false
+	}
+	return line[:colon+1] + strconv.Itoa(port) + line[end:], true
+}
+
+// withVmessField sets one field of a vmess payload, keeping any #fragment.
+func withVmessField(line, field, value string) (string, bool) {
+	m, err := decodeVmessPayload(line)
+	if err != nil {
+		return line, false
+	}
+	m[field] = value
+	out, err := encodeVmess(m)
+	if err != nil {
+		return line, false
+	}
+	if _, frag, ok := strings.Cut(line, "#"); ok {
+		out += "#" + frag
+	}
+	return out, true
+}
+
+// serverBounds locates the server of a URL-style link: line[host:colon] is
+// the host (brackets included) and line[colon+1:end] the port.
+func serverBounds(line string) (host, colon, end int, ok bool) {
+	i := strings.Index(line, "://")
+	if i < 0 {
+		return 0, 0, 0, false
+	}
+	start := i + 3
+	end = len(line)
+	if j := strings.IndexAny(line[start:], "/?#"); j >= 0 {
+		end = start + j
+	}
+	auth := line[start:end]
+	h := strings.LastIndex(auth, "@") + 1
+	c := strings.LastIndex(auth, ":")
+	if c < h || c < strings.LastIndex(auth, "]") {
+		return 0, 0, 0, false
+	}
+	if _, err := strconv.Atoi(auth[c+1:]); err != nil {
+		return 0, 0, 0, false
+	}
+	return start + h, start + c, end, true
+}
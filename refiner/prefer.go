@@ -0,0 +1,44 @@
+package refiner
+
+import "sort"
+
+// keepPreferred returns n of lines, in their original order. Lines whose
+// scheme comes earlier in prefer are kept first, unlisted schemes last;
+// within a rank, better decides.
+func keepPreferred(lines []string, n int, prefer []string, better func(lines []string, i, j int) bool) []string {
+	if n >= len(lines) {
+		return lines
+	}
+	rank := make([]int, len(lines))
+	idx := make([]int, len(lines))
+	for i, l := range lines {
+		rank[i], idx[i] = schemeRank(schemeOf(l), prefer), i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		if ra, rb := rank[idx[a]], rank[idx[b]]; ra != rb {
+			return ra < rb
+		}
+		return better(lines, idx[a], idx[b])
+	})
+	idx = idx[:n]
+	sort.Ints(idx)
+	out := make([]string, len(idx))
+	for i, j := range idx {
+		out[i] = lines[j]
+	}
+	return out
+}
+
+// newer prefers lines closer to the end, where feeds put their newest.
+func newer(_ []string, i, j int) bool { return i > j }
+
+// schemeRank is the position of scheme in prefer, or len(prefer) when
+// it is not listed.
+func schemeRank(scheme string, prefer []string) int {
+	for i, p := range prefer {
+		if p == scheme {
+			return i
+		}
+	}
+	return len(prefer)
+}
@@ -0,0 +1,49 @@
+package refiner
+
+import (
+	"fmt"
+)
+
+// RunAsCfg names the account a process started as root switches to once
+// it holds what needs root: the serve listeners on low ports and the
+// choice of ICMP socket. Group defaults to the user's primary group.
+type RunAsCfg struct {
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+}
+
+func (c RunAsCfg) check() error {
+	if c.User == "" && c.Group != "" {
+		return fmt.Errorf("run_as: group needs a user")
+	}
+	return nil
+}
+
+// dropPrivileges switches to run_as when running as root. Raw ICMP sockets
+// are opened per ping and no longer can be afterwards, so icmp_fallback
+// looks again for a socket the new user may open.
+func (r *refiner) dropPrivileges() error {
+	c := r.cfg.RunAs
+	if c.User == "" {
+		return nil
+	}
+	if !privDropSupported {
+		fmt.Fprintf(r.log, "!! run_as is not supported on Windows, ignoring it; run the service under the account instead\n")
+		return nil
+	}
+	if !isRoot() {
+		fmt.Fprintf(r.log, "Info: not running as root, ignoring run_as\n")
+		return nil
+	}
+	if err := setUser(c); err != nil {
+		return fmt.Errorf("run_as: %w", err)
+	}
+	fmt.Fprintf(r.log, "Info: dropped privileges to %s\n", c.User)
+	if r.cfg.Probe.ICMPFallback && r.prober != nil {
+		r.prober.icmpFallback = r.prober.dialer.enableICMP()
+		if !r.prober.icmpFallback {
+			fmt.Fprintf(r.log, "Info: icmp_fallback disabled, %s may not open ICMP sockets\n", c.User)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+package refiner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+const privDropSupported = true
+
+func isRoot() bool { return os.Geteuid() == 0 }
+
+// setUser switches every thread to c's user and group, dropping the
+// supplementary groups of root.
+func setUser(c RunAsCfg) error {
+	u, err := user.Lookup(c.User)
+	if err != nil {
+		return err
+	}
+	gid := u.Gid
+	if c.Group != "" {
+		g, err := user.LookupGroup(c.Group)
+		if err != nil {
+			return err
+		}
+		gid = g.Gid
+	}
+	uidN, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: uid %q", c.User, u.Uid)
+	}
+	gidN, err := strconv.Atoi(gid)
+	if err != nil {
+		return fmt.Errorf("group %s: gid %q", c.Group, gid)
+	}
+	if uidN == 0 {
+		return errors.New("user must not be root")
+	}
+	if err := syscall.Setgroups([]int{gidN}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gidN); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uidN); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if syscall.Setuid(0) == nil {
+		return errors.New("could regain root after dropping privileges")
+	}
+	return nil
+}
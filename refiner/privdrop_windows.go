@@ -0,0 +1,15 @@
+//go:build windows
+
+package refiner
+
+import "errors"
+
+// Windows services run under the account they are installed for, so
+// run_as is ignored there.
+const privDropSupported = false
+
+func isRoot() bool { return false }
+
+func setUser(RunAsCfg) error {
+	return errors.New("not supported on Windows; run the service under the account instead")
+}
@@ -0,0 +1,728 @@
+package refiner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// happyEyeballsDelay is the RFC 8305 "Connection Attempt Delay": how long an
+// attempt gets before the next address is tried in parallel.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// probeResult is the outcome of probing one line. err is nil for nodes that
+// passed every enabled check; graced nodes failed but are exported anyway
+// because they were reachable within the grace period.
+type probeResult struct {
+	line    string
+	err     error
+	latency time.Duration
+	cert    *certInfo
+	graced  bool
+	// tlsErr is the failed handshake of a node kept with tls_check.drop
+	// false.
+	tlsErr string
+	// unverified is set when the TCP dial failed but the host answered an
+	// ICMP echo; such nodes are exported but flagged in reports.
+	unverified bool
+	// unprobed results come from keys with probe.enabled: false.
+	unprobed bool
+	// vantage holds per-vantage-point verdicts when agents are configured.
+	vantage map[string]bool
+	// mbps is the measured download throughput, 0 when not measured.
+	mbps float64
+	// jitter and loss come from extra connect samples (probe.samples).
+	jitter time.Duration
+	loss   float64
+	// freshness weighs latency and throughput in selection by how recently
+	// the node was first seen, 0 when not weighted.
+	freshness float64
+	// method is how the node was checked (tcp, tls, ws, grpc, reality,
+	// udp, or icmp for unverified nodes) and checked when.
+	method  string
+	checked time.Time
+}
+
+// probeLines probes up to maxToTest lines on p's shared pool, at most
+// maxConcurrent at a time, and returns one result per probed line, in input
+// order.
+func probeLines(lines []string, p *prober, maxConcurrent, maxToTest int) []probeResult {
+	limit := len(lines)
+	if maxToTest > 0 && limit > maxToTest {
+		limit = maxToTest
+	}
+	results := make([]probeResult, limit)
+	tested := make([]bool, limit)
+
+	if maxConcurrent <= 0 {
+		maxConcurrent = 20
+	}
+	p.pool.each(limit, maxConcurrent, func(i int) {
+		if l := strings.TrimSpace(lines[i]); l != "" {
+			results[i] = p.probe(l)
+			tested[i] = true
+		}
+	})
+
+	out := results[:0]
+	for i, r := range results {
+		if tested[i] {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// unprobedResults passes lines through as reachable without testing them.
+func unprobedResults(lines []string) []probeResult {
+	out := make([]probeResult, len(lines))
+	for i, l := range lines {
+		out[i] = probeResult{line: l, unprobed: true}
+	}
+	return out
+}
+
+// resultsByLine indexes results by their line.
+func resultsByLine(results []probeResult) map[string]*probeResult {
+	out := make(map[string]*probeResult, len(results))
+	for i := range results {
+		out[results[i].line] = &results[i]
+	}
+	return out
+}
+
+func reachableLines(results []probeResult) []string {
+	out := make([]string, 0, len(results))
+	for _, r := range results {
+		if r.err == nil || r.graced || r.unverified {
+			out = append(out, r.line)
+		}
+	}
+	return out
+}
+
+// prober decides whether a single node is alive. Each node is probed with a
+// method picked from probe.strategies; nodes no rule matches use
+// probe.default, or else the TCP dial plus whichever of the ws/grpc/tls/
+// reality checks are enabled.
+type prober struct {
+	dialer    *probeDialer
+	wsCheck   bool
+	grpcCheck bool
+
+	tlsCheck       bool
+	tlsDrop        bool
+	realityCheck   bool
+	dropExpired    bool
+	dropSelfSigned bool
+
+	strategies []probeStrategy
+	fallback   probeStrategy
+
+	icmpFallback bool
+	samples      int
+
+	// adaptive drives probeAdaptive. dialCut, when shorter than a node's
+	// timeout, bounds its TCP connect; with retryCut set, nodes cut short
+	// fail with errDialCut so they can be retried with a longer one.
+	adaptive AdaptiveTimeoutCfg
+	dialCut  time.Duration
+	retryCut bool
+
+	// pool runs the probes of every key; ctx cancels them.
+	pool *workerPool
+	ctx  context.Context
+}
+
+// probeStrategy applies method (with its own timeout, when set) to nodes
+// carrying every token of match: a scheme, transport or security name, or
+// "cdn" for hosts on Cloudflare addresses.
+type probeStrategy struct {
+	tokens  []string
+	method  string
+	timeout time.Duration
+}
+
+// probeMethods are the methods a strategy may name; "http" is an alias of
+// "ws" and "reality" of "tls".
+var probeMethods = map[string]bool{
+	"tcp": true, "tls": true, "reality": true, "ws": true, "http": true, "grpc": true, "udp": true,
+}
+
+func newProber(cfg ProbeCfg, d *probeDialer) *prober {
+	p := &prober{
+		dialer:         d,
+		wsCheck:        cfg.WSCheck,
+		grpcCheck:      cfg.GRPCCheck,
+		tlsCheck:       cfg.TLSCheck.Enabled || cfg.DropExpiredCerts || cfg.DropSelfSigned,
+		tlsDrop:        cfg.TLSCheck.drop(),
+		realityCheck:   cfg.RealityCheck,
+		dropExpired:    cfg.DropExpiredCerts,
+		dropSelfSigned: cfg.DropSelfSigned,
+		fallback:       newProbeStrategy(cfg.Default),
+		icmpFallback:   cfg.ICMPFallback && (d.icmp4 != "" || d.icmp6 != ""),
+		samples:        cfg.Samples,
+		adaptive:       cfg.Adaptive,
+		ctx:            context.Background(),
+	}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = cfg.Concurrency
+	}
+	// A probe holds its connection while taking further samples, so each
+	// worker may need two sockets; more workers than that would only wait.
+	if perProbe := min(max(cfg.Samples, 1), 2); cfg.MaxOpenSockets > 0 && workers*perProbe > cfg.MaxOpenSockets {
+		workers = max(cfg.MaxOpenSockets/perProbe, 1)
+	}
+	p.pool = newWorkerPool(workers)
+	for _, s := range cfg.Strategies {
+		p.strategies = append(p.strategies, newProbeStrategy(s))
+	}
+	return p
+}
+
+// withTimeout returns a prober that shares p's settings but uses timeout as
+// its default, for keys overriding probe.timeout.
+func (p *prober) withTimeout(timeout time.Duration) *prober {
+	if timeout <= 0 || timeout == p.dialer.timeout {
+		return p
+	}
+	cp := *p
+	d := *p.dialer
+	d.timeout = timeout
+	cp.dialer = &d
+	return &cp
+}
+
+// withContext returns a prober that shares p's settings but whose probes
+// are cancelled with ctx.
+func (p *prober) withContext(ctx context.Context) *prober {
+	if ctx == p.ctx {
+		return p
+	}
+	cp := *p
+	cp.ctx = ctx
+	return &cp
+}
+
+func newProbeStrategy(s ProbeStrategy) probeStrategy {
+	ps := probeStrategy{method: strings.ToLower(strings.TrimSpace(s.Method)), timeout: s.Timeout}
+	for _, t := range strings.Split(strings.ToLower(s.Match), "+") {
+		if t = strings.TrimSpace(t); t != "" {
+			ps.tokens = append(ps.tokens, t)
+		}
+	}
+	switch ps.method {
+	case "http":
+		ps.method = "ws"
+	case "reality":
+		ps.method = "tls"
+	}
+	return ps
+}
+
+func (s probeStrategy) matches(n *node, cdn bool) bool {
+	for _, t := range s.tokens {
+		switch t {
+		case n.Scheme, n.Transport, n.Security:
+		case "cdn":
+			if !cdn {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (p *prober) usesCDN() bool {
+	for _, s := range p.strategies {
+		for _, t := range s.tokens {
+			if t == "cdn" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// strategyFor returns the probe method and timeout for n.
+func (p *prober) strategyFor(n *node, cdn bool) (string, time.Duration) {
+	s := p.fallback
+	for _, st := range p.strategies {
+		if st.matches(n, cdn) {
+			s = st
+			break
+		}
+	}
+
+	method, timeout := s.method, s.timeout
+	if timeout <= 0 {
+		timeout = p.fallback.timeout
+	}
+	if timeout <= 0 {
+		timeout = p.dialer.timeout
+	}
+	if method == "" {
+		switch {
+		case udpSchemes[n.Scheme]:
+			method = "udp"
+		case p.realityCheck && n.Security == "reality":
+			method = "tls"
+		case p.wsCheck && n.Transport == "ws":
+			method = "ws"
+		case p.grpcCheck && n.Transport == "grpc" && n.Security != "reality":
+			method = "grpc"
+		case p.tlsCheck && n.Security == "tls":
+			method = "tls"
+		default:
+			method = "tcp"
+		}
+	}
+	return method, timeout
+}
+
+func (p *prober) probe(line string) probeResult {
+	res := probeResult{line: line}
+
+	n, err := parseNode(line)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if n.Host == "" || n.Port == 0 {
+		res.err = fmt.Errorf("missing host or port")
+		return res
+	}
+
+	rctx, rcancel := context.WithTimeout(p.ctx, p.dialer.timeout)
+	ips, err := p.dialer.resolve(rctx, n.Host)
+	rcancel()
+	if err != nil {
+		res.err = err
+		return res
+	}
+	cdn := false
+	if p.usesCDN() {
+		for _, ip := range ips {
+			if a, ok := netip.AddrFromSlice(ip); ok && isCloudflareAddr(a.Unmap()) {
+				cdn = true
+				break
+			}
+		}
+	}
+	method, timeout := p.strategyFor(n, cdn)
+
+	ctx, cancel := context.WithTimeout(p.ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	res.method, res.checked = method, start.UTC()
+	if method == "udp" {
+		res.err = p.dialer.probeUDP(ctx, ips, n.Port)
+		res.latency = time.Since(start)
+		return res
+	}
+	dctx := ctx
+	if p.dialCut > 0 && p.dialCut < timeout {
+		var dcancel context.CancelFunc
+		dctx, dcancel = context.WithTimeout(ctx, p.dialCut)
+		defer dcancel()
+	}
+	conn, err := p.dialer.race(dctx, ips, n.Port)
+	if err != nil {
+		res.err = err
+		if p.retryCut && dctx.Err() != nil && ctx.Err() == nil {
+			res.err = errDialCut
+			return res
+		}
+		// A refusal means the host is up but nothing listens there.
+		if p.icmpFallback && !errors.Is(err, syscall.ECONNREFUSED) {
+			pctx, pcancel := context.WithTimeout(p.ctx, timeout)
+			if rtt, perr := p.dialer.ping(pctx, ips); perr == nil {
+				res.unverified, res.latency, res.method = true, rtt, "icmp"
+			}
+			pcancel()
+		}
+		return res
+	}
+	res.latency = time.Since(start)
+	defer conn.Close()
+	// The handshakes below run on deadlines; closing aborts them.
+	defer context.AfterFunc(p.ctx, func() { conn.Close() })()
+	if p.samples > 1 {
+		res.jitter, res.loss = p.sample(ips, n.Port, timeout, res.latency)
+	}
+
+	if method == "tcp" {
+		return res
+	}
+	if n.Security == "reality" {
+		res.method = "reality"
+		// Plain TLS clients get false negatives from REALITY servers.
+		res.cert, res.err = realityHandshake(conn, n, timeout)
+		return res
+	}
+
+	if n.Security == "tls" {
+		var alpn []string
+		switch method {
+		case "ws":
+			alpn = []string{"http/1.1"}
+		case "grpc":
+			alpn = []string{"h2"}
+		}
+		tc, cert, err := tlsHandshake(conn, n, alpn, timeout)
+		res.cert = cert
+		if err != nil && method == "tls" && !p.tlsDrop {
+			res.tlsErr = err.Error()
+			return res
+		}
+		if err != nil {
+			res.err = err
+			return res
+		}
+		if res.err = p.checkCert(cert); res.err != nil {
+			return res
+		}
+		conn = tc
+	}
+
+	switch method {
+	case "ws":
+		res.err = checkWebSocket(conn, n, timeout)
+	case "grpc":
+		res.err = checkHTTP2Preface(conn, timeout)
+	}
+	return res
+}
+
+// sample takes probe.samples-1 further TCP connect timings after the first
+// successful one and returns the jitter (mean difference between consecutive
+// samples, as in RFC 3550) and the share of attempts that failed.
+func (p *prober) sample(ips []net.IP, port int, timeout, first time.Duration) (time.Duration, float64) {
+	rtts := []time.Duration{first}
+	lost := 0
+	for i := 1; i < p.samples; i++ {
+		ctx, cancel := context.WithTimeout(p.ctx, timeout)
+		start := time.Now()
+		conn, err := p.dialer.race(ctx, ips, port)
+		cancel()
+		if err != nil {
+			lost++
+			continue
+		}
+		rtts = append(rtts, time.Since(start))
+		conn.Close()
+	}
+	var jitter time.Duration
+	for i := 1; i < len(rtts); i++ {
+		d := rtts[i] - rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		jitter += d
+	}
+	if len(rtts) > 1 {
+		jitter /= time.Duration(len(rtts) - 1)
+	}
+	return jitter, float64(lost) / float64(p.samples)
+}
+
+func (p *prober) checkCert(c *certInfo) error {
+	if c == nil {
+		return nil
+	}
+	if p.dropExpired && time.Now().After(c.NotAfter) {
+		return fmt.Errorf("tls: certificate expired %s", c.NotAfter.Format(time.RFC3339))
+	}
+	if p.dropSelfSigned && c.SelfSigned {
+		return fmt.Errorf("tls: self-signed certificate %q", c.Subject)
+	}
+	return nil
+}
+
+// probeDialer opens the TCP connections used for reachability checks. Hosts
+// that resolve to several addresses are dialed RFC 8305-style, so a node
+// published with both A and AAAA records is still reachable from a runner
+// that lacks working IPv6.
+type probeDialer struct {
+	timeout       time.Duration
+	fallbackDelay time.Duration
+
+	// canV4/canV6 report which families may be dialed at all, derived from
+	// probe.family and what the runner (or the chosen source) supports.
+	canV4, canV6 bool
+	// localV4/localV6 are bound as the source address when set.
+	localV4, localV6 net.IP
+	// icmp4/icmp6 name the sockets used for ICMP echoes, if any work.
+	icmp4, icmp6 string
+	// sockets caps the sockets held open by all dials.
+	sockets socketLimit
+	dns     *dnsCache
+}
+
+func newProbeDialer(cfg ProbeCfg, timeout time.Duration, log io.Writer) (*probeDialer, error) {
+	d := &probeDialer{timeout: timeout, fallbackDelay: happyEyeballsDelay, sockets: newSocketLimit(cfg.MaxOpenSockets), dns: newDNSCache(cfg.DNS)}
+
+	switch {
+	case cfg.SourceAddr != "":
+		ip := net.ParseIP(strings.TrimSpace(cfg.SourceAddr))
+		if ip == nil {
+			return nil, fmt.Errorf("probe.source_addr: invalid IP %q", cfg.SourceAddr)
+		}
+		if ip.To4() != nil {
+			d.localV4, d.canV4 = ip, true
+		} else {
+			d.localV6, d.canV6 = ip, true
+		}
+	case cfg.Interface != "":
+		ifi, err := net.InterfaceByName(cfg.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("probe.interface: %w", err)
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("probe.interface %s: %w", cfg.Interface, err)
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || !ipn.IP.IsGlobalUnicast() {
+				continue
+			}
+			if ipn.IP.To4() != nil {
+				if d.localV4 == nil {
+					d.localV4 = ipn.IP
+				}
+			} else if d.localV6 == nil {
+				d.localV6 = ipn.IP
+			}
+		}
+		if d.localV4 == nil && d.localV6 == nil {
+			return nil, fmt.Errorf("probe.interface %s has no usable addresses", cfg.Interface)
+		}
+		d.canV4, d.canV6 = d.localV4 != nil, d.localV6 != nil
+	default:
+		d.canV4, d.canV6 = true, hasGlobalIPv6()
+	}
+
+	switch cfg.Family {
+	case "ipv4":
+		d.canV6 = false
+	case "ipv6":
+		d.canV4 = false
+	}
+	if !d.canV4 && !d.canV6 {
+		return nil, fmt.Errorf("probe.family %s is not available with the configured source", cfg.Family)
+	}
+	if cfg.ICMPFallback && !d.enableICMP() {
+		fmt.Fprintf(log, "Info: icmp_fallback disabled, no raw or unprivileged ICMP socket available\n")
+	}
+	return d, nil
+}
+
+// hasGlobalIPv6 reports whether any local interface carries a routable IPv6
+// address. Runners without one cannot reach IPv6 nodes, so dialing them only
+// burns the probe timeout.
+func hasGlobalIPv6() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if ok && ipn.IP.To4() == nil && ipn.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *probeDialer) dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return d.race(ctx, ips, port)
+}
+
+// resolve returns the addresses of host that may be dialed, in dialing
+// order.
+func (d *probeDialer) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	ips, err := d.dns.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	usable := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if d.allows(ip) {
+			usable = append(usable, ip)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("%s has no address in a dialable family", host)
+	}
+	return usable, nil
+}
+
+func (d *probeDialer) allows(ip net.IP) bool {
+	if ip.To4() != nil {
+		return d.canV4
+	}
+	return d.canV6
+}
+
+func (d *probeDialer) netDialer(ip net.IP) *net.Dialer {
+	local := d.localV6
+	if ip.To4() != nil {
+		local = d.localV4
+	}
+	if local == nil {
+		return &net.Dialer{}
+	}
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: local}}
+}
+
+// race starts a connection attempt to ips[0] and then to each following
+// address once the previous attempt failed or fallbackDelay elapsed,
+// returning the first connection that succeeds.
+func (d *probeDialer) race(ctx context.Context, ips []net.IP, port int) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(ips))
+	start := func(ip net.IP) {
+		nd := d.netDialer(ip)
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		go func() {
+			release, err := d.sockets.acquire(ctx)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			conn, err := nd.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				release()
+				results <- result{err: err}
+				return
+			}
+			results <- result{conn: &limitedConn{Conn: conn, release: release}}
+		}()
+	}
+
+	// Attempts still in flight when we return may complete anyway; close
+	// whatever they produce so no connection leaks.
+	pending := 0
+	defer func() {
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(pending)
+	}()
+
+	var firstErr error
+	next := 0
+	for {
+		if pending == 0 && next < len(ips) {
+			start(ips[next])
+			next++
+			pending++
+		}
+		if pending == 0 {
+			break
+		}
+
+		var delay <-chan time.Time
+		var timer *time.Timer
+		if next < len(ips) {
+			timer = time.NewTimer(d.fallbackDelay)
+			delay = timer.C
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		case <-delay:
+			start(ips[next])
+			next++
+			pending++
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			return nil, firstErr
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, firstErr
+}
+
+// resolveProbeIPs returns the addresses of host ordered for dialing: IPv6
+// and IPv4 interleaved, IPv6 first, as recommended by RFC 8305.
+func resolveProbeIPs(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 []net.IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a.IP)
+		} else {
+			v6 = append(v6, a.IP)
+		}
+	}
+	out := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return out, nil
+}
@@ -0,0 +1,39 @@
+package refiner
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// http2Preface is the client connection preface followed by an empty
+// SETTINGS frame (RFC 9113 section 3.4).
+var http2Preface = append([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), 0, 0, 0, 0x4, 0, 0, 0, 0, 0)
+
+// checkHTTP2Preface verifies that a grpc node speaks HTTP/2: after the client
+// preface the server's first frame must be SETTINGS. TLS nodes must have
+// negotiated h2 via ALPN already, plain ones are expected to accept
+// prior-knowledge h2c.
+func checkHTTP2Preface(conn net.Conn, timeout time.Duration) error {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if proto := tc.ConnectionState().NegotiatedProtocol; proto != "h2" {
+			return fmt.Errorf("grpc: server negotiated %q instead of h2", proto)
+		}
+	}
+
+	if _, err := conn.Write(http2Preface); err != nil {
+		return fmt.Errorf("grpc write preface: %w", err)
+	}
+	var hdr [9]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return fmt.Errorf("grpc read frame: %w", err)
+	}
+	if hdr[3] != 0x4 {
+		return fmt.Errorf("grpc: first frame type %d, want SETTINGS", hdr[3])
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package refiner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var errICMPUnavailable = errors.New("icmp: no usable socket for this family")
+
+// detectICMP returns the first of raw (root or CAP_NET_RAW) and dgram
+// (unprivileged ping sockets, e.g. Linux with net.ipv4.ping_group_range) that
+// can be opened, or "" when neither works.
+func detectICMP(raw, dgram, addr string) string {
+	for _, network := range []string{raw, dgram} {
+		c, err := icmp.ListenPacket(network, addr)
+		if err == nil {
+			c.Close()
+			return network
+		}
+	}
+	return ""
+}
+
+func (d *probeDialer) enableICMP() bool {
+	d.icmp4 = detectICMP("ip4:icmp", "udp4", listenAddr(d.localV4, "0.0.0.0"))
+	d.icmp6 = detectICMP("ip6:ipv6-icmp", "udp6", listenAddr(d.localV6, "::"))
+	return d.icmp4 != "" || d.icmp6 != ""
+}
+
+func listenAddr(local net.IP, any string) string {
+	if local == nil {
+		return any
+	}
+	return local.String()
+}
+
+// ping sends an ICMP echo to each of ips in turn and returns the round trip
+// of the first one that answers.
+func (d *probeDialer) ping(ctx context.Context, ips []net.IP) (time.Duration, error) {
+	err := errICMPUnavailable
+	for _, ip := range ips {
+		var rtt time.Duration
+		if rtt, err = d.pingOne(ctx, ip); err == nil {
+			return rtt, nil
+		}
+	}
+	return 0, err
+}
+
+func (d *probeDialer) pingOne(ctx context.Context, ip net.IP) (time.Duration, error) {
+	network, proto, local := d.icmp4, 1, listenAddr(d.localV4, "0.0.0.0")
+	var reqType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, proto, local = d.icmp6, 58, listenAddr(d.localV6, "::")
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	if network == "" {
+		return 0, errICMPUnavailable
+	}
+
+	release, err := d.sockets.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	c, err := icmp.ListenPacket(network, local)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	} else {
+		_ = c.SetDeadline(time.Now().Add(d.timeout))
+	}
+
+	// Datagram ping sockets rewrite the echo ID, so replies are matched on
+	// their random payload instead.
+	payload := make([]byte, 16)
+	_, _ = rand.Read(payload)
+	msg := icmp.Message{Type: reqType, Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: payload}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if network == "udp4" || network == "udp6" {
+		dst = &net.UDPAddr{IP: ip}
+	}
+
+	start := time.Now()
+	if _, err := c.WriteTo(b, dst); err != nil {
+		return 0, fmt.Errorf("icmp write: %w", err)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return 0, fmt.Errorf("icmp read: %w", err)
+		}
+		m, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || m.Type != replyType {
+			continue
+		}
+		if echo, ok := m.Body.(*icmp.Echo); ok && bytes.Equal(echo.Data, payload) {
+			return time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package refiner
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// realityHandshake performs the ClientHello a REALITY client would send: the
+// node's SNI with its uTLS fingerprint (fp=). REALITY servers forward
+// handshakes they cannot authenticate to their dest, so a completed handshake
+// shows both the server and its dest are up, while a plain crypto/tls hello
+// is often rejected outright.
+func realityHandshake(conn net.Conn, n *node, timeout time.Duration) (*certInfo, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	fp := ""
+	if n.Query != nil {
+		fp = n.Query.Get("fp")
+	}
+	sni := n.tlsServerName()
+	uc := utls.UClient(conn, &utls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+	}, utlsHelloID(fp))
+	if err := uc.Handshake(); err != nil {
+		return nil, fmt.Errorf("reality handshake (sni=%s fp=%s): %w", sni, fp, err)
+	}
+
+	certs := uc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, nil
+	}
+	return inspectCert(certs[0], sni), nil
+}
+
+// utlsHelloID maps xray's fingerprint names to uTLS ClientHello presets,
+// defaulting to Chrome like xray does.
+func utlsHelloID(fp string) utls.ClientHelloID {
+	switch strings.ToLower(strings.TrimSpace(fp)) {
+	case "firefox":
+		return utls.HelloFirefox_Auto
+	case "safari":
+		return utls.HelloSafari_Auto
+	case "ios":
+		return utls.HelloIOS_Auto
+	case "android":
+		return utls.HelloAndroid_11_OkHttp
+	case "edge":
+		return utls.HelloEdge_Auto
+	case "360":
+		return utls.Hello360_Auto
+	case "qq":
+		return utls.HelloQQ_Auto
+	case "random", "randomized":
+		return utls.HelloRandomized
+	default:
+		return utls.HelloChrome_Auto
+	}
+}
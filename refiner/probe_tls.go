@@ -0,0 +1,85 @@
+package refiner
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TLSCheckCfg is probe.tls_check, either true or {enabled, drop}. Nodes
+// whose TLS handshake fails are dropped unless Drop is false; then they
+// are kept on their TCP connect with the error in the reports.
+type TLSCheckCfg struct {
+	Enabled bool  `yaml:"enabled"`
+	Drop    *bool `yaml:"drop"`
+}
+
+func (c *TLSCheckCfg) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&c.Enabled)
+	}
+	type plain TLSCheckCfg
+	return n.Decode((*plain)(c))
+}
+
+func (c TLSCheckCfg) drop() bool { return c.Drop == nil || *c.Drop }
+
+// certInfo summarizes the leaf certificate a TLS node presented.
+type certInfo struct {
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	NotAfter   time.Time `json:"not_after"`
+	SelfSigned bool      `json:"self_signed"`
+	SNIMatch   bool      `json:"sni_match"`
+}
+
+// tlsHandshake performs a TLS handshake over conn using the node's SNI and
+// ALPN (alpn overrides the node's own list when non-empty). Verification is
+// skipped so that certificate problems are recorded rather than fatal; the
+// caller decides what to drop. A failed handshake is an error.
+func tlsHandshake(conn net.Conn, n *node, alpn []string, timeout time.Duration) (*tls.Conn, *certInfo, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if len(alpn) == 0 && n.Query != nil {
+		for _, p := range strings.Split(n.Query.Get("alpn"), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				alpn = append(alpn, p)
+			}
+		}
+	}
+	sni := n.tlsServerName()
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+		NextProtos:         alpn,
+	})
+	if err := tc.Handshake(); err != nil {
+		return nil, nil, fmt.Errorf("tls handshake: %w", err)
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return tc, nil, nil
+	}
+	return tc, inspectCert(certs[0], sni), nil
+}
+
+// inspectCert summarizes the leaf certificate of a handshake. It counts as
+// self-signed when it is its own issuer and verifies under its own key;
+// CheckSignatureFrom would also demand a CA, which self-signed leaves
+// rarely are.
+func inspectCert(c *x509.Certificate, sni string) *certInfo {
+	return &certInfo{
+		Subject:    c.Subject.String(),
+		Issuer:     c.Issuer.String(),
+		NotAfter:   c.NotAfter,
+		SelfSigned: bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil,
+		SNIMatch:   c.VerifyHostname(sni) == nil,
+	}
+}
@@ -0,0 +1,69 @@
+package refiner
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// udpSilence is how long probeUDP listens for a reply or an ICMP error
+// before taking silence for a live server. ICMP errors come back within a
+// round trip, so waiting out a long probe timeout tells nothing more.
+const udpSilence = 1500 * time.Millisecond
+
+// probeUDP checks a UDP-based node (tuic, hysteria2, ...). Such servers
+// silently drop datagrams they cannot authenticate, so silence for
+// udpSilence (or until the deadline, when sooner) counts as alive; only an
+// ICMP port-unreachable (surfacing as ECONNREFUSED on the connected socket)
+// or a send failure marks the node dead. It returns as soon as a reply or an
+// error is read.
+func (d *probeDialer) probeUDP(ctx context.Context, ips []net.IP, port int) error {
+	if len(ips) == 0 {
+		return errors.New("no addresses to probe")
+	}
+	ip := ips[0]
+	release, err := d.sockets.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	conn, err := d.netDialer(ip).DialContext(ctx, "udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(d.timeout)
+	}
+	if quiet := time.Now().Add(udpSilence); quiet.Before(deadline) {
+		deadline = quiet
+	}
+	_ = conn.SetDeadline(deadline)
+
+	// Large enough to look like a QUIC Initial to middleboxes.
+	payload := make([]byte, 1200)
+	_, _ = rand.Read(payload)
+	if _, err := conn.Write(payload); err != nil {
+		return fmt.Errorf("udp write: %w", err)
+	}
+
+	buf := make([]byte, 64)
+	_, err = conn.Read(buf)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errors.New("udp: port unreachable")
+	}
+	return fmt.Errorf("udp read: %w", err)
+}
@@ -0,0 +1,77 @@
+package refiner
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkWebSocket sends a websocket upgrade for the node's path over conn
+// (already TLS-wrapped for tls nodes) and judges the answer. A live xray ws
+// inbound answers 101, or 400/404 when the handshake or path is not to its
+// liking; a dead backend behind a CDN shows up as the CDN's own error page
+// instead.
+func checkWebSocket(conn net.Conn, n *node, timeout time.Duration) error {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	path := n.Path
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	host := n.firstHostHeader()
+	if host == "" {
+		host = n.tlsServerName()
+	}
+
+	var key [16]byte
+	_, _ = rand.Read(key[:])
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"User-Agent: Mozilla/5.0\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + base64.StdEncoding.EncodeToString(key[:]) + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return fmt.Errorf("ws write: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return fmt.Errorf("ws read: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusSwitchingProtocols:
+		return nil
+	case http.StatusBadRequest, http.StatusNotFound:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if isCDNErrorPage(resp, body) {
+			return fmt.Errorf("ws: CDN error page (status %d)", resp.StatusCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("ws: unexpected status %d", resp.StatusCode)
+}
+
+// isCDNErrorPage reports whether a response was generated by a CDN edge
+// rather than by the proxied xray server. Xray answers with short plain-text
+// bodies; edges serve full HTML documents.
+func isCDNErrorPage(resp *http.Response, body []byte) bool {
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	l := strings.ToLower(string(body))
+	if strings.Contains(ct, "text/html") && strings.Contains(l, "<html") {
+		return true
+	}
+	return strings.Contains(l, "cloudflare") || strings.Contains(l, "cf-error")
+}
@@ -0,0 +1,155 @@
+package refiner
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProfileCfg describes the provider behind the exports. With Comments it
+// is written as a comment block in front of plain outputs, where clients
+// such as Hiddify and v2rayN pick up the profile-* lines; serve mode sends
+// it as response headers.
+type ProfileCfg struct {
+	Title          string        `yaml:"title"`
+	Maintainer     string        `yaml:"maintainer"`
+	Homepage       string        `yaml:"homepage"`
+	UpdateInterval time.Duration `yaml:"update_interval"`
+	Comments       *bool         `yaml:"comments"`
+	// Userinfo is announced as subscription-userinfo, for clients that
+	// show traffic and expiry.
+	Userinfo *UserinfoCfg `yaml:"userinfo"`
+}
+
+// UserinfoCfg is a traffic quota in bytes and its expiry.
+type UserinfoCfg struct {
+	Upload   int64     `yaml:"upload"`
+	Download int64     `yaml:"download"`
+	Total    int64     `yaml:"total"`
+	Expire   time.Time `yaml:"expire"`
+}
+
+// merge returns p with the non-zero fields of o applied on top.
+func (p ProfileCfg) merge(o ProfileCfg) ProfileCfg {
+	if o.Title != "" {
+		p.Title = o.Title
+	}
+	if o.Maintainer != "" {
+		p.Maintainer = o.Maintainer
+	}
+	if o.Homepage != "" {
+		p.Homepage = o.Homepage
+	}
+	if o.UpdateInterval > 0 {
+		p.UpdateInterval = o.UpdateInterval
+	}
+	if o.Comments != nil {
+		p.Comments = o.Comments
+	}
+	if o.Userinfo != nil {
+		p.Userinfo = o.Userinfo
+	}
+	return p
+}
+
+func (p ProfileCfg) check() error {
+	for _, f := range [][2]string{{"title", p.Title}, {"maintainer", p.Maintainer}, {"homepage", p.Homepage}} {
+		if strings.ContainsAny(f[1], "\r\n") {
+			return fmt.Errorf("profile.%s must be a single line", f[0])
+		}
+	}
+	if p.Homepage != "" {
+		if u, err := url.Parse(p.Homepage); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("profile.homepage must be an http(s) URL, got %q", p.Homepage)
+		}
+	}
+	if p.UpdateInterval < 0 {
+		return fmt.Errorf("profile.update_interval must not be negative, got %s", p.UpdateInterval)
+	}
+	if u := p.Userinfo; u != nil && (u.Upload < 0 || u.Download < 0 || u.Total < 0) {
+		return fmt.Errorf("profile.userinfo: traffic must not be negative")
+	}
+	return nil
+}
+
+// updateHours is UpdateInterval in whole hours, rounded up, as clients
+// expect in profile-update-interval; 0 when unset.
+func (p ProfileCfg) updateHours() int {
+	if p.UpdateInterval <= 0 {
+		return 0
+	}
+	return int((p.UpdateInterval + time.Hour - 1) / time.Hour)
+}
+
+// commentLines is the comment block of a plain output updated at stamp,
+// or nil when comments are off.
+func (p ProfileCfg) commentLines(stamp time.Time) []string {
+	if p.Comments == nil || !*p.Comments {
+		return nil
+	}
+	var out []string
+	if p.Title != "" {
+		out = append(out, "#profile-title: "+p.Title)
+	}
+	if h := p.updateHours(); h > 0 {
+		out = append(out, fmt.Sprintf("#profile-update-interval: %d", h))
+	}
+	if p.Homepage != "" {
+		out = append(out, "#profile-web-page-url: "+p.Homepage)
+	}
+	if p.Maintainer != "" {
+		out = append(out, "# maintainer: "+p.Maintainer)
+	}
+	return append(out, "# updated: "+stamp.UTC().Format(time.RFC3339))
+}
+
+// headers are the client hint headers of the profile.
+func (p ProfileCfg) headers() http.Header {
+	h := http.Header{}
+	if p.Title != "" {
+		// Base64 keeps non-ASCII titles intact in a header.
+		h.Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(p.Title)))
+	}
+	if n := p.updateHours(); n > 0 {
+		h.Set("Profile-Update-Interval", strconv.Itoa(n))
+	}
+	if p.Homepage != "" {
+		h.Set("Profile-Web-Page-Url", p.Homepage)
+	}
+	if u := p.Userinfo; u != nil {
+		v := fmt.Sprintf("upload=%d; download=%d; total=%d", u.Upload, u.Download, u.Total)
+		if !u.Expire.IsZero() {
+			v += fmt.Sprintf("; expire=%d", u.Expire.Unix())
+		}
+		h.Set("Subscription-Userinfo", v)
+	}
+	return h
+}
+
+// profileHeaders maps the export paths of every key, relative to outDir
+// and slash-separated, to the key's profile headers.
+func profileHeaders(cfg *Config, outDir string) map[string]http.Header {
+	out := map[string]http.Header{}
+	for _, sub := range append(cfg.Subscriptions, cfg.Locations...) {
+		h := cfg.Profile.merge(sub.Profile).headers()
+		if len(h) == 0 || sub.hidden {
+			continue
+		}
+		ec := exportCfgFor(cfg.Export, sub)
+		for _, o := range cfg.Outputs {
+			path, err := exportPath(outDir, ec, sub.Key, o)
+			if err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel(outDir, path); err == nil {
+				out[filepath.ToSlash(rel)] = h
+			}
+		}
+	}
+	return out
+}
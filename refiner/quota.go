@@ -0,0 +1,81 @@
+package refiner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseRatio turns protocol_ratio values ("60%" or 60) into fractions per
+// scheme. The shares may add up to less than 100%; the rest is left to
+// whichever nodes are newest.
+func parseRatio(raw map[string]string) (map[string]float64, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]float64, len(raw))
+	total := 0.0
+	for scheme, v := range raw {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "%"), 64)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("protocol_ratio %s: %q is not a percentage", scheme, v)
+		}
+		out[strings.ToLower(strings.TrimSpace(scheme))] = p / 100
+		total += p
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("protocol_ratio adds up to %g%%, more than 100%%", total)
+	}
+	return out, nil
+}
+
+// ratioTail picks n of lines like buildLiteTail, but gives each scheme in
+// ratio its share of the slots, newest first. Slots a scheme cannot fill
+// go to the newest remaining lines of any scheme. Original order is kept.
+func ratioTail(lines []string, n int, ratio map[string]float64) []string {
+	if n > len(lines) {
+		n = len(lines)
+	}
+	quota := make(map[string]int, len(ratio))
+	for s, f := range ratio {
+		quota[s] = int(f * float64(n))
+	}
+
+	picked := make([]bool, len(lines))
+	count := 0
+	for i := len(lines) - 1; i >= 0 && count < n; i-- {
+		s := schemeOf(lines[i])
+		if quota[s] > 0 {
+			quota[s]--
+			picked[i] = true
+			count++
+		}
+	}
+	for i := len(lines) - 1; i >= 0 && count < n; i-- {
+		if !picked[i] {
+			picked[i] = true
+			count++
+		}
+	}
+
+	idx := make([]int, 0, n)
+	for i, ok := range picked {
+		if ok {
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	out := make([]string, len(idx))
+	for j, i := range idx {
+		out[j] = lines[i]
+	}
+	return out
+}
+
+func schemeOf(line string) string {
+	if i := strings.Index(line, "://"); i > 0 {
+		return strings.ToLower(line[:i])
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package refiner
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// refineDefaults is the configuration refine uses when no config.yaml is
+// around.
+const refineDefaults = "allowed_schemes: [vless, vmess, trojan, ss]\n"
+
+// refineKey is the key a single refined source is processed under.
+const refineKey = "refined"
+
+// singleSource returns a copy of cfg that processes src alone under
+// refineKey, with no state, snapshots, reports or export layout.
+func singleSource(cfg *Config, src string) *Config {
+	c := *cfg
+	c.Subscriptions = []Subscription{{Key: refineKey, URL: src, Probe: c.Probe.ProbeLimits}}
+	c.Locations = nil
+	c.Export = ExportCfg{}
+	c.Snapshots = SnapshotCfg{}
+	c.State = StateCfg{}
+	c.Quarantine = QuarantineCfg{}
+	c.GraceRuns = 0
+	c.Reports = ReportCfg{}
+	return &c
+}
+
+// runRefine refines a single source and writes the result to stdout:
+//
+//	curl -s https://example.com/sub | xraysubrefiner refine - > sub.txt
+//
+// The source is "-" for stdin, a URL, or a file path. Settings other than
+// subscriptions, outputs, state and snapshots are taken from -config when
+// it exists.
+func runRefine(args []string) {
+	fs := flag.NewFlagSet("refine", flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yaml", "path to config.yaml (optional)")
+	format := fs.String("format", "base64", "base64 | plain")
+	timeout := fs.Duration("timeout", 20*time.Second, "HTTP client timeout")
+	noProbe := fs.Bool("no-probe", false, "export every valid node without probing")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: xraysubrefiner refine [flags] <url|file|->")
+		os.Exit(2)
+	}
+	if *format != "base64" && *format != "plain" {
+		must(fmt.Errorf("-format must be base64 or plain, got %q", *format))
+	}
+
+	cfg, err := LoadConfig(*cfgPath)
+	if errors.Is(err, os.ErrNotExist) {
+		cfg, err = ParseConfig([]byte(refineDefaults))
+	}
+	must(err)
+
+	if *noProbe {
+		off := false
+		cfg.Probe.Enabled = &off
+	}
+
+	out := OutputCfg{Name: refineKey, Format: *format, Sort: true}
+	cfg = singleSource(cfg, fs.Arg(0))
+	cfg.Outputs = []OutputCfg{out}
+
+	dir, err := cfg.Disk.mkdirTemp("xsr-refine-")
+	must(err)
+	defer os.RemoveAll(dir)
+
+	r, err := newRefiner(cfg, dir, *timeout, os.Stderr)
+	must(err)
+	r.progress = os.Stderr
+	must(r.run())
+
+	path, err := exportPath(dir, cfg.Export, refineKey, out)
+	must(err)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// No reachable nodes: an empty result, as with other outputs.
+		return
+	}
+	must(err)
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	must(err)
+}
+
+// readSource returns the raw body of a subscription source: stdin for "-",
+// a local file for file:// URLs and plain paths, and an HTTP fetch
+// otherwise. HTTP answers are checked for HTML pages against allowed, unless
+// it is nil.
+func (r *refiner) readSource(src string, allowed map[string]struct{}) ([]byte, error) {
+	switch {
+	case src == "-":
+		// Stdin can only be read once; later daemon runs reuse it.
+		if r.stdin == nil {
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, err
+			}
+			r.stdin = b
+		}
+		return r.stdin, nil
+	case strings.HasPrefix(src, "file://"):
+		return os.ReadFile(filepath.FromSlash(strings.TrimPrefix(src, "file://")))
+	case !strings.Contains(src, "://"):
+		return os.ReadFile(src)
+	}
+	return r.fetchSource(src, allowed)
+}
@@ -0,0 +1,112 @@
+package refiner
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rejection records why a line did not make it into the exports.
+type rejection struct {
+	Line   string `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Stage  string `json:"stage"`
+	Reason string `json:"reason"`
+}
+
+// rejects collects the rejections of one key for rejects.json (when keep
+// is set) and passes them on to obs. A nil *rejects discards everything.
+type rejects struct {
+	items []rejection
+	key   string
+	keep  bool
+	obs   Observer
+}
+
+func (r *rejects) add(line, stage, reason string) {
+	if r == nil {
+		return
+	}
+	if r.obs != nil {
+		r.obs.OnNodeRejected(RejectEvent{Key: r.key, Link: line, Stage: stage, Reason: reason})
+	}
+	if r.keep {
+		r.items = append(r.items, rejection{Line: line, ID: fingerprint(line), Stage: stage, Reason: reason})
+	}
+}
+
+// diff records every line of before missing from after.
+func (r *rejects) diff(before, after []string, stage, reason string) {
+	if r == nil {
+		return
+	}
+	kept := make(map[string]bool, len(after))
+	for _, l := range after {
+		kept[l] = true
+	}
+	for _, l := range before {
+		if !kept[l] {
+			r.add(l, stage, reason)
+		}
+	}
+}
+
+// dedupe returns dedupe(in) and records every repeated line with reason.
+func (r *rejects) dedupe(in []string, reason string) []string {
+	out := dedupe(in)
+	if r == nil || len(out) == len(in) {
+		return out
+	}
+	seen := make(map[string]bool, len(out))
+	for _, l := range in {
+		k := strings.TrimSpace(l)
+		if k == "" {
+			continue
+		}
+		if seen[k] {
+			r.add(k, "dedupe", reason)
+		}
+		seen[k] = true
+	}
+	return out
+}
+
+// probed records the results that are not exported, and lines left out of
+// probing entirely.
+func (r *rejects) probed(lines []string, results []probeResult) {
+	if r == nil {
+		return
+	}
+	seen := make(map[string]bool, len(results))
+	for _, res := range results {
+		seen[res.line] = true
+		if res.err != nil && !res.graced && !res.unverified {
+			r.add(res.line, "probe", res.err.Error())
+		}
+	}
+	for _, l := range lines {
+		if !seen[l] {
+			r.add(l, "probe", "not probed: over probe.max_nodes or outside this run's probe.slice")
+		}
+	}
+}
+
+// write stores the rejections as rejects.json in keyDir.
+func (r *rejects) write(keyDir string) error {
+	if r == nil || !r.keep {
+		return nil
+	}
+	if err := os.MkdirAll(keyDir, 0o755); err != nil {
+		return err
+	}
+	items := r.items
+	if items == nil {
+		items = []rejection{}
+	}
+	b, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(keyDir, "rejects.json"), b)
+}
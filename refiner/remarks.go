@@ -0,0 +1,125 @@
+package refiner
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemarksCfg drops nodes whose remark says they are dead or not a node at
+// all: an expiry date in the past (DropExpired), the built-in "traffic
+// exhausted" and advertisement patterns (Builtin), and any of Patterns.
+// AppendID adds each node's fingerprint to its exported remark; Template
+// rewrites exported remarks with the node's probe results.
+type RemarksCfg struct {
+	DropExpired bool     `yaml:"drop_expired"`
+	Builtin     bool     `yaml:"builtin"`
+	Patterns    []string `yaml:"patterns"`
+	AppendID    bool     `yaml:"append_id"`
+	Template    string   `yaml:"template"`
+
+	res []*regexp.Regexp
+}
+
+// builtinRemarkPatterns catch remarks of used-up nodes and filler entries
+// that only advertise a channel.
+var builtinRemarkPatterns = []string{
+	`(?i)traffic\s*(is\s*)?(exhausted|finished|used\s*up|over)`,
+	`(?i)\b(expired|out\s*of\s*(traffic|data))\b`,
+	`(?i)\b0(\.0+)?\s*(b|kb|mb|gb)\s*(left|remaining)\b`,
+	`حجم.{0,10}(تمام|اتمام)|منقضی`,
+	`(?i)^\W*(join|follow|subscribe)\b.{0,40}(@|t\.me/|telegram|channel)`,
+}
+
+// reExpiry finds "exp 2024-05-01"-style dates: an expiry keyword followed
+// by a year-first date.
+var reExpiry = regexp.MustCompile(`(?i)(?:exp(?:ires?|iry|ired|\.)?|valid\s*(?:until|till)|until|انقضا)\D{0,5}(\d{4})[-/.](\d{1,2})[-/.](\d{1,2})`)
+
+func (c *RemarksCfg) compile() error {
+	var pats []string
+	if c.Builtin {
+		pats = append(pats, builtinRemarkPatterns...)
+	}
+	for _, p := range append(pats, c.Patterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("remarks pattern %q: %w", p, err)
+		}
+		c.res = append(c.res, re)
+	}
+	return nil
+}
+
+func (c RemarksCfg) enabled() bool { return c.DropExpired || len(c.res) > 0 }
+
+// remarkVerdict returns why remark marks its node as unusable, or "".
+func (c RemarksCfg) remarkVerdict(remark string, now time.Time) string {
+	if remark == "" {
+		return ""
+	}
+	if c.DropExpired {
+		for _, m := range reExpiry.FindAllStringSubmatch(remark, -1) {
+			y, _ := strconv.Atoi(m[1])
+			mo, _ := strconv.Atoi(m[2])
+			d, _ := strconv.Atoi(m[3])
+			// Solar Hijri years (14xx) and invalid dates are left alone.
+			if y < 2000 || mo < 1 || mo > 12 || d < 1 || d > 31 {
+				continue
+			}
+			if exp := time.Date(y, time.Month(mo), d, 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1); exp.Before(now) {
+				return fmt.Sprintf("remark says it expired on %04d-%02d-%02d", y, mo, d)
+			}
+		}
+	}
+	for _, re := range c.res {
+		if re.MatchString(remark) {
+			return fmt.Sprintf("remark matches %q", re.String())
+		}
+	}
+	return ""
+}
+
+// filterRemarks drops lines whose remark is an expiry, exhaustion or
+// advertisement notice, recording them in rej.
+func filterRemarks(lines []string, c RemarksCfg, now time.Time, rej *rejects) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		n, err := parseNode(l)
+		if err == nil {
+			if why := c.remarkVerdict(n.Remark, now); why != "" {
+				rej.add(l, "remarks", why)
+				continue
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// applyRemarkTemplate rewrites the remark of every line with tmpl. {remark}
+// is the original remark, {id} the node ID, {latency} the connect time in
+// ms, and {jitter} (ms) and {loss} (%) come from probe.samples; values that
+// were not measured are left empty.
+func applyRemarkTemplate(lines []string, tmpl string, results map[string]*probeResult, sampled bool) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		var latency, jitter, loss string
+		if r := results[l]; r != nil && r.err == nil && !r.unprobed {
+			latency = strconv.FormatInt(r.latency.Milliseconds(), 10)
+			if sampled && !r.unverified {
+				jitter = strconv.FormatFloat(float64(r.jitter.Microseconds())/1000, 'f', 1, 64)
+				loss = strconv.FormatFloat(r.loss*100, 'f', 0, 64)
+			}
+		}
+		id := fingerprint(l)
+		out = append(out, withRemark(l, func(remark string) string {
+			return strings.TrimSpace(strings.NewReplacer(
+				"{remark}", remark, "{id}", id, "{latency}", latency,
+				"{jitter}", jitter, "{loss}", loss,
+			).Replace(tmpl))
+		}))
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package refiner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// renameState remembers when a key was renamed, so its old export paths
+// keep being written for state.rename_grace.
+type renameState struct {
+	To    string    `json:"to"`
+	Since time.Time `json:"since"`
+	// Retired is set once the grace period is over and the old outputs
+	// were removed.
+	Retired bool `json:"retired,omitempty"`
+}
+
+// migrate moves the history of sub's previous keys over to sub.Key and
+// records the renames. Nodes known under both keys keep the new history.
+func (st *runState) migrate(log io.Writer, sub Subscription, now time.Time) {
+	for _, old := range sub.PreviousKeys {
+		if ks, ok := st.Keys[old]; ok {
+			nks := st.key(sub.Key)
+			moved := 0
+			for line, ns := range ks.Nodes {
+				if _, ok := nks.Nodes[line]; !ok {
+					nks.Nodes[line] = ns
+					moved++
+				}
+			}
+			delete(st.Keys, old)
+			fmt.Fprintf(log, "Info: %s -> carried over history of %d nodes from %s\n", sub.Key, moved, old)
+		}
+		if st.Renames == nil {
+			st.Renames = map[string]*renameState{}
+		}
+		if rs := st.Renames[old]; rs == nil || rs.To != sub.Key {
+			st.Renames[old] = &renameState{To: sub.Key, Since: now}
+		}
+	}
+}
+
+// aliases returns the previous keys of key still within grace.
+func (st *runState) aliases(key string, now time.Time, grace time.Duration) []string {
+	var out []string
+	for old, rs := range st.Renames {
+		if rs.To == key && !rs.Retired && now.Sub(rs.Since) < grace {
+			out = append(out, old)
+		}
+	}
+	return out
+}
+
+// retireRenames removes the old outputs, sidecars and reports of renames
+// whose grace period ended, and the old key directory once it is empty.
+func (r *refiner) retireRenames(root string, st *runState, now time.Time) error {
+	for old, rs := range st.Renames {
+		if rs.Retired || now.Sub(rs.Since) < r.cfg.State.RenameGrace {
+			continue
+		}
+		var paths []string
+		for _, o := range r.cfg.Outputs {
+			sc := o
+			ext := sidecarExt
+			sc.Extension = &ext
+			for _, o := range []OutputCfg{o, sc} {
+				path, err := exportPath(root, r.cfg.Export, old, o)
+				if err != nil {
+					return err
+				}
+				paths = append(paths, path)
+			}
+		}
+		keyDir := filepath.Join(root, old)
+		for name := range reportFiles {
+			paths = append(paths, filepath.Join(keyDir, name))
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		// Left in place when other files are still in it.
+		_ = os.Remove(keyDir)
+		rs.Retired = true
+		fmt.Fprintf(r.log, "Info: %s -> rename grace over, removed the outputs and reports of %s\n", rs.To, old)
+	}
+	return nil
+}
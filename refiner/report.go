@@ -0,0 +1,159 @@
+package refiner
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+type nodeReport struct {
+	Line       string          `json:"line"`
+	ID         string          `json:"id,omitempty"`
+	Reachable  bool            `json:"reachable"`
+	Graced     bool            `json:"graced,omitempty"`
+	Unverified bool            `json:"unverified_alive,omitempty"`
+	Unprobed   bool            `json:"unprobed,omitempty"`
+	Vantage    map[string]bool `json:"vantage,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	LatencyMS  int64           `json:"latency_ms,omitempty"`
+	Mbps       float64         `json:"mbps,omitempty"`
+	JitterMS   float64         `json:"jitter_ms,omitempty"`
+	LossPct    float64         `json:"loss_pct,omitempty"`
+	Cert       *certInfo       `json:"cert,omitempty"`
+	TLSError   string          `json:"tls_error,omitempty"`
+	// SharedIP is the address (or subnet) the node shares with
+	// SharedHosts hosts, with shared_ips.
+	SharedIP    string `json:"shared_ip,omitempty"`
+	SharedHosts int    `json:"shared_hosts,omitempty"`
+}
+
+type keyReport struct {
+	Key         string           `json:"key"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	Credentials *credentialStats `json:"credentials,omitempty"`
+	ASNs        *asnStats        `json:"asns,omitempty"`
+	Nodes       []nodeReport     `json:"nodes"`
+}
+
+func buildKeyReport(key string, results []probeResult, now time.Time) keyReport {
+	rep := keyReport{Key: key, GeneratedAt: now, Nodes: make([]nodeReport, 0, len(results))}
+	for _, r := range results {
+		nr := nodeReport{
+			Line:       r.line,
+			ID:         fingerprint(r.line),
+			Reachable:  r.err == nil && !r.unprobed,
+			Graced:     r.graced,
+			Unverified: r.unverified,
+			Unprobed:   r.unprobed,
+			Vantage:    r.vantage,
+			LatencyMS:  r.latency.Milliseconds(),
+			Mbps:       r.mbps,
+			JitterMS:   float64(r.jitter.Microseconds()) / 1000,
+			LossPct:    r.loss * 100,
+			Cert:       r.cert,
+			TLSError:   r.tlsErr,
+		}
+		if r.err != nil {
+			nr.Error = r.err.Error()
+		}
+		rep.Nodes = append(rep.Nodes, nr)
+	}
+	return rep
+}
+
+// reportFiles are the reports written next to the exports of a key.
+var reportFiles = map[string]bool{
+	"report.json": true, "report.csv": true, "rejects.json": true, "manifest.json": true,
+}
+
+// sidecarExt replaces the output extension in the path of its sidecar.
+const sidecarExt = ".probe.json"
+
+// sidecarEntry is the probe result of one exported node in a sidecar.
+type sidecarEntry struct {
+	LatencyMS int64      `json:"latency_ms,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	Method    string     `json:"method"`
+	Graced    bool       `json:"graced,omitempty"`
+}
+
+// writeSidecar writes the probe results of an output's lines, keyed by
+// node ID, so downstream tools can rank them without probing again.
+func writeSidecar(path string, lines []string, results map[string]*probeResult) error {
+	out := make(map[string]sidecarEntry, len(lines))
+	for _, l := range lines {
+		id := fingerprint(l)
+		if id == "" {
+			continue
+		}
+		e := sidecarEntry{Method: "none"}
+		if r := results[l]; r != nil && !r.unprobed {
+			e = sidecarEntry{LatencyMS: r.latency.Milliseconds(), Method: r.method, Graced: r.graced}
+			if !r.checked.IsZero() {
+				e.CheckedAt = &r.checked
+			}
+		}
+		out[id] = e
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeReports writes the per-node probe report of a key as report.json
+// and/or report.csv into keyDir, as enabled in cfg.
+func writeReports(keyDir string, rep keyReport, cfg ReportCfg) error {
+	if !cfg.JSON && !cfg.CSV {
+		return nil
+	}
+
+	if cfg.JSON {
+		b, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(keyDir, "report.json"), b); err != nil {
+			return err
+		}
+	}
+	if cfg.CSV {
+		b, err := reportCSV(rep)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(keyDir, "report.csv"), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reportCSV(rep keyReport) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"line", "reachable", "error", "latency_ms",
+		"cert_subject", "cert_issuer", "cert_not_after", "cert_self_signed", "cert_sni_match", "unverified_alive", "unprobed", "mbps", "jitter_ms", "loss_pct", "id", "shared_ip", "shared_hosts", "tls_error"})
+	for _, n := range rep.Nodes {
+		row := []string{n.Line, strconv.FormatBool(n.Reachable), n.Error, strconv.FormatInt(n.LatencyMS, 10),
+			"", "", "", "", "",
+			strconv.FormatBool(n.Unverified), strconv.FormatBool(n.Unprobed),
+			strconv.FormatFloat(n.Mbps, 'f', 2, 64),
+			strconv.FormatFloat(n.JitterMS, 'f', 1, 64), strconv.FormatFloat(n.LossPct, 'f', 0, 64), n.ID,
+			n.SharedIP, strconv.Itoa(n.SharedHosts), n.TLSError}
+		if c := n.Cert; c != nil {
+			row[4] = c.Subject
+			row[5] = c.Issuer
+			row[6] = c.NotAfter.UTC().Format(time.RFC3339)
+			row[7] = strconv.FormatBool(c.SelfSigned)
+			row[8] = strconv.FormatBool(c.SNIMatch)
+		}
+		_ = w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,61 @@
+package refiner
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// resolveHosts looks up every distinct host once, with at most concurrency
+// lookups in flight, until ctx is done. IP literals are returned as-is;
+// hosts that fail to resolve are absent from the result.
+func resolveHosts(ctx context.Context, hosts []string, timeout time.Duration, concurrency int) map[string][]netip.Addr {
+	out := make(map[string][]netip.Addr, len(hosts))
+	var mu sync.Mutex
+
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	if concurrency <= 0 {
+		concurrency = 20
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range todo {
+				lctx, cancel := context.WithTimeout(ctx, timeout)
+				addrs, err := net.DefaultResolver.LookupNetIP(lctx, "ip", h)
+				cancel()
+				if err != nil || len(addrs) == 0 {
+					continue
+				}
+				for i, a := range addrs {
+					addrs[i] = a.Unmap()
+				}
+				mu.Lock()
+				out[h] = addrs
+				mu.Unlock()
+			}
+		}()
+	}
+
+	seen := make(map[string]struct{}, len(hosts))
+	for _, h := range hosts {
+		if _, ok := seen[h]; ok || h == "" {
+			continue
+		}
+		seen[h] = struct{}{}
+		if a, err := netip.ParseAddr(h); err == nil {
+			mu.Lock()
+			out[h] = []netip.Addr{a.Unmap()}
+			mu.Unlock()
+			continue
+		}
+		todo <- h
+	}
+	close(todo)
+	wg.Wait()
+	return out
+}
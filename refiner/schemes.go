@@ -0,0 +1,86 @@
+package refiner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// anyScheme in allowed_schemes lets every link through to validation.
+const anyScheme = "*"
+
+var reLinkScheme = regexp.MustCompile(`^([a-z][a-z0-9+.-]*)://`)
+
+// parseSchemes turns an allowed_schemes list into a set.
+func parseSchemes(list []string) (map[string]struct{}, error) {
+	set := make(map[string]struct{}, len(list))
+	for _, s := range list {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			return nil, fmt.Errorf("allowed_schemes contains an empty value")
+		}
+		if s != anyScheme && !reLinkScheme.MatchString(s+"://") {
+			return nil, fmt.Errorf("allowed_schemes: invalid scheme %q", s)
+		}
+		set[s] = struct{}{}
+	}
+	return set, nil
+}
+
+// schemeAllowed reports whether the lower-cased link l starts with an
+// allowed scheme.
+func schemeAllowed(allowed map[string]struct{}, l string) bool {
+	m := reLinkScheme.FindStringSubmatch(l)
+	if m == nil {
+		return false
+	}
+	if _, ok := allowed[anyScheme]; ok {
+		return true
+	}
+	_, ok := allowed[m[1]]
+	return ok
+}
+
+// parseAliases checks scheme_aliases and lower-cases it. Aliases map to
+// canonical schemes only, so no chains or loops are possible.
+func parseAliases(m map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(m))
+	for from, to := range m {
+		from, to = strings.ToLower(strings.TrimSpace(from)), strings.ToLower(strings.TrimSpace(to))
+		if !reLinkScheme.MatchString(from+"://") || !reLinkScheme.MatchString(to+"://") {
+			return nil, fmt.Errorf("scheme_aliases: invalid alias %q -> %q", from, to)
+		}
+		if from == to {
+			return nil, fmt.Errorf("scheme_aliases: %q maps to itself", from)
+		}
+		out[from] = to
+	}
+	for from, to := range out {
+		if _, ok := out[to]; ok {
+			return nil, fmt.Errorf("scheme_aliases: %q maps to %q, which is an alias itself", from, to)
+		}
+	}
+	return out, nil
+}
+
+// aliasScheme rewrites the lower-case scheme of link to its canonical
+// spelling, e.g. hy2:// to hysteria2://.
+func aliasScheme(link string, aliases map[string]string) string {
+	i := strings.Index(link, "://")
+	if i < 0 {
+		return link
+	}
+	if to, ok := aliases[link[:i]]; ok {
+		return to + link[i:]
+	}
+	return link
+}
+
+// allowedFor returns the scheme set of sub: its own allowed_schemes, or
+// the global one.
+func (r *refiner) allowedFor(sub Subscription) map[string]struct{} {
+	if sub.allowed != nil {
+		return sub.allowed
+	}
+	return r.allowed
+}
@@ -0,0 +1,37 @@
+package refiner
+
+import (
+	"strings"
+	"unicode"
+)
+
+// invisible reports whether r is a character that clients choke on: control
+// characters, zero-width spaces, byte order marks and bidi controls, which
+// links copied out of Telegram often carry. Tabs stay, as they separate
+// links. Other format characters stay too: Persian spelling needs the
+// zero-width non-joiner, and emoji sequences are built of the joiner and tag
+// characters.
+func invisible(r rune) bool {
+	switch {
+	case r == '\t':
+		return false
+	case r == unicode.ReplacementChar, r == '\u200b', r == '\ufeff':
+		return true
+	case r == '\u061c', r == '\u200e', r == '\u200f', r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+		return true
+	}
+	return unicode.Is(unicode.Cc, r)
+}
+
+// scrubText drops the invisible characters of s.
+func scrubText(s string) string {
+	if strings.IndexFunc(s, invisible) < 0 {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if invisible(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,114 @@
+package refiner
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotifier speaks systemd's notify protocol for Type=notify services:
+// READY once the daemon loop starts, STATUS with the outcome of each run,
+// and WATCHDOG pings when WatchdogSec is set. Pings stop when a run makes
+// no progress (no fetch, probe verdict or export) for the watchdog
+// interval, so systemd restarts a daemon stuck in a hung probe or fetch;
+// between runs it is always pinged. A nil *sdNotifier does nothing, as
+// outside systemd.
+type sdNotifier struct {
+	NopObserver
+
+	addr     *net.UnixAddr
+	watchdog time.Duration
+	running  atomic.Bool
+	last     atomic.Int64
+}
+
+// newSDNotifier returns the notifier of $NOTIFY_SOCKET, or nil.
+func newSDNotifier() *sdNotifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	n := &sdNotifier{addr: &net.UnixAddr{Name: path, Net: "unixgram"}}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n
+}
+
+// send writes one notify message; failures are only logged.
+func (n *sdNotifier) send(msg string) {
+	if n == nil {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err == nil {
+		_, err = conn.Write([]byte(msg))
+		conn.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!! sd_notify: %v\n", err)
+	}
+}
+
+func (n *sdNotifier) progress() { n.last.Store(time.Now().UnixNano()) }
+
+func (n *sdNotifier) OnFetch(FetchEvent)      { n.progress() }
+func (n *sdNotifier) OnNodeProbed(ProbeEvent) { n.progress() }
+func (n *sdNotifier) OnExport(ExportEvent)    { n.progress() }
+
+// begin and end bracket a run.
+func (n *sdNotifier) begin() {
+	if n == nil {
+		return
+	}
+	n.progress()
+	n.running.Store(true)
+	n.send("STATUS=run in progress")
+}
+
+func (n *sdNotifier) end(err error, next time.Time) {
+	if n == nil {
+		return
+	}
+	n.running.Store(false)
+	status := "last run ok"
+	if err != nil {
+		status = "last run failed: " + err.Error()
+	}
+	n.send(fmt.Sprintf("STATUS=%s, next run at %s", status, next.Format(time.TimeOnly)))
+}
+
+// ready tells systemd the daemon is up and starts the watchdog pings.
+func (n *sdNotifier) ready() {
+	if n == nil {
+		return
+	}
+	n.send("READY=1")
+	if n.watchdog <= 0 {
+		return
+	}
+	go func() {
+		stalled := false
+		for range time.Tick(n.watchdog / 2) {
+			idle := time.Since(time.Unix(0, n.last.Load()))
+			if n.running.Load() && idle >= n.watchdog {
+				if !stalled {
+					fmt.Fprintf(os.Stderr, "!! watchdog: run made no progress for %s, no longer pinging systemd\n", idle.Round(time.Second))
+					stalled = true
+				}
+				continue
+			}
+			stalled = false
+			n.send("WATCHDOG=1")
+		}
+	}()
+}
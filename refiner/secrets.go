@@ -0,0 +1,135 @@
+package refiner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// reSecretRef matches ${NAME} references in config values; $${ escapes a
+// literal "${".
+var reSecretRef = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveSecrets replaces ${NAME} in the string values of a config with
+// entries of its secrets_file, falling back to the environment, so
+// config.yaml can be published while tokens, webhook URLs and credentials
+// live elsewhere. The secrets file is a YAML map or, when named *.env or
+// .env, KEY=VALUE lines; relative paths are taken from dir. It returns the
+// rewritten config and any warnings.
+func resolveSecrets(b []byte, dir string) ([]byte, []string, error) {
+	if !bytes.Contains(b, []byte("${")) && !bytes.Contains(b, []byte("secrets_file")) {
+		return b, nil, nil
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, nil, err
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return b, nil, nil
+	}
+
+	var secrets map[string]string
+	var warnings []string
+	top := root.Content[0]
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		if top.Content[i].Value != "secrets_file" || top.Content[i+1].Value == "" {
+			continue
+		}
+		path := top.Content[i+1].Value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		var err error
+		if secrets, err = loadSecrets(path); err != nil {
+			return nil, nil, fmt.Errorf("secrets_file: %w", err)
+		}
+		if fi, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && fi.Mode().Perm()&0o004 != 0 {
+			warnings = append(warnings, fmt.Sprintf("secrets_file %s is readable by every user", path))
+		}
+	}
+
+	var missing []string
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Kind == yaml.ScalarNode {
+			if !strings.Contains(n.Value, "${") {
+				return
+			}
+			n.Value = reSecretRef.ReplaceAllStringFunc(n.Value, func(ref string) string {
+				if strings.HasPrefix(ref, "$$") {
+					return ref[1:]
+				}
+				name := ref[2 : len(ref)-1]
+				if v, ok := secrets[name]; ok {
+					return v
+				}
+				if v, ok := os.LookupEnv(name); ok {
+					return v
+				}
+				missing = append(missing, name)
+				return ref
+			})
+			// Let the value resolve like a literal of the same text would.
+			if n.Style == 0 {
+				n.Tag = ""
+			}
+			return
+		}
+		for i, c := range n.Content {
+			// Mapping keys are names, not values.
+			if n.Kind == yaml.MappingNode && i%2 == 0 {
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(&root)
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("config references undefined secrets: %s", strings.Join(missing, ", "))
+	}
+	out, err := yaml.Marshal(&root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, warnings, nil
+}
+
+// loadSecrets reads a secrets file: KEY=VALUE lines for .env files, a YAML
+// map of strings otherwise.
+func loadSecrets(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]string{}
+	if base := filepath.Base(path); base != ".env" && filepath.Ext(base) != ".env" {
+		if err := yaml.Unmarshal(b, &out); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return out, nil
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		out[strings.TrimSpace(k)] = v
+	}
+	return out, sc.Err()
+}
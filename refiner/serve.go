@@ -0,0 +1,342 @@
+package refiner
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ServeCfg configures the built-in subscription server. With TokensFile
+// set, subscriptions are only served under /sub/<token>/; AdminToken
+// enables the dashboard and the management API.
+type ServeCfg struct {
+	Listen     string `yaml:"listen"`
+	TokensFile string `yaml:"tokens_file"`
+	AdminToken string `yaml:"admin_token"`
+	// AccessLog appends one JSON line per subscription request.
+	AccessLog string `yaml:"access_log"`
+
+	RateLimit RateLimitCfg `yaml:"rate_limit"`
+	// CacheTTL keeps served files in memory this long before looking at
+	// the disk again.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// TrustProxy takes the client IP from CF-Connecting-IP ("cloudflare",
+	// believed from Cloudflare addresses only) or X-Forwarded-For
+	// ("forwarded", from TrustedProxies).
+	TrustProxy     string   `yaml:"trust_proxy"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	TLS ServeTLSCfg `yaml:"tls"`
+}
+
+// ServeTLSCfg terminates TLS with the Cert and Key files, or with
+// certificates obtained from Let's Encrypt for Domains. HTTPListen serves
+// ACME http-01 challenges and redirects plain HTTP to HTTPS; without it
+// only the tls-alpn-01 challenge on the TLS port is available.
+type ServeTLSCfg struct {
+	Cert       string   `yaml:"cert"`
+	Key        string   `yaml:"key"`
+	Domains    []string `yaml:"domains"`
+	Email      string   `yaml:"email"`
+	CacheDir   string   `yaml:"cache_dir"`
+	HTTPListen string   `yaml:"http_listen"`
+}
+
+// accessEntry is one line of the access log.
+type accessEntry struct {
+	Time   time.Time `json:"time"`
+	Token  string    `json:"token,omitempty"`
+	Path   string    `json:"path"`
+	Remote string    `json:"remote"`
+	Status int       `json:"status"`
+}
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// server serves the exports of a refiner that keeps refreshing them.
+type server struct {
+	cfg     ServeCfg
+	outDir  string
+	tokens  *tokenStore
+	limiter *rateLimiter
+	trusted []netip.Prefix
+
+	logMu   sync.Mutex
+	cacheMu sync.Mutex
+	cache   map[string]*cachedFile
+
+	status  *runStatus
+	refresh chan<- struct{}
+	// headers holds the profile headers per export path.
+	headers map[string]http.Header
+	deltas  *deltaStore
+}
+
+func newServer(cfg ServeCfg, outDir string) *server {
+	s := &server{cfg: cfg, outDir: outDir, limiter: newRateLimiter(cfg.RateLimit), cache: map[string]*cachedFile{}}
+	if cfg.TokensFile != "" {
+		s.tokens = &tokenStore{path: cfg.TokensFile}
+	}
+	for _, p := range cfg.TrustedProxies {
+		// Validated in parseConfig.
+		if pfx, err := parsePrefixOrAddr(p); err == nil {
+			s.trusted = append(s.trusted, pfx)
+		}
+	}
+	return s
+}
+
+// runServe refreshes the exports every -interval and serves them over HTTP:
+//
+//	xraysubrefiner serve -listen :8080 -interval 30m
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yaml", "path to config.yaml")
+	outDir := fs.String("out", "export", "output directory")
+	timeout := fs.Duration("timeout", 20*time.Second, "HTTP client timeout")
+	interval := fs.Duration("interval", time.Hour, "start a new run this often")
+	listen := fs.String("listen", "", "address to listen on (overrides serve.listen)")
+	strict := fs.Bool("strict", false, "treat config warnings as errors")
+	logTarget := fs.String("log", "stderr", "stderr | journald | syslog")
+	_ = fs.Parse(args)
+	must(setLogTarget(*logTarget))
+
+	cfg, err := LoadConfig(*cfgPath)
+	must(err)
+	must(cfg.checkWarnings(*strict))
+	if *listen != "" {
+		cfg.Serve.Listen = *listen
+	}
+
+	srv := newServer(cfg.Serve, *outDir)
+	srv.headers = profileHeaders(cfg, *outDir)
+	srv.deltas = &deltaStore{}
+
+	r, err := newRefiner(cfg, *outDir, *timeout, os.Stderr)
+	must(err)
+	refresh := make(chan struct{}, 1)
+	r.status, r.refresh = &runStatus{}, refresh
+	r.obs = append(r.obs, r.status, srv.deltas)
+	srv.status, srv.refresh = r.status, refresh
+	hs := &http.Server{
+		Addr:              cfg.Serve.Listen,
+		Handler:           srv.limit(srv.routes()),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    16 << 10,
+	}
+	tc := cfg.Serve.TLS
+	var m *autocert.Manager
+	switch {
+	case tc.Cert != "":
+		// Loaded before run_as applies, so the key may stay readable by
+		// root only.
+		cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+		must(err)
+		hs.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case len(tc.Domains) > 0:
+		m = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(tc.Domains...),
+			Cache:      autocert.DirCache(tc.CacheDir),
+			Email:      tc.Email,
+		}
+		hs.TLSConfig = m.TLSConfig()
+	}
+	// Listen before dropping privileges: the ports may be below 1024.
+	ln, err := net.Listen("tcp", cfg.Serve.Listen)
+	must(err)
+	var lnHTTP net.Listener
+	if m != nil && tc.HTTPListen != "" {
+		lnHTTP, err = net.Listen("tcp", tc.HTTPListen)
+		must(err)
+	}
+	must(r.dropPrivileges())
+	go r.daemon(*interval)
+
+	switch {
+	case tc.Cert != "":
+		fmt.Fprintf(os.Stderr, "Info: serving %s on %s (TLS)\n", *outDir, cfg.Serve.Listen)
+		log.Fatal(hs.ServeTLS(ln, "", ""))
+	case m != nil:
+		if lnHTTP != nil {
+			go func() {
+				hr := &http.Server{Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+				log.Fatal(hr.Serve(lnHTTP))
+			}()
+		}
+		fmt.Fprintf(os.Stderr, "Info: serving %s on %s (TLS for %s)\n", *outDir, cfg.Serve.Listen, strings.Join(tc.Domains, ", "))
+		log.Fatal(hs.ServeTLS(ln, "", ""))
+	default:
+		fmt.Fprintf(os.Stderr, "Info: serving %s on %s\n", *outDir, cfg.Serve.Listen)
+		log.Fatal(hs.Serve(ln))
+	}
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	if s.tokens != nil {
+		mux.HandleFunc("GET /sub/{token}/{path...}", func(w http.ResponseWriter, req *http.Request) {
+			tok := s.tokens.lookup(req.PathValue("token"))
+			if tok == nil {
+				s.logAccess(req, "", req.PathValue("path"), http.StatusNotFound)
+				http.NotFound(w, req)
+				return
+			}
+			s.serveExport(w, req, tok.Name, req.PathValue("path"))
+		})
+	} else {
+		mux.HandleFunc("GET /sub/{path...}", func(w http.ResponseWriter, req *http.Request) {
+			s.serveExport(w, req, "", req.PathValue("path"))
+		})
+	}
+	if s.cfg.AdminToken != "" {
+		mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write(dashboardHTML)
+		})
+		mux.HandleFunc("GET /api/status", s.admin(func(w http.ResponseWriter, req *http.Request) {
+			writeJSON(w, http.StatusOK, s.status.report())
+		}))
+		mux.HandleFunc("POST /api/refresh", s.admin(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case s.refresh <- struct{}{}:
+			default: // a refresh is already pending
+			}
+			writeJSON(w, http.StatusAccepted, map[string]bool{"queued": true})
+		}))
+	}
+	if s.cfg.AdminToken != "" && s.tokens != nil {
+		mux.HandleFunc("GET /api/tokens", s.admin(func(w http.ResponseWriter, req *http.Request) {
+			tokens, err := s.tokens.list()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, tokens)
+		}))
+		mux.HandleFunc("POST /api/tokens", s.admin(func(w http.ResponseWriter, req *http.Request) {
+			var body struct {
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<16)).Decode(&body); err != nil || body.Name == "" {
+				http.Error(w, "expected {\"name\": ...}", http.StatusBadRequest)
+				return
+			}
+			tok, err := s.tokens.create(body.Name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, tok)
+		}))
+		mux.HandleFunc("DELETE /api/tokens/{ref}", s.admin(func(w http.ResponseWriter, req *http.Request) {
+			n, err := s.tokens.revoke(req.PathValue("ref"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"revoked": n})
+		}))
+	}
+	return mux
+}
+
+// admin requires the admin bearer token.
+func (s *server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !s.isAdmin(req) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// isAdmin reports whether req carries the admin bearer token.
+func (s *server) isAdmin(req *http.Request) bool {
+	if s.cfg.AdminToken == "" {
+		return false
+	}
+	want := "Bearer " + s.cfg.AdminToken
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// serveExport serves one export file. Directories, paths leaving the
+// output directory and, without the admin token, the reports (which carry
+// source URLs and dropped lines) are not found.
+func (s *server) serveExport(w http.ResponseWriter, req *http.Request, token, name string) {
+	if !fs.ValidPath(name) || reportFiles[path.Base(name)] && !s.isAdmin(req) {
+		s.logAccess(req, token, name, http.StatusNotFound)
+		http.NotFound(w, req)
+		return
+	}
+	if s.serveDelta(w, req, token, name) {
+		return
+	}
+	f, err := s.file(name, time.Now())
+	if err != nil {
+		s.logAccess(req, token, name, http.StatusNotFound)
+		http.NotFound(w, req)
+		return
+	}
+	if path.Ext(name) == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	for k, v := range s.headers[name] {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", f.etag)
+	s.logAccess(req, token, name, http.StatusOK)
+	http.ServeContent(w, req, name, f.mod, f.reader())
+}
+
+func (s *server) logAccess(req *http.Request, token, name string, status int) {
+	who := token
+	if who == "" {
+		who = "-"
+	}
+	remote := s.clientIP(req)
+	fmt.Fprintf(os.Stderr, "Info: serve: %s %s %s -> %d\n", who, remote, name, status)
+	if s.cfg.AccessLog == "" {
+		return
+	}
+	b, err := json.Marshal(accessEntry{Time: time.Now().UTC(), Token: token, Path: name, Remote: remote, Status: status})
+	if err != nil {
+		return
+	}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	f, err := os.OpenFile(s.cfg.AccessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!! access log: %v\n", err)
+		return
+	}
+	defer f.Close()
+	_, _ = f.Write(append(b, '\n'))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
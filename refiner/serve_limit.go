@@ -0,0 +1,193 @@
+package refiner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitCfg allows each client IP Requests per Per, in bursts of up to
+// Requests.
+type RateLimitCfg struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+}
+
+// rateLimiter is a token bucket per client IP.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(c RateLimitCfg) *rateLimiter {
+	if c.Requests <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    float64(c.Requests) / c.Per.Seconds(),
+		burst:   float64(c.Requests),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow takes a token for ip, or returns how long until one is available.
+func (l *rateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Full buckets carry no information; drop them now and then so the
+	// map does not grow with every address ever seen.
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b := l.buckets[ip]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// clientIP is the address the request came from. Proxy headers are only
+// believed from the proxies trust_proxy names.
+func (s *server) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	peer = peer.Unmap()
+	switch s.cfg.TrustProxy {
+	case "cloudflare":
+		if isCloudflareAddr(peer) {
+			if a, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get("CF-Connecting-IP"))); err == nil {
+				return a.Unmap().String()
+			}
+		}
+	case "forwarded":
+		if inPrefixes([]netip.Addr{peer}, s.trusted) {
+			// The last hop not added by a trusted proxy is the client.
+			hops := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				a, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+				if err != nil {
+					break
+				}
+				if a = a.Unmap(); !inPrefixes([]netip.Addr{a}, s.trusted) || i == 0 {
+					return a.String()
+				}
+			}
+		}
+	}
+	return peer.String()
+}
+
+// limit rejects clients over the rate limit with 429.
+func (s *server) limit(h http.Handler) http.Handler {
+	if s.limiter == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ok, wait := s.limiter.allow(s.clientIP(req), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// cachedFile is an export held in memory, checked against the disk again
+// after cache_ttl.
+type cachedFile struct {
+	body    []byte
+	mod     time.Time
+	etag    string
+	checked time.Time
+}
+
+// file returns name from the output directory, from memory while the
+// cached copy is younger than cache_ttl or unchanged on disk.
+func (s *server) file(name string, now time.Time) (*cachedFile, error) {
+	s.cacheMu.Lock()
+	c := s.cache[name]
+	s.cacheMu.Unlock()
+	if c != nil && now.Sub(c.checked) < s.cfg.CacheTTL {
+		return c, nil
+	}
+
+	fsys := os.DirFS(s.outDir)
+	fi, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+	if c == nil || !fi.ModTime().Equal(c.mod) || int64(len(c.body)) != fi.Size() {
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(body)
+		c = &cachedFile{body: body, mod: fi.ModTime(), etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+	} else {
+		cp := *c
+		c = &cp
+	}
+	c.checked = now
+	if s.cfg.CacheTTL > 0 {
+		s.cacheMu.Lock()
+		s.cache[name] = c
+		s.cacheMu.Unlock()
+	}
+	return c, nil
+}
+
+func (c *cachedFile) reader() *bytes.Reader { return bytes.NewReader(c.body) }
+
+// parsePrefixOrAddr accepts a CIDR or a single address.
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package refiner
+
+import "errors"
+
+func manageService(string, bool) error {
+	return errors.New("-install-service and -uninstall-service are only available on Windows")
+}
+
+func serviceMode() bool { return false }
+
+func runService(string, func()) error { return nil }
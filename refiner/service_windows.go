@@ -0,0 +1,120 @@
+//go:build windows
+
+package refiner
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceFlags are the flags that manage the service rather than being
+// passed to it.
+var serviceFlags = map[string]bool{"install-service": true, "uninstall-service": true}
+
+// manageService installs or removes the Windows service name. An installed
+// service starts automatically and runs the daemon with the flags of this
+// invocation; -config and -out are made absolute, as services start in
+// System32. Windows restarts it when it fails.
+func manageService(name string, install bool) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if !install {
+		s, err := m.OpenService(name)
+		if err != nil {
+			return fmt.Errorf("service %s: %w", name, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Info: service %s removed\n", name)
+		return nil
+	}
+
+	if f := flag.Lookup("interval"); f == nil || f.Value.String() == "0s" {
+		return errors.New("-install-service needs -interval: the service runs the daemon")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if serviceFlags[f.Name] || f.Name == "config" || f.Name == "out" {
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	for _, f := range []string{"config", "out"} {
+		p, err := filepath.Abs(flag.Lookup(f).Value.String())
+		if err != nil {
+			return err
+		}
+		args = append(args, "-"+f+"="+p)
+	}
+
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists; remove it with -uninstall-service first", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "Xray subscription refiner",
+		Description: "Refreshes the refined Xray subscriptions on an interval.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: time.Minute}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 24*60*60); err != nil {
+		fmt.Fprintf(os.Stderr, "!! service %s: recovery actions: %v\n", name, err)
+	}
+	fmt.Fprintf(os.Stderr, "Info: service %s installed, start it with: sc start %s\n", name, name)
+	return nil
+}
+
+// serviceMode reports whether the process was started by the service
+// control manager.
+func serviceMode() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService runs daemon as the service name until it is stopped.
+func runService(name string, daemon func()) error {
+	return svc.Run(name, serviceHandler{daemon})
+}
+
+type serviceHandler struct {
+	daemon func()
+}
+
+// Execute starts the daemon and waits for stop or shutdown. An export in
+// progress is abandoned; staged exports keep the published files whole.
+func (h serviceHandler) Execute(_ []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go h.daemon()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for c := range req {
+		switch c.Cmd {
+		case svc.Interrogate:
+			status <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
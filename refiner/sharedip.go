@@ -0,0 +1,234 @@
+package refiner
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"time"
+)
+
+// SharedIPsCfg finds reachable nodes whose different hosts resolve to one
+// address, or one subnet with prefix_v4/prefix_v6: however many domains
+// point there, it is one server and they all go down together. Such nodes
+// are marked in the reports, and with max_per_ip only the fastest of each
+// address are exported across all keys. CDN edges front many domains
+// without being one server: Cloudflare's ranges, the Exempt prefixes and,
+// with an asn.source table, the ExemptASNs are never grouped.
+type SharedIPsCfg struct {
+	Enabled    bool     `yaml:"enabled"`
+	MinHosts   int      `yaml:"min_hosts"`
+	PrefixV4   int      `yaml:"prefix_v4"`
+	PrefixV6   int      `yaml:"prefix_v6"`
+	MaxPerIP   int      `yaml:"max_per_ip"`
+	Exempt     []string `yaml:"exempt"`
+	ExemptASNs []uint32 `yaml:"exempt_asns"`
+}
+
+// cdnASNs are the default exempt_asns: Cloudflare, Fastly, Akamai and
+// Gcore. CloudFront shares AS16509 with all of EC2, so its ranges belong in
+// exempt instead.
+var cdnASNs = []uint32{13335, 209242, 54113, 20940, 16625, 199524}
+
+func (c SharedIPsCfg) check() error {
+	switch {
+	case c.MinHosts < 0 || c.MaxPerIP < 0:
+		return fmt.Errorf("shared_ips: min_hosts and max_per_ip must not be negative")
+	case c.PrefixV4 < 0 || c.PrefixV4 > 32:
+		return fmt.Errorf("shared_ips.prefix_v4 must be between 0 and 32, got %d", c.PrefixV4)
+	case c.PrefixV6 < 0 || c.PrefixV6 > 128:
+		return fmt.Errorf("shared_ips.prefix_v6 must be between 0 and 128, got %d", c.PrefixV6)
+	case c.MaxPerIP > 0 && !c.Enabled:
+		return fmt.Errorf("shared_ips.max_per_ip needs shared_ips.enabled")
+	}
+	for _, p := range c.Exempt {
+		if _, err := parsePrefixOrAddr(p); err != nil {
+			return fmt.Errorf("shared_ips.exempt: %w", err)
+		}
+	}
+	return nil
+}
+
+// sharedGroup is one address or subnet that at least min_hosts hosts
+// resolve to. keep holds the nodes within max_per_ip; it is nil without a
+// cap.
+type sharedGroup struct {
+	prefix netip.Prefix
+	hosts  int
+	nodes  int
+	keep   map[string]bool
+}
+
+// sharedIPs maps the reachable nodes of a run that sit on a shared address
+// to their group. A nil *sharedIPs marks and drops nothing.
+type sharedIPs struct {
+	byLine map[string]*sharedGroup
+}
+
+// findSharedIPs resolves the hosts of the reachable nodes of every key in
+// done and groups them by address, the smallest of each host so a group
+// does not change with the order resolvers answer in. CDN addresses are
+// left out.
+func (r *refiner) findSharedIPs(done map[string]refinedKey) *sharedIPs {
+	c := r.cfg.SharedIPs
+	keys := make([]string, 0, len(done))
+	for k := range done {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// rank orders the nodes of a group for max_per_ip: verified ones by
+	// latency, then the rest.
+	rank := map[string]time.Duration{}
+	hostOf := map[string]string{}
+	var lines, hosts []string
+	for _, k := range keys {
+		byLine := resultsByLine(done[k].results)
+		for _, l := range done[k].reachable {
+			if _, seen := hostOf[l]; seen {
+				continue
+			}
+			n, err := parseNode(l)
+			if err != nil || n.Host == "" {
+				continue
+			}
+			hostOf[l] = n.Host
+			lines = append(lines, l)
+			hosts = append(hosts, n.Host)
+			rank[l] = time.Duration(1<<63 - 1)
+			if res := byLine[l]; res != nil && res.err == nil && !res.unprobed && res.latency > 0 {
+				rank[l] = res.latency
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	resolved := resolveHosts(r.ctx, hosts, r.cfg.Probe.Timeout, 20)
+	exempt := r.cdnAddr()
+
+	members := map[netip.Prefix][]string{}
+	hostsOf := map[netip.Prefix]map[string]bool{}
+	for _, l := range lines {
+		h := hostOf[l]
+		addrs := resolved[h]
+		if len(addrs) == 0 {
+			continue
+		}
+		a := slices.MinFunc(addrs, netip.Addr.Compare)
+		if exempt(a) {
+			continue
+		}
+		bits := c.PrefixV6
+		if a.Is4() {
+			bits = c.PrefixV4
+		}
+		p, err := a.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if hostsOf[p] == nil {
+			hostsOf[p] = map[string]bool{}
+		}
+		hostsOf[p][h] = true
+		members[p] = append(members[p], l)
+	}
+
+	s := &sharedIPs{byLine: map[string]*sharedGroup{}}
+	var found []*sharedGroup
+	for p, hs := range hostsOf {
+		if len(hs) < c.MinHosts {
+			continue
+		}
+		g := &sharedGroup{prefix: p, hosts: len(hs), nodes: len(members[p])}
+		ms := members[p]
+		if c.MaxPerIP > 0 && len(ms) > c.MaxPerIP {
+			sort.SliceStable(ms, func(i, j int) bool { return rank[ms[i]] < rank[ms[j]] })
+			g.keep = make(map[string]bool, c.MaxPerIP)
+			for _, l := range ms[:c.MaxPerIP] {
+				g.keep[l] = true
+			}
+		}
+		for _, l := range ms {
+			s.byLine[l] = g
+		}
+		found = append(found, g)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].hosts != found[j].hosts {
+			return found[i].hosts > found[j].hosts
+		}
+		return found[i].prefix.String() < found[j].prefix.String()
+	})
+	for _, g := range found {
+		fmt.Fprintf(r.log, "Info: shared IPs -> %d hosts (%d reachable nodes) resolve to %s\n", g.hosts, g.nodes, g.label())
+	}
+	return s
+}
+
+// cdnAddr returns whether an address belongs to a CDN exempt from
+// shared_ips.
+func (r *refiner) cdnAddr() func(netip.Addr) bool {
+	c := r.cfg.SharedIPs
+	prefixes := append([]netip.Prefix(nil), cloudflareRanges...)
+	for _, s := range c.Exempt {
+		if p, err := parsePrefixOrAddr(s); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	asns := make(map[uint32]bool, len(c.ExemptASNs))
+	for _, n := range c.ExemptASNs {
+		asns[n] = true
+	}
+	return func(a netip.Addr) bool {
+		for _, p := range prefixes {
+			if p.Contains(a) {
+				return true
+			}
+		}
+		if ar, ok := r.asns.lookup(a); ok && asns[ar.asn] {
+			return true
+		}
+		return false
+	}
+}
+
+// label is the address of g, or its subnet when grouped by one.
+func (g *sharedGroup) label() string {
+	if g.prefix.IsSingleIP() {
+		return g.prefix.Addr().String()
+	}
+	return g.prefix.String()
+}
+
+func (s *sharedIPs) of(line string) *sharedGroup {
+	if s == nil {
+		return nil
+	}
+	return s.byLine[line]
+}
+
+// limit drops the nodes of lines over max_per_ip on their address.
+func (s *sharedIPs) limit(lines []string) ([]string, int) {
+	if s == nil {
+		return lines, 0
+	}
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if g := s.byLine[l]; g != nil && g.keep != nil && !g.keep[l] {
+			continue
+		}
+		out = append(out, l)
+	}
+	return out, len(lines) - len(out)
+}
+
+// annotate marks the nodes of rep that sit on a shared address.
+func (s *sharedIPs) annotate(rep *keyReport) {
+	for i := range rep.Nodes {
+		if g := s.of(rep.Nodes[i].Line); g != nil {
+			rep.Nodes[i].SharedIP = g.label()
+			rep.Nodes[i].SharedHosts = g.hosts
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package refiner
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"time"
+)
+
+// sliceState is where the time-sliced probing of one key stands: the
+// window offset into its pool and the nodes found reachable, by line, so
+// they are exported between their checks.
+type sliceState struct {
+	Offset int                  `json:"offset"`
+	Good   map[string]sliceGood `json:"good,omitempty"`
+}
+
+type sliceGood struct {
+	Latency time.Duration `json:"latency"`
+	Checked time.Time     `json:"checked"`
+}
+
+// sliceRecheck divides a slice: up to size/sliceRecheck of it re-checks
+// nodes found reachable earlier, oldest check first, so dead ones leave the
+// export within a few runs; the rest probes the next window of the pool.
+const sliceRecheck = 2
+
+// probeSlice probes at most size of lines, as probe.slice asks for keys too
+// large to probe in one run: up to half re-checks reachable nodes, the rest
+// walks a window through lines in a stable order that a feed reordering its
+// links does not shift. Reachable nodes outside this run's slice are
+// exported with their last result. It returns the results in the order of
+// lines.
+func probeSlice(log io.Writer, key string, lines []string, size int, ss *sliceState, now time.Time, probe func([]string) []probeResult) []probeResult {
+	present := make(map[string]bool, len(lines))
+	for _, l := range lines {
+		present[l] = true
+	}
+	if ss.Good == nil {
+		ss.Good = map[string]sliceGood{}
+	}
+	for l := range ss.Good {
+		if !present[l] {
+			delete(ss.Good, l)
+		}
+	}
+
+	good := make([]string, 0, len(ss.Good))
+	for l := range ss.Good {
+		good = append(good, l)
+	}
+	sort.Slice(good, func(i, j int) bool {
+		a, b := ss.Good[good[i]].Checked, ss.Good[good[j]].Checked
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return good[i] < good[j]
+	})
+	recheck := good[:min(len(good), size/sliceRecheck)]
+	picked := make(map[string]bool, size)
+	for _, l := range recheck {
+		picked[l] = true
+	}
+
+	// The window walks the whole pool, passing over the re-checked nodes.
+	pool := append([]string(nil), lines...)
+	sort.Slice(pool, func(i, j int) bool { return sliceRank(pool[i]) < sliceRank(pool[j]) })
+	from := ss.Offset % len(pool)
+	n, walked := 0, 0
+	for ; walked < len(pool) && len(recheck)+n < size; walked++ {
+		if l := pool[(from+walked)%len(pool)]; !picked[l] {
+			picked[l] = true
+			n++
+		}
+	}
+	ss.Offset = (from + walked) % len(pool)
+	fmt.Fprintf(log, "Info: %s -> probing a slice of %d of %d nodes: %d re-checks, %d from offset %d\n",
+		key, len(recheck)+n, len(lines), len(recheck), n, from)
+
+	var batch []string
+	for _, l := range lines {
+		if picked[l] {
+			batch = append(batch, l)
+		}
+	}
+	byLine := make(map[string]probeResult, len(batch))
+	for _, res := range probe(batch) {
+		byLine[res.line] = res
+		if res.err == nil {
+			ss.Good[res.line] = sliceGood{Latency: res.latency, Checked: now}
+		} else {
+			delete(ss.Good, res.line)
+		}
+	}
+
+	out := make([]probeResult, 0, len(batch)+len(ss.Good))
+	reused := 0
+	for _, l := range lines {
+		if res, ok := byLine[l]; ok {
+			out = append(out, res)
+		} else if g, ok := ss.Good[l]; ok {
+			out = append(out, probeResult{line: l, latency: g.Latency, checked: g.Checked})
+			reused++
+		}
+	}
+	if reused > 0 {
+		fmt.Fprintf(log, "Info: %s -> reusing %d reachable results of earlier slices\n", key, reused)
+	}
+	return out
+}
+
+// sliceRank orders a pool by a hash of each line.
+func sliceRank(line string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return h.Sum64()
+}
+
+// sliceState returns the slice state of key: in the state file when
+// state.path is set, else in memory for the life of the process.
+func (r *refiner) sliceState(st *runState, key string) *sliceState {
+	m := r.slices
+	if r.cfg.State.Path != "" {
+		if st.Slices == nil {
+			st.Slices = map[string]*sliceState{}
+		}
+		m = st.Slices
+	}
+	ss := m[key]
+	if ss == nil {
+		ss = &sliceState{}
+		m[key] = ss
+	}
+	return ss
+}
@@ -0,0 +1,72 @@
+package refiner
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshotLayout is RFC 3339 in UTC with the colons replaced, since ':' is
+// not allowed in Windows file names.
+const snapshotLayout = "2006-01-02T15-04-05Z"
+
+const snapshotsDir = "snapshots"
+
+type SnapshotCfg struct {
+	Enabled bool          `yaml:"enabled"`
+	Keep    int           `yaml:"keep"`
+	MaxAge  time.Duration `yaml:"max_age"`
+}
+
+// writeSnapshot copies the export tree under root (minus older snapshots)
+// into root/snapshots/<timestamp> and applies the retention policy.
+func writeSnapshot(root string, cfg SnapshotCfg, now time.Time) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	base := filepath.Join(root, snapshotsDir)
+	dst := filepath.Join(base, now.UTC().Format(snapshotLayout))
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := copyTree(root, dst, snapshotsDir); err != nil {
+		return err
+	}
+	return pruneSnapshots(base, cfg, now)
+}
+
+func pruneSnapshots(base string, cfg SnapshotCfg, now time.Time) error {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		t, err := time.Parse(snapshotLayout, e.Name())
+		if err != nil {
+			continue
+		}
+		if cfg.MaxAge > 0 && now.Sub(t) > cfg.MaxAge {
+			if err := os.RemoveAll(filepath.Join(base, e.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	if cfg.Keep <= 0 {
+		return nil
+	}
+	sort.Strings(names)
+	for len(names) > cfg.Keep {
+		if err := os.RemoveAll(filepath.Join(base, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
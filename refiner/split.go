@@ -0,0 +1,135 @@
+package refiner
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// SplitCfg lists the separators feeds put between links on one line. A
+// separator only ends a link where another link follows it, so commas in
+// alpn lists and pipes in remarks survive. "<br>" stands for every spelling
+// of the HTML line break.
+type SplitCfg struct {
+	Separators []string `yaml:"separators"`
+}
+
+var defaultSeparators = []string{"|", ",", "\t", " ", "<br>"}
+
+// validatedSchemes are the schemes with a link validator; they are
+// recognised inside runs of letters when links are glued together.
+var validatedSchemes = []string{"vless", "vmess", "trojan", "ss", "tuic", "hysteria2", "hy2", "hysteria"}
+
+var (
+	reHTMLBreak  = regexp.MustCompile(`(?i)<br\s*/?>`)
+	reHTMLEntity = regexp.MustCompile(`&(?:amp|lt|gt|quot|apos|nbsp|#[0-9]{1,6}|#[xX][0-9a-fA-F]{1,6});`)
+)
+
+// splitPossible splits a line into links. Links start at every "://",
+// with the scheme taken back to the last non-scheme character, or to the
+// longest known scheme when they are glued to the previous one
+// ("...#namevless://"). Separators and whitespace around them are trimmed.
+// HTML entities (&amp; in queries of links copied from web pages) are
+// decoded first.
+func splitPossible(s string, seps []string, allowed map[string]struct{}, aliases map[string]string) []string {
+	s = reHTMLEntity.ReplaceAllStringFunc(s, html.UnescapeString)
+	s = reHTMLBreak.ReplaceAllString(s, "<br>")
+	if strings.Count(s, "://") <= 1 {
+		return []string{trimSeparators(s, seps)}
+	}
+
+	var starts []int
+	for i := 0; ; {
+		j := strings.Index(s[i:], "://")
+		if j < 0 {
+			break
+		}
+		end := i + j
+		start := end
+		for start > 0 && isSchemeChar(s[start-1]) {
+			start--
+		}
+		start = schemeStart(s[start:end], start, allowed, aliases)
+		if start < end && (len(starts) == 0 || start > starts[len(starts)-1]) {
+			starts = append(starts, start)
+		}
+		i = end + 3
+	}
+
+	var parts []string
+	if len(starts) == 0 || starts[0] > 0 {
+		first := len(s)
+		if len(starts) > 0 {
+			first = starts[0]
+		}
+		if p := trimSeparators(s[:first], seps); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	for k, start := range starts {
+		end := len(s)
+		if k+1 < len(starts) {
+			end = starts[k+1]
+		}
+		if p := trimSeparators(s[start:end], seps); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// schemeStart returns where the scheme in run (starting at offset) begins:
+// at the longest known scheme ending the run, otherwise at its first letter.
+func schemeStart(run string, offset int, allowed map[string]struct{}, aliases map[string]string) int {
+	l := strings.ToLower(run)
+	best := ""
+	try := func(sch string) {
+		if len(sch) > len(best) && strings.HasSuffix(l, sch) {
+			best = sch
+		}
+	}
+	for _, sch := range validatedSchemes {
+		try(sch)
+	}
+	for sch := range allowed {
+		if sch != anyScheme {
+			try(sch)
+		}
+	}
+	for sch := range aliases {
+		try(sch)
+	}
+	if best != "" {
+		return offset + len(run) - len(best)
+	}
+	i := 0
+	for i < len(run) && !isLetter(run[i]) {
+		i++
+	}
+	return offset + i
+}
+
+// trimSeparators strips whitespace and separators from both ends of s.
+func trimSeparators(s string, seps []string) string {
+	for {
+		t := strings.TrimSpace(s)
+		for _, sep := range seps {
+			if sep == "" {
+				continue
+			}
+			t = strings.TrimPrefix(strings.TrimSuffix(t, sep), sep)
+		}
+		if t == s {
+			return t
+		}
+		s = t
+	}
+}
+
+func isSchemeChar(c byte) bool {
+	return isLetter(c) || (c >= '0' && c <= '9') || c == '+' || c == '.' || c == '-'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,190 @@
+package refiner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keepReleases is how many release directories symlink staging keeps,
+// including the one currently published.
+const keepReleases = 3
+
+// exportStage is where a run writes its exports. Without staging that is the
+// output directory itself. With staging the run writes into a separate tree,
+// seeded with the previous exports so keys that fail this run keep their
+// files, and commit publishes it: by exchanging the two directories, or by
+// repointing a symlink at a fresh release directory.
+type exportStage struct {
+	mode string
+	out  string
+	root string
+}
+
+func beginExport(out, mode string) (*exportStage, error) {
+	s := &exportStage{mode: mode, out: filepath.Clean(out)}
+	switch mode {
+	case "":
+		s.root = s.out
+		return s, os.MkdirAll(s.root, 0o755)
+	case "rename":
+		s.root = s.out + ".staging"
+	case "symlink":
+		s.root = filepath.Join(s.out+".releases", time.Now().UTC().Format("20060102T150405.000000000Z"))
+	default:
+		return nil, fmt.Errorf("unknown export staging mode %q", mode)
+	}
+
+	// Leftovers of a crashed run are discarded.
+	if err := os.RemoveAll(s.root); err != nil {
+		return nil, err
+	}
+	if src, err := filepath.EvalSymlinks(s.out); err == nil {
+		if err := copyTree(src, s.root); err != nil {
+			return nil, fmt.Errorf("seed staging from %s: %w", s.out, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return s, os.MkdirAll(s.root, 0o755)
+}
+
+// commit publishes the staged tree.
+func (s *exportStage) commit() error {
+	switch s.mode {
+	case "rename":
+		// Swapping both trees in one step never leaves out missing; the
+		// previous exports end up in root.
+		if err := exchangeDirs(s.root, s.out); err == nil {
+			return os.RemoveAll(s.root)
+		}
+		// Without an exchange (first run, other platforms, file systems
+		// lacking it), out is moved aside and briefly absent.
+		old := s.out + ".old"
+		if err := os.RemoveAll(old); err != nil {
+			return err
+		}
+		if err := os.Rename(s.out, old); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Rename(s.root, s.out); err != nil {
+			return err
+		}
+		return os.RemoveAll(old)
+	case "symlink":
+		return s.flipSymlink()
+	}
+	return nil
+}
+
+func (s *exportStage) flipSymlink() error {
+	target, err := filepath.Rel(filepath.Dir(s.out), s.root)
+	if err != nil {
+		target = s.root
+	}
+
+	// A plain directory from before staging was enabled is kept as a
+	// release so the rename below can replace it with the link.
+	if fi, err := os.Lstat(s.out); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		legacy := filepath.Join(s.out+".releases", "0-pre-staging")
+		if err := os.Rename(s.out, legacy); err != nil {
+			return err
+		}
+	}
+
+	tmp := s.out + ".link.tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.out); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return pruneReleases(s.out+".releases", filepath.Base(s.root))
+}
+
+// pruneReleases removes all but the newest keepReleases release
+// directories; release names sort chronologically, and the pre-staging copy
+// of an old plain directory sorts before all of them.
+func pruneReleases(dir, current string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != current {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keepReleases-1 {
+		if err := os.RemoveAll(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// copyTree replicates src into dst, hardlinking files where possible. This
+// is safe because exports are always replaced by rename, never rewritten in
+// place. Top-level directories named in skipDirs are left out.
+func copyTree(src, dst string, skipDirs ...string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			for _, skip := range skipDirs {
+				if rel == skip {
+					return filepath.SkipDir
+				}
+			}
+			return os.MkdirAll(target, 0o755)
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Keep the mtime, so unchanged files look unchanged after staging.
+	if fi, err := in.Stat(); err == nil {
+		_ = os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package refiner
+
+import "errors"
+
+func exchangeDirs(string, string) error {
+	return errors.New("atomic directory exchange is not supported on this platform")
+}
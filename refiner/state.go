@@ -0,0 +1,195 @@
+package refiner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// stateRetention is how long a node that stopped appearing in its feed keeps
+// its history before it is forgotten.
+const stateRetention = 7 * 24 * time.Hour
+
+var errQuarantined = errors.New("quarantined: flapping between reachable and unreachable")
+
+// runState is what persists between runs when state.path is configured.
+type runState struct {
+	Runs    int                      `json:"runs"`
+	Keys    map[string]*keyState     `json:"keys"`
+	Renames map[string]*renameState  `json:"renames,omitempty"`
+	Sources map[string]*sourceHealth `json:"sources,omitempty"`
+	// UserAgents is the User-Agent that last got through, per source host.
+	UserAgents map[string]string `json:"user_agents,omitempty"`
+	// Slices is the progress of time-sliced probing, per key.
+	Slices map[string]*sliceState `json:"slices,omitempty"`
+}
+
+type keyState struct {
+	Nodes map[string]*nodeState `json:"nodes"`
+}
+
+type nodeState struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// History holds one probe outcome per run, oldest first: '1' reachable,
+	// '0' unreachable.
+	History     string `json:"history"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+	// Streak counts consecutive successful probes.
+	Streak int `json:"streak"`
+}
+
+func loadState(path string) (*runState, error) {
+	st := &runState{Keys: map[string]*keyState{}}
+	if path == "" {
+		return st, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("state %s: %w", path, err)
+	}
+	if st.Keys == nil {
+		st.Keys = map[string]*keyState{}
+	}
+	return st, nil
+}
+
+func saveState(path string, st *runState) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+func (st *runState) key(k string) *keyState {
+	ks := st.Keys[k]
+	if ks == nil {
+		ks = &keyState{Nodes: map[string]*nodeState{}}
+		st.Keys[k] = ks
+	}
+	return ks
+}
+
+// observe appends this run's probe outcomes to each node's history, keeping
+// at most window entries, and forgets nodes unseen for stateRetention.
+func (ks *keyState) observe(results []probeResult, now time.Time, window int) {
+	for _, r := range results {
+		ns := ks.Nodes[r.line]
+		if ns == nil {
+			ns = &nodeState{FirstSeen: now}
+			ks.Nodes[r.line] = ns
+		}
+		ns.LastSeen = now
+		if r.err == nil {
+			ns.History += "1"
+			ns.Streak++
+		} else {
+			ns.History += "0"
+			ns.Streak = 0
+		}
+		if len(ns.History) > window {
+			ns.History = ns.History[len(ns.History)-window:]
+		}
+	}
+	for line, ns := range ks.Nodes {
+		if now.Sub(ns.LastSeen) > stateRetention {
+			delete(ks.Nodes, line)
+		}
+	}
+}
+
+// flaps counts reachable/unreachable transitions in a history.
+func flaps(history string) int {
+	n := 0
+	for i := 1; i < len(history); i++ {
+		if history[i] != history[i-1] {
+			n++
+		}
+	}
+	return n
+}
+
+// applyQuarantine puts nodes whose history shows at least threshold flaps
+// into quarantine and keeps them there until they have reinstateAfter
+// consecutive successes; reinstated nodes start a fresh history so old flaps
+// don't count against them again. Reachable results of quarantined nodes are
+// marked with errQuarantined so they stay out of the exports.
+func (ks *keyState) applyQuarantine(results []probeResult, threshold, reinstateAfter int) int {
+	if threshold <= 0 {
+		return 0
+	}
+	held := 0
+	for i, r := range results {
+		ns := ks.Nodes[r.line]
+		if ns == nil {
+			continue
+		}
+		if !ns.Quarantined && flaps(ns.History) >= threshold {
+			ns.Quarantined = true
+		}
+		if ns.Quarantined && ns.Streak >= reinstateAfter {
+			ns.Quarantined = false
+			if ns.Streak < len(ns.History) {
+				ns.History = ns.History[len(ns.History)-ns.Streak:]
+			}
+		}
+		if ns.Quarantined && r.err == nil {
+			results[i].err = errQuarantined
+			held++
+		}
+	}
+	return held
+}
+
+// applyGrace keeps nodes that failed this run's probe but were reachable
+// within the last graceRuns runs, so a brief server restart doesn't churn
+// them out of the exports. Quarantined nodes get no grace.
+func (ks *keyState) applyGrace(results []probeResult, graceRuns int) int {
+	if graceRuns <= 0 {
+		return 0
+	}
+	kept := 0
+	for i, r := range results {
+		ns := ks.Nodes[r.line]
+		if r.err == nil || ns == nil || ns.Quarantined {
+			continue
+		}
+		fails := len(ns.History) - len(strings.TrimRight(ns.History, "0"))
+		if fails < len(ns.History) && fails <= graceRuns {
+			results[i].graced = true
+			kept++
+		}
+	}
+	return kept
+}
+
+// applyFreshness weighs each result by how recently its node was first
+// seen, halving the weight every halfLife. Fresh nodes are less likely to be
+// blocked already.
+func (ks *keyState) applyFreshness(results []probeResult, now time.Time, halfLife time.Duration) {
+	if halfLife <= 0 {
+		return
+	}
+	for i, r := range results {
+		ns := ks.Nodes[r.line]
+		if ns == nil {
+			continue
+		}
+		age := now.Sub(ns.FirstSeen)
+		results[i].freshness = math.Pow(0.5, float64(age)/float64(halfLife))
+	}
+}
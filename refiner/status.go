@@ -0,0 +1,96 @@
+package refiner
+
+import (
+	"sync"
+	"time"
+)
+
+// statusRuns is how many past runs the daemon remembers for the dashboard.
+const statusRuns = 200
+
+// runSummary is one daemon run as shown on the dashboard.
+type runSummary struct {
+	Started  time.Time            `json:"started"`
+	Finished time.Time            `json:"finished"`
+	Error    string               `json:"error,omitempty"`
+	Keys     map[string]keyCounts `json:"keys"`
+}
+
+type keyCounts struct {
+	Valid     int `json:"valid"`
+	Reachable int `json:"reachable"`
+}
+
+// runStatus records the daemon's runs, taking the per-key counts from the
+// run's export events. The zero value is ready to use; a nil *runStatus
+// ignores everything, as one-shot runs do not need it.
+type runStatus struct {
+	NopObserver
+
+	mu      sync.Mutex
+	runs    []runSummary
+	current *runSummary
+	next    time.Time
+}
+
+func (s *runStatus) begin(now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = &runSummary{Started: now, Keys: map[string]keyCounts{}}
+}
+
+func (s *runStatus) OnExport(ev ExportEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		s.current.Keys[ev.Key] = keyCounts{Valid: ev.Valid, Reachable: len(ev.Nodes)}
+	}
+}
+
+func (s *runStatus) end(err error, next time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return
+	}
+	s.current.Finished = time.Now().UTC()
+	if err != nil {
+		s.current.Error = err.Error()
+	}
+	s.runs = append(s.runs, *s.current)
+	if len(s.runs) > statusRuns {
+		s.runs = s.runs[len(s.runs)-statusRuns:]
+	}
+	s.current, s.next = nil, next
+}
+
+// statusReport is the dashboard's view of the daemon.
+type statusReport struct {
+	Running *runSummary  `json:"running,omitempty"`
+	NextRun time.Time    `json:"next_run"`
+	Runs    []runSummary `json:"runs"`
+}
+
+func (s *runStatus) report() statusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := statusReport{NextRun: s.next, Runs: append([]runSummary(nil), s.runs...)}
+	if s.current != nil {
+		cur := *s.current
+		cur.Keys = make(map[string]keyCounts, len(s.current.Keys))
+		for k, v := range s.current.Keys {
+			cur.Keys[k] = v
+		}
+		rep.Running = &cur
+	}
+	return rep
+}
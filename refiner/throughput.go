@@ -0,0 +1,179 @@
+package refiner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ThroughputCfg enables download tests through the node itself, by running
+// xray-core with a local SOCKS inbound and the node as outbound. Only the
+// MaxNodes lowest-latency reachable nodes of a key are measured.
+type ThroughputCfg struct {
+	Enabled     bool          `yaml:"enabled"`
+	XrayPath    string        `yaml:"xray_path"`
+	URL         string        `yaml:"url"`
+	MaxBytes    int64         `yaml:"max_bytes"`
+	Duration    time.Duration `yaml:"duration"`
+	Concurrency int           `yaml:"concurrency"`
+	MaxNodes    int           `yaml:"max_nodes"`
+
+	// tempDir is disk.temp_dir, where xray's configs are written.
+	tempDir string
+}
+
+// xrayStartTimeout is how long xray gets to open its SOCKS port.
+const xrayStartTimeout = 5 * time.Second
+
+// measureThroughput fills in mbps for the fastest reachable results.
+func measureThroughput(ctx context.Context, log io.Writer, results []probeResult, cfg ThroughputCfg, key string) {
+	var idx []int
+	for i, r := range results {
+		if r.err == nil && !r.unprobed {
+			idx = append(idx, i)
+		}
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return results[idx[a]].latency < results[idx[b]].latency })
+	if len(idx) > cfg.MaxNodes {
+		idx = idx[:cfg.MaxNodes]
+	}
+
+	sem := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, i := range idx {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *probeResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			mbps, err := downloadThrough(ctx, r.line, cfg)
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			r.mbps = mbps
+		}(&results[i])
+	}
+	wg.Wait()
+	fmt.Fprintf(log, "Info: %s -> measured throughput of %d nodes (%d failed)\n", key, len(idx)-failed, failed)
+}
+
+// downloadThrough starts xray for line and downloads cfg.URL through it
+// until MaxBytes or Duration is reached, returning megabits per second.
+func downloadThrough(ctx context.Context, line string, cfg ThroughputCfg) (float64, error) {
+	ob, err := xrayOutbound(line, "proxy")
+	if err != nil {
+		return 0, err
+	}
+	port, err := freePort()
+	if err != nil {
+		return 0, err
+	}
+	conf := map[string]any{
+		"log": map[string]any{"loglevel": "none"},
+		"inbounds": []any{map[string]any{
+			"listen": "127.0.0.1", "port": port, "protocol": "socks",
+			"settings": map[string]any{"udp": false},
+		}},
+		"outbounds": []any{ob},
+	}
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return 0, err
+	}
+	dir, err := os.MkdirTemp(cfg.tempDir, "xsr-xray-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	confPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(confPath, b, 0o600); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, xrayStartTimeout+cfg.Duration+5*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cfg.XrayPath, "run", "-c", confPath)
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start xray: %w", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if err := waitListening(ctx, addr); err != nil {
+		return 0, err
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: addr}),
+	}}
+	dctx, dcancel := context.WithTimeout(ctx, cfg.Duration)
+	defer dcancel()
+	req, err := http.NewRequestWithContext(dctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, cfg.MaxBytes))
+	elapsed := time.Since(start)
+	// Running into Duration still yields a valid sample.
+	if err != nil && dctx.Err() == nil {
+		return 0, err
+	}
+	if n == 0 || elapsed <= 0 {
+		return 0, fmt.Errorf("no data received")
+	}
+	return float64(n) * 8 / elapsed.Seconds() / 1e6, nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitListening(ctx context.Context, addr string) error {
+	deadline := time.Now().Add(xrayStartTimeout)
+	for time.Now().Before(deadline) {
+		c, err := net.DialTimeout("tcp", addr, 200*time.Millisecond)
+		if err == nil {
+			c.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("xray did not open %s", addr)
+}
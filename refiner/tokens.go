@@ -0,0 +1,194 @@
+package refiner
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// accessToken is one client's key to the served subscriptions. The token
+// itself is part of the subscription URL, so revoking it cuts off exactly
+// the links handed to that client.
+type accessToken struct {
+	Token     string     `json:"token"`
+	Name      string     `json:"name"`
+	Created   time.Time  `json:"created"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// tokenStore keeps the tokens in a JSON file. The file is reloaded when it
+// changes, so tokens created or revoked from the CLI apply to a running
+// server.
+type tokenStore struct {
+	path string
+
+	mu     sync.Mutex
+	mod    time.Time
+	tokens []accessToken
+}
+
+func (s *tokenStore) load() error {
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.mod) && s.tokens != nil {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var tokens []accessToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return fmt.Errorf("tokens %s: %w", s.path, err)
+	}
+	s.tokens, s.mod = tokens, fi.ModTime()
+	return nil
+}
+
+func (s *tokenStore) save() error {
+	b, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.mod = fi.ModTime()
+	}
+	return nil
+}
+
+// lookup returns the active token t, or nil. Every token is compared in
+// constant time.
+func (s *tokenStore) lookup(t string) *accessToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "!! %v\n", err)
+	}
+	var found *accessToken
+	for i := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(s.tokens[i].Token), []byte(t)) == 1 && s.tokens[i].RevokedAt == nil {
+			tok := s.tokens[i]
+			found = &tok
+		}
+	}
+	return found
+}
+
+func (s *tokenStore) list() ([]accessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return append([]accessToken(nil), s.tokens...), nil
+}
+
+func (s *tokenStore) create(name string) (accessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return accessToken{}, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return accessToken{}, err
+	}
+	tok := accessToken{Token: hex.EncodeToString(b), Name: name, Created: time.Now().UTC()}
+	s.tokens = append(s.tokens, tok)
+	return tok, s.save()
+}
+
+// revoke revokes every active token whose value or name is ref and returns
+// how many there were.
+func (s *tokenStore) revoke(ref string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	n := 0
+	for i := range s.tokens {
+		t := &s.tokens[i]
+		if t.RevokedAt == nil && (t.Token == ref || t.Name == ref) {
+			t.RevokedAt = &now
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no active token %q", ref)
+	}
+	return n, s.save()
+}
+
+// runToken manages serve tokens from the command line:
+//
+//	xraysubrefiner token create -name alice
+//	xraysubrefiner token revoke alice
+//	xraysubrefiner token list
+func runToken(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: xraysubrefiner token create|revoke|list [flags]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yaml", "path to config.yaml")
+	name := fs.String("name", "", "client name (create)")
+	_ = fs.Parse(args[1:])
+
+	cfg, err := LoadConfig(*cfgPath)
+	must(err)
+	if cfg.Serve.TokensFile == "" {
+		must(errors.New("serve.tokens_file is not set in config.yaml"))
+	}
+	s := &tokenStore{path: cfg.Serve.TokensFile}
+
+	switch args[0] {
+	case "create":
+		if *name == "" {
+			must(errors.New("token create needs -name"))
+		}
+		tok, err := s.create(*name)
+		must(err)
+		fmt.Println(tok.Token)
+	case "revoke":
+		if fs.NArg() != 1 {
+			must(errors.New("usage: xraysubrefiner token revoke <name|token>"))
+		}
+		n, err := s.revoke(fs.Arg(0))
+		must(err)
+		fmt.Fprintf(os.Stderr, "Info: revoked %d token(s)\n", n)
+	case "list":
+		tokens, err := s.list()
+		must(err)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTOKEN\tCREATED\tSTATUS")
+		for _, t := range tokens {
+			status := "active"
+			if t.RevokedAt != nil {
+				status = "revoked " + t.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Name, t.Token, t.Created.Format(time.RFC3339), status)
+		}
+		must(w.Flush())
+	default:
+		must(fmt.Errorf("unknown token command %q", args[0]))
+	}
+}
@@ -1,12 +1,11 @@
-package main
+package refiner
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -32,7 +31,19 @@ func validateLines(lines []string, key string) error {
 		key, len(problems), strings.Join(problems, "\n"))
 }
 
+// validateLine checks the link syntax of line and then its server host.
 func validateLine(line string) error {
+	if err := validateLinkSyntax(line); err != nil {
+		return err
+	}
+	n, err := parseNode(line)
+	if err != nil {
+		return err
+	}
+	return validateHost(n.Host)
+}
+
+func validateLinkSyntax(line string) error {
 	switch {
 	case strings.HasPrefix(line, "vmess://"):
 		return validateVmess(line)
@@ -42,71 +53,68 @@ func validateLine(line string) error {
 		return validateTrojan(line)
 	case strings.HasPrefix(line, "ss://"):
 		return validateShadowsocks(line)
+	case strings.HasPrefix(line, "tuic://"),
+		strings.HasPrefix(line, "hysteria2://"),
+		strings.HasPrefix(line, "hy2://"),
+		strings.HasPrefix(line, "hysteria://"):
+		return validateQUIC(line)
 	default:
 		return fmt.Errorf("unsupported or unexpected scheme")
 	}
 }
 
-func filterValidLines(lines []string, key string) []string {
-    var out []string
+func filterValidLines(log io.Writer, lines []string, key string, rej *rejects) []string {
+	var out []string
 
-    for idx, raw := range lines {
-        line := strings.TrimSpace(raw)
-        if line == "" {
-            continue
-        }
+	for idx, raw := range lines {
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			continue
+		}
 
-        if err := validateLine(line); err != nil {
-            fmt.Fprintf(os.Stderr, "!! %s: skip invalid line [%d]: %v\n", key, idx, err)
-            continue
-        }
+		if err := validateLine(line); err != nil {
+			fmt.Fprintf(log, "!! %s: skip invalid line [%d]: %v\n", key, idx, err)
+			rej.add(line, "validation", err.Error())
+			continue
+		}
 
-        out = append(out, line)
-    }
+		out = append(out, line)
+	}
 
-    return out
+	return out
 }
 
 func validateVmess(line string) error {
-    raw := strings.TrimPrefix(line, "vmess://")
-
-    if i := strings.IndexByte(raw, '#'); i >= 0 {
-        raw = raw[:i]
-    }
-    raw = strings.TrimSpace(raw)
-    if raw == "" {
-        return errors.New("vmess: empty payload after trimming fragment")
-    }
-
-    payload, err := decodeVmessBase64(raw)
-    if err != nil {
-        return fmt.Errorf("vmess base64 decode: %w", err)
-    }
+	m, err := decodeVmessPayload(line)
+	if err != nil {
+		return err
+	}
 
-    var m map[string]any
-    if err := json.Unmarshal(payload, &m); err != nil {
-        return fmt.Errorf("vmess json: %w", err)
-    }
+	host, _ := m["add"].(string)
+	if strings.TrimSpace(host) == "" {
+		return errors.New("vmess: missing add (server)")
+	}
 
-    host, _ := m["add"].(string)
-    if strings.TrimSpace(host) == "" {
-        return errors.New("vmess: missing add (server)")
-    }
+	port, err := extractPortFromJSON(m["port"])
+	if err != nil {
+		return fmt.Errorf("vmess: %w", err)
+	}
+	if port <= 0 || port > 99999 {
+		return fmt.Errorf("vmess: invalid port %d", port)
+	}
 
-    port, err := extractPortFromJSON(m["port"])
-    if err != nil {
-        return fmt.Errorf("vmess: %w", err)
-    }
-    if port <= 0 || port > 99999 {
-        return fmt.Errorf("vmess: invalid port %d", port)
-    }
+	id, _ := m["id"].(string)
+	if strings.TrimSpace(id) == "" {
+		return errors.New("vmess: missing id (UUID)")
+	}
 
-    id, _ := m["id"].(string)
-    if strings.TrimSpace(id) == "" {
-        return errors.New("vmess: missing id (UUID)")
-    }
+	netw, _ := m["net"].(string)
+	path, _ := m["path"].(string)
+	if err := validateGRPCServiceName(netw, path); err != nil {
+		return fmt.Errorf("vmess: %w", err)
+	}
 
-    return nil
+	return nil
 }
 
 func decodeVmessBase64(b64 string) ([]byte, error) {
@@ -147,32 +155,33 @@ func extractPortFromJSON(v any) (int, error) {
 }
 
 func validateVless(line string) error {
-    u, err := url.Parse(line)
-    if err != nil {
-        return fmt.Errorf("parse: %w", err)
-    }
+	u, err := url.Parse(line)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
 
-    if u.Hostname() == "" {
-        return errors.New("missing host")
-    }
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
 
-    port, err := parsePort(u.Port())
-    if err != nil {
-        return err
-    }
-    if port <= 0 || port > 65535 {
-        return fmt.Errorf("invalid port %d", port)
-    }
+	port, err := parsePort(u.Port())
+	if err != nil {
+		return err
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
 
-    user := ""
-    if u.User != nil {
-        user = u.User.Username()
-    }
-    if strings.TrimSpace(user) == "" {
-        return errors.New("missing user/id in vless url")
-    }
+	user := ""
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	if strings.TrimSpace(user) == "" {
+		return errors.New("missing user/id in vless url")
+	}
 
-    return nil
+	q := u.Query()
+	return validateGRPCServiceName(q.Get("type"), q.Get("serviceName"))
 }
 
 func validateTrojan(line string) error {
@@ -197,10 +206,26 @@ func validateTrojan(line string) error {
 	if strings.TrimSpace(pass) == "" {
 		return errors.New("missing trojan password in user part")
 	}
+	q := u.Query()
+	return validateGRPCServiceName(q.Get("type"), q.Get("serviceName"))
+}
+
+// validateGRPCServiceName rejects grpc transports without a service name:
+// clients connect to them fine but no data ever flows.
+func validateGRPCServiceName(transport, serviceName string) error {
+	if !strings.EqualFold(strings.TrimSpace(transport), "grpc") {
+		return nil
+	}
+	if strings.TrimSpace(serviceName) == "" {
+		return errors.New("grpc transport without serviceName")
+	}
 	return nil
 }
 
-func validateShadowsocks(line string) error {
+// validateQUIC covers the URL-style QUIC protocols (tuic, hysteria, hysteria2):
+// all of them need a host, a port and credentials in the user part, except
+// hysteria v1 which may carry auth in the query.
+func validateQUIC(line string) error {
 	u, err := url.Parse(line)
 	if err != nil {
 		return fmt.Errorf("parse: %w", err)
@@ -215,6 +240,30 @@ func validateShadowsocks(line string) error {
 	if port <= 0 || port > 65535 {
 		return fmt.Errorf("invalid port %d", port)
 	}
+	if strings.EqualFold(u.Scheme, "hysteria") {
+		return nil
+	}
+	if u.User == nil || strings.TrimSpace(u.User.Username()) == "" {
+		return errors.New("missing credentials in user part")
+	}
+	return nil
+}
+
+func validateShadowsocks(line string) error {
+	u, err := url.Parse(expandLegacySS(line))
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	port, err := parsePort(u.Port())
+	if err != nil {
+		return err
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
 
 	user := ""
 	if u.User != nil {
@@ -238,7 +287,7 @@ func validateShadowsocks(line string) error {
 }
 
 func decodeSSUserInfo(user string) (method string, err error) {
-	if dec, decErr := base64.StdEncoding.DecodeString(user); decErr == nil {
+	if dec, decErr := decodeVmessBase64(user); decErr == nil {
 		if parts := strings.SplitN(string(dec), ":", 2); len(parts) == 2 {
 			return parts[0], nil
 		}
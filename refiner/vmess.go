@@ -0,0 +1,291 @@
+package refiner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// decodeVmessPayload returns the JSON object of a vmess link. Besides the
+// usual base64 JSON it accepts the alternative form some clients (v2rayNG,
+// Shadowrocket) emit: "security:uuid@host:port", plain or base64, followed
+// by a query with the transport settings. That form is mapped onto the JSON
+// keys so the rest of the pipeline sees one shape.
+func decodeVmessPayload(line string) (map[string]any, error) {
+	raw := strings.TrimPrefix(line, "vmess://")
+	raw, frag, _ := strings.Cut(raw, "#")
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("vmess: empty payload after trimming fragment")
+	}
+
+	body, query, _ := strings.Cut(raw, "?")
+	if strings.Contains(body, "@") {
+		return vmessAltPayload(body, query, frag)
+	}
+
+	payload, err := decodeVmessBase64(body)
+	if err != nil {
+		return nil, fmt.Errorf("vmess base64 decode: %w", err)
+	}
+	if t := bytes.TrimSpace(payload); len(t) > 0 && t[0] != '{' && bytes.Contains(t, []byte("@")) {
+		return vmessAltPayload(string(t), query, frag)
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, fmt.Errorf("vmess json: %w", err)
+	}
+	return m, nil
+}
+
+func vmessAltPayload(body, query, frag string) (map[string]any, error) {
+	at := strings.LastIndexByte(body, '@')
+	user, hostport := body[:at], body[at+1:]
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("vmess: %w", err)
+	}
+	scy, id, ok := strings.Cut(user, ":")
+	if !ok {
+		scy, id = "auto", user
+	}
+
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("vmess query: %w", err)
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := strings.TrimSpace(q.Get(k)); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	m := map[string]any{
+		"v":    "2",
+		"add":  host,
+		"port": port,
+		"id":   id,
+		"scy":  scy,
+		"aid":  "0",
+	}
+	if aid := first("alterId", "aid"); aid != "" {
+		m["aid"] = aid
+	}
+
+	netw := strings.ToLower(first("type", "network", "net", "obfs"))
+	switch netw {
+	case "", "none":
+		netw = "tcp"
+	case "websocket":
+		netw = "ws"
+	}
+	m["net"] = netw
+	if h := first("host", "obfsParam"); h != "" {
+		m["host"] = h
+	}
+	if netw == "grpc" {
+		m["path"] = first("serviceName", "path")
+	} else if p := first("path"); p != "" {
+		m["path"] = p
+	}
+
+	switch sec := strings.ToLower(first("security", "tls")); sec {
+	case "1", "true", "tls":
+		m["tls"] = "tls"
+	case "reality":
+		m["tls"] = "reality"
+	}
+	if sni := first("sni", "peer"); sni != "" {
+		m["sni"] = sni
+	}
+	for _, k := range []string{"fp", "alpn", "pbk", "sid", "spx"} {
+		if v := first(k); v != "" {
+			m[k] = v
+		}
+	}
+
+	ps := first("remarks", "remark")
+	if ps == "" {
+		ps, _ = url.PathUnescape(frag)
+	}
+	if ps != "" {
+		m["ps"] = ps
+	}
+	return m, nil
+}
+
+// VmessCfg tunes vmess handling. Lenient repairs sloppy JSON payloads
+// (trailing commas, single quotes, bare words) instead of dropping them.
+type VmessCfg struct {
+	Lenient bool `yaml:"lenient"`
+}
+
+// repairVmessLines rewrites vmess links whose JSON payload only parses after
+// repairJSON as links with the repaired payload, so strict parsing applies
+// downstream. It returns the lines and how many were repaired.
+func repairVmessLines(lines []string) ([]string, int) {
+	out := make([]string, 0, len(lines))
+	repaired := 0
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "vmess://") {
+			out = append(out, l)
+			continue
+		}
+		if _, err := decodeVmessPayload(l); err == nil {
+			out = append(out, l)
+			continue
+		}
+		raw, frag, hasFrag := strings.Cut(strings.TrimPrefix(l, "vmess://"), "#")
+		payload, err := decodeVmessBase64(raw)
+		if err != nil {
+			out = append(out, l)
+			continue
+		}
+		fixed := repairJSON(string(payload))
+		var m map[string]any
+		if err := json.Unmarshal([]byte(fixed), &m); err != nil {
+			out = append(out, l)
+			continue
+		}
+		link := "vmess://" + base64.StdEncoding.EncodeToString([]byte(fixed))
+		if hasFrag {
+			link += "#" + frag
+		}
+		out = append(out, link)
+		repaired++
+	}
+	return out, repaired
+}
+
+// repairJSON fixes the mistakes hand-made vmess payloads commonly contain:
+// single-quoted strings, trailing commas, and bare words or malformed
+// numbers (like 0443) where strings belong. Valid JSON passes unchanged.
+func repairJSON(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				j = len(s) - 1
+			}
+			b.WriteString(s[i : j+1])
+			i = j
+		case c == '\'':
+			b.WriteByte('"')
+			j := i + 1
+			for ; j < len(s) && s[j] != '\''; j++ {
+				switch {
+				case s[j] == '\\' && j+1 < len(s) && s[j+1] == '\'':
+					b.WriteByte('\'')
+					j++
+				case s[j] == '\\' && j+1 < len(s):
+					b.WriteString(s[j : j+2])
+					j++
+				case s[j] == '"':
+					b.WriteString(`\"`)
+				default:
+					b.WriteByte(s[j])
+				}
+			}
+			b.WriteByte('"')
+			i = j
+		case c == ',':
+			j := i + 1
+			for j < len(s) && isJSONSpace(s[j]) {
+				j++
+			}
+			if j < len(s) && (s[j] == '}' || s[j] == ']') {
+				continue
+			}
+			b.WriteByte(c)
+		case isJSONSpace(c) || strings.IndexByte("{}[]:", c) >= 0:
+			b.WriteByte(c)
+		default:
+			j := i
+			for j < len(s) && !isJSONSpace(s[j]) && strings.IndexByte(",{}[]:", s[j]) < 0 {
+				j++
+			}
+			tok := s[i:j]
+			if tok == "true" || tok == "false" || tok == "null" || json.Valid([]byte(tok)) {
+				b.WriteString(tok)
+			} else {
+				q, _ := json.Marshal(tok)
+				b.Write(q)
+			}
+			i = j - 1
+		}
+	}
+	return b.String()
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// canonicalVmess re-encodes a vmess link from its decoded payload: keys in
+// sorted order, every scalar as a string (port and aid included) and
+// v "2", so that differently encoded copies of one node dedupe. A trailing
+// #fragment becomes the ps remark unless the payload has one.
+func canonicalVmess(line string) (string, error) {
+	m, err := decodeVmessPayload(line)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range m {
+		switch val := v.(type) {
+		case float64:
+			m[k] = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			m[k] = strconv.FormatBool(val)
+		}
+	}
+	m["v"] = "2"
+	if _, frag, ok := strings.Cut(line, "#"); ok && jsonString(m, "ps") == "" {
+		if ps, err := url.PathUnescape(frag); err == nil && ps != "" {
+			m["ps"] = ps
+		}
+	}
+
+	return encodeVmess(m)
+}
+
+// encodeVmess builds a vmess link from a payload, with keys sorted.
+func encodeVmess(m map[string]any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		return "", err
+	}
+	return "vmess://" + base64.StdEncoding.EncodeToString(bytes.TrimSpace(buf.Bytes())), nil
+}
+
+func canonicalVmessLines(lines []string) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if strings.HasPrefix(l, "vmess://") {
+			if c, err := canonicalVmess(l); err == nil {
+				l = c
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package refiner
+
+import "fmt"
+
+// WeightedSource is one entry of a key's sources list. Weight sets how
+// much of the key the source contributes against the others.
+type WeightedSource struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// expandSources turns every key with sources into a merge of hidden
+// member keys, one per source, refined like the key itself but not
+// exported. The members precede their key, as merge members must.
+func expandSources(subs []Subscription) ([]Subscription, error) {
+	var out []Subscription
+	for _, sub := range subs {
+		if len(sub.Sources) == 0 {
+			out = append(out, sub)
+			continue
+		}
+		if sub.URL != "" || len(sub.Merge) > 0 {
+			return nil, fmt.Errorf("%s: sources replaces url and merge", sub.Key)
+		}
+		sub.weights = make([]int, len(sub.Sources))
+		for i, s := range sub.Sources {
+			if s.URL == "" {
+				return nil, fmt.Errorf("%s: sources[%d]: url is required", sub.Key, i)
+			}
+			if s.Weight < 0 {
+				return nil, fmt.Errorf("%s: sources[%d]: weight must not be negative", sub.Key, i)
+			}
+			sub.weights[i] = max(s.Weight, 1)
+			m := sub
+			m.Key = fmt.Sprintf("%s.source%d", sub.Key, i+1)
+			m.URL, m.Sources, m.Merge, m.weights, m.PreviousKeys = s.URL, nil, nil, nil, nil
+			m.hidden = true
+			out = append(out, m)
+			sub.Merge = append(sub.Merge, m.Key)
+		}
+		out = append(out, sub)
+	}
+	return out, nil
+}
+
+// weightedOrder interleaves the lines of members so that, read from the
+// end, where tail outputs and caps pick from, member i comes up weights[i]
+// times as often as a member of weight one, each in its own order. Members
+// that run out leave the rest to the others; repeated lines keep their
+// newest position.
+func weightedOrder(members [][]string, weights []int) []string {
+	next := make([]int, len(members))
+	credit := make([]int, len(members))
+	for i, m := range members {
+		next[i] = len(m) - 1
+	}
+	seen := map[string]bool{}
+	var rev []string
+	for {
+		best, total := -1, 0
+		for i := range members {
+			if next[i] < 0 {
+				continue
+			}
+			credit[i] += weights[i]
+			total += weights[i]
+			if best < 0 || credit[i] > credit[best] {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		credit[best] -= total
+		l := members[best][next[best]]
+		next[best]--
+		if !seen[l] {
+			seen[l] = true
+			rev = append(rev, l)
+		}
+	}
+	out := make([]string, len(rev))
+	for i, l := range rev {
+		out[len(rev)-1-i] = l
+	}
+	return out
+}
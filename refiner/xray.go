@@ -0,0 +1,137 @@
+package refiner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// param returns a link parameter: from the query of URL-style links, or the
+// JSON payload of vmess links.
+func (n *node) param(key string) string {
+	if n.Vmess != nil {
+		return jsonString(n.Vmess, key)
+	}
+	if n.Query != nil {
+		return n.Query.Get(key)
+	}
+	return ""
+}
+
+// xrayOutbound builds the xray-core outbound object for the node in line.
+// vless, vmess, trojan and shadowsocks are supported.
+func xrayOutbound(line, tag string) (map[string]any, error) {
+	n, err := parseNode(line)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{"tag": tag}
+	switch n.Scheme {
+	case "vless":
+		user := map[string]any{"id": n.User, "encryption": "none"}
+		if f := n.param("flow"); f != "" {
+			user["flow"] = f
+		}
+		out["protocol"] = "vless"
+		out["settings"] = map[string]any{"vnext": []any{map[string]any{
+			"address": n.Host, "port": n.Port, "users": []any{user},
+		}}}
+	case "vmess":
+		aid, _ := strconv.Atoi(fmt.Sprint(n.Vmess["aid"]))
+		scy := n.param("scy")
+		if scy == "" {
+			scy = "auto"
+		}
+		out["protocol"] = "vmess"
+		out["settings"] = map[string]any{"vnext": []any{map[string]any{
+			"address": n.Host, "port": n.Port,
+			"users": []any{map[string]any{"id": n.User, "alterId": aid, "security": scy}},
+		}}}
+	case "trojan":
+		out["protocol"] = "trojan"
+		out["settings"] = map[string]any{"servers": []any{map[string]any{
+			"address": n.Host, "port": n.Port, "password": n.User,
+		}}}
+	case "ss":
+		l, err := parseSSLink(line)
+		if err != nil {
+			return nil, err
+		}
+		out["protocol"] = "shadowsocks"
+		out["settings"] = map[string]any{"servers": []any{map[string]any{
+			"address": n.Host, "port": n.Port, "method": l.Method, "password": l.Password,
+		}}}
+	default:
+		return nil, fmt.Errorf("xray: unsupported scheme %s", n.Scheme)
+	}
+	out["streamSettings"] = xrayStream(n)
+	return out, nil
+}
+
+func xrayStream(n *node) map[string]any {
+	network := n.Transport
+	if network == "" {
+		network = "tcp"
+	}
+	ss := map[string]any{"network": network}
+
+	switch network {
+	case "ws":
+		ws := map[string]any{"path": n.Path}
+		if h := n.firstHostHeader(); h != "" {
+			ws["headers"] = map[string]any{"Host": h}
+		}
+		ss["wsSettings"] = ws
+	case "httpupgrade":
+		ss["httpupgradeSettings"] = map[string]any{"path": n.Path, "host": n.firstHostHeader()}
+	case "grpc":
+		ss["grpcSettings"] = map[string]any{"serviceName": n.ServiceName, "multiMode": n.param("mode") == "multi"}
+	case "h2", "http":
+		h := map[string]any{"path": n.Path}
+		if n.HostHeader != "" {
+			h["host"] = strings.Split(n.HostHeader, ",")
+		}
+		ss["network"] = "http"
+		ss["httpSettings"] = h
+	case "tcp":
+		// vmess links carry the header type as "type".
+		header := n.param("headerType")
+		if n.Vmess != nil {
+			header = n.param("type")
+		}
+		if header == "http" {
+			ss["tcpSettings"] = map[string]any{"header": map[string]any{"type": "http"}}
+		}
+	}
+
+	switch n.Security {
+	case "tls":
+		t := map[string]any{"serverName": n.tlsServerName()}
+		if fp := n.param("fp"); fp != "" {
+			t["fingerprint"] = fp
+		}
+		if alpn := n.param("alpn"); alpn != "" {
+			t["alpn"] = strings.Split(alpn, ",")
+		}
+		if n.param("allowInsecure") == "1" {
+			t["allowInsecure"] = true
+		}
+		ss["security"] = "tls"
+		ss["tlsSettings"] = t
+	case "reality":
+		fp := n.param("fp")
+		if fp == "" {
+			fp = "chrome"
+		}
+		ss["security"] = "reality"
+		ss["realitySettings"] = map[string]any{
+			"serverName":  n.tlsServerName(),
+			"fingerprint": fp,
+			"publicKey":   n.param("pbk"),
+			"shortId":     n.param("sid"),
+			"spiderX":     n.param("spx"),
+		}
+	}
+	return ss
+}
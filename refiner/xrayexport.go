@@ -0,0 +1,134 @@
+package refiner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// XrayCfg shapes the full client configs of "xray" outputs. Fragment
+// splits the TLS ClientHello through a freedom outbound, which gets past
+// SNI-based DPI; Mux multiplexes connections over one. Keys may override
+// either.
+type XrayCfg struct {
+	Fragment *FragmentCfg `yaml:"fragment"`
+	Mux      *MuxCfg      `yaml:"mux"`
+	// SocksPort and HTTPPort are the local inbounds (default 10808, 10809).
+	SocksPort int `yaml:"socks_port"`
+	HTTPPort  int `yaml:"http_port"`
+}
+
+// FragmentCfg is xray's freedom fragment setting, e.g. packets "tlshello",
+// length "100-200", interval "10-20" (milliseconds).
+type FragmentCfg struct {
+	Packets  string `yaml:"packets"`
+	Length   string `yaml:"length"`
+	Interval string `yaml:"interval"`
+}
+
+type MuxCfg struct {
+	Enabled     bool `yaml:"enabled"`
+	Concurrency int  `yaml:"concurrency"`
+}
+
+// merge returns c with the set fields of o applied on top.
+func (c XrayCfg) merge(o XrayCfg) XrayCfg {
+	if o.Fragment != nil {
+		c.Fragment = o.Fragment
+	}
+	if o.Mux != nil {
+		c.Mux = o.Mux
+	}
+	if o.SocksPort > 0 {
+		c.SocksPort = o.SocksPort
+	}
+	if o.HTTPPort > 0 {
+		c.HTTPPort = o.HTTPPort
+	}
+	return c
+}
+
+func (c XrayCfg) check() error {
+	if f := c.Fragment; f != nil && (f.Packets == "" || f.Length == "" || f.Interval == "") {
+		return fmt.Errorf("xray.fragment needs packets, length and interval")
+	}
+	if m := c.Mux; m != nil && (m.Concurrency < 0 || m.Concurrency > 1024) {
+		return fmt.Errorf("xray.mux.concurrency must be between 0 and 1024, got %d", m.Concurrency)
+	}
+	for _, p := range []int{c.SocksPort, c.HTTPPort} {
+		if p < 0 || p > 65535 {
+			return fmt.Errorf("xray: port %d out of range", p)
+		}
+	}
+	return nil
+}
+
+// xrayConfigs encodes lines as a JSON array of complete xray client
+// configs, one per node, as v2rayNG and Streisand import them. Lines xray
+// has no outbound for are left out.
+func xrayConfigs(lines []string, c XrayCfg) ([]byte, error) {
+	socksPort, httpPort := c.SocksPort, c.HTTPPort
+	if socksPort == 0 {
+		socksPort = 10808
+	}
+	if httpPort == 0 {
+		httpPort = 10809
+	}
+	confs := make([]any, 0, len(lines))
+	for _, l := range lines {
+		ob, err := xrayOutbound(l, "proxy")
+		if err != nil {
+			continue
+		}
+		n, err := parseNode(l)
+		if err != nil {
+			continue
+		}
+		outbounds := []any{ob,
+			map[string]any{"tag": "direct", "protocol": "freedom"},
+			map[string]any{"tag": "block", "protocol": "blackhole"},
+		}
+		if f := c.Fragment; f != nil {
+			ob["streamSettings"].(map[string]any)["sockopt"] = map[string]any{"dialerProxy": "fragment"}
+			outbounds = append(outbounds, map[string]any{
+				"tag": "fragment", "protocol": "freedom",
+				"settings": map[string]any{"fragment": map[string]any{
+					"packets": f.Packets, "length": f.Length, "interval": f.Interval,
+				}},
+			})
+		}
+		// XTLS flows cannot be multiplexed.
+		if m := c.Mux; m != nil && m.Enabled && n.param("flow") == "" {
+			mux := map[string]any{"enabled": true}
+			if m.Concurrency > 0 {
+				mux["concurrency"] = m.Concurrency
+			}
+			ob["mux"] = mux
+		}
+		remark := n.Remark
+		if remark == "" {
+			remark = fmt.Sprintf("%s %s:%d", n.Scheme, n.Host, n.Port)
+		}
+		confs = append(confs, map[string]any{
+			"remarks": remark,
+			"log":     map[string]any{"loglevel": "warning"},
+			"inbounds": []any{
+				map[string]any{
+					"tag": "socks", "listen": "127.0.0.1", "port": socksPort, "protocol": "socks",
+					"settings": map[string]any{"udp": true},
+					"sniffing": map[string]any{"enabled": true, "destOverride": []string{"http", "tls"}},
+				},
+				map[string]any{"tag": "http", "listen": "127.0.0.1", "port": httpPort, "protocol": "http"},
+			},
+			"outbounds": outbounds,
+		})
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(confs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
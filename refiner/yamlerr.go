@@ -0,0 +1,148 @@
+package refiner
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// reYAMLTypeError splits a yaml.v3 TypeError entry into its line and the
+// rest; the value yaml could not use is quoted in backticks, shortened to
+// seven characters and "..." when longer than ten.
+var (
+	reYAMLTypeError = regexp.MustCompile("^line ([0-9]+): (.*)$")
+	reYAMLValue     = regexp.MustCompile("`([^`]*)`")
+)
+
+// configErrors lists every field of a config that could not be decoded,
+// each with its position in the file and its path, e.g.
+//
+//	line 14, column 16 (subscriptions[2].probe.timeout): cannot unmarshal !!str `fast` into time.Duration
+type configErrors []string
+
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return e[0]
+	}
+	return fmt.Sprintf("%d errors:\n  %s", len(e), strings.Join(e, "\n  "))
+}
+
+// describeYAMLError adds the column and field path to the entries of a
+// yaml.TypeError from decoding doc. Positions come from orig, the file as
+// written, which differs from doc when secrets were substituted. Syntax
+// errors already carry their line.
+func describeYAMLError(err error, doc, orig []byte) error {
+	var te *yaml.TypeError
+	if !errors.As(err, &te) {
+		return configErrors{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	var root, origRoot yaml.Node
+	if yaml.Unmarshal(doc, &root) != nil {
+		return err
+	}
+	if yaml.Unmarshal(orig, &origRoot) != nil {
+		origRoot = root
+	}
+
+	out := make(configErrors, 0, len(te.Errors))
+	for _, msg := range te.Errors {
+		m := reYAMLTypeError.FindStringSubmatch(msg)
+		if m == nil {
+			out = append(out, msg)
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		var value string
+		if v := reYAMLValue.FindStringSubmatch(m[2]); v != nil {
+			value = v[1]
+		}
+		path, ok := yamlPathAt(&root, line, value)
+		if !ok {
+			out = append(out, msg)
+			continue
+		}
+		pos := fmt.Sprintf("line %d", line)
+		if n := yamlNodeAt(&origRoot, path); n != nil {
+			pos = fmt.Sprintf("line %d, column %d", n.Line, n.Column)
+		}
+		out = append(out, fmt.Sprintf("%s (%s): %s", pos, yamlPathString(path), m[2]))
+	}
+	return out
+}
+
+// yamlPathAt returns the path of the value node on line that best matches
+// value: one whose text value is (or, when shortened, starts with), else
+// the first value on the line.
+func yamlPathAt(root *yaml.Node, line int, value string) ([]string, bool) {
+	prefix, short := strings.CutSuffix(value, "...")
+	var first, match []string
+	var walk func(n *yaml.Node, path []string)
+	walk = func(n *yaml.Node, path []string) {
+		if n.Line == line && match == nil {
+			if first == nil {
+				first = path
+			}
+			if n.Kind == yaml.ScalarNode && (n.Value == value || short && strings.HasPrefix(n.Value, prefix)) {
+				match = path
+			}
+		}
+		switch n.Kind {
+		case yaml.DocumentNode:
+			for _, c := range n.Content {
+				walk(c, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				walk(n.Content[i+1], append(path[:len(path):len(path)], n.Content[i].Value))
+			}
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				walk(c, append(path[:len(path):len(path)], "["+strconv.Itoa(i)+"]"))
+			}
+		}
+	}
+	walk(root, []string{})
+	if match != nil {
+		return match, true
+	}
+	return first, first != nil
+}
+
+// yamlNodeAt follows path from root.
+func yamlNodeAt(root *yaml.Node, path []string) *yaml.Node {
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, p := range path {
+		var next *yaml.Node
+		switch {
+		case n.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					next = n.Content[i+1]
+				}
+			}
+		case n.Kind == yaml.SequenceNode && strings.HasPrefix(p, "["):
+			if i, err := strconv.Atoi(strings.Trim(p, "[]")); err == nil && i < len(n.Content) {
+				next = n.Content[i]
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+func yamlPathString(path []string) string {
+	if len(path) == 0 {
+		return "top level"
+	}
+	return strings.ReplaceAll(strings.Join(path, "."), ".[", "[")
+}